@@ -0,0 +1,336 @@
+package sips
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a client for a pinning service. It implements PinHandler
+// and TokenHandler by sending requests to the service over HTTP, so it
+// can be passed to Handler in order to proxy requests to another
+// service.
+//
+// Requests are authenticated using the token associated with the
+// context passed to each method, if there is one, such as when the
+// Client is being used by Handler. Otherwise, the token provided via
+// WithToken is used.
+type Client struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+// NewClient returns a new Client created with the given options.
+func NewClient(options ...ClientOption) *Client {
+	c := Client{
+		client: http.DefaultClient,
+		base:   "http://localhost:8080",
+	}
+	for _, option := range options {
+		option(&c)
+	}
+
+	return &c
+}
+
+func (c *Client) do(ctx context.Context, data interface{}, method, endpoint string, args url.Values, body interface{}) error {
+	url := c.base + endpoint
+	if len(args) > 0 {
+		url += "?" + args.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	token, ok := Token(ctx)
+	if !ok {
+		token = c.token
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%v %q: %w", method, endpoint, err)
+	}
+	defer rsp.Body.Close()
+
+	buf, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	if (rsp.StatusCode < 200) || (rsp.StatusCode >= 300) {
+		err := newError(rsp.StatusCode, buf)
+		if secs, perr := strconv.ParseInt(rsp.Header.Get("Retry-After"), 10, 64); perr == nil {
+			err.Wait = time.Duration(secs) * time.Second
+		}
+		return err
+	}
+
+	if data == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(buf, data)
+	if err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+func (query PinQuery) values() url.Values {
+	args := make(url.Values)
+	if len(query.CID) > 0 {
+		args.Set("cid", strings.Join(query.CID, ","))
+	}
+	if query.Name != "" {
+		args.Set("name", query.Name)
+	}
+	if query.Match != "" {
+		args.Set("match", string(query.Match))
+	}
+	if len(query.Status) > 0 {
+		statuses := make([]string, 0, len(query.Status))
+		for _, status := range query.Status {
+			statuses = append(statuses, string(status))
+		}
+		args.Set("status", strings.Join(statuses, ","))
+	}
+	if !query.Before.IsZero() {
+		args.Set("before", query.Before.Format(time.RFC3339Nano))
+	}
+	if !query.After.IsZero() {
+		args.Set("after", query.After.Format(time.RFC3339Nano))
+	}
+	if query.Limit > 0 {
+		args.Set("limit", strconv.FormatInt(int64(query.Limit), 10))
+	}
+	if len(query.Meta) > 0 {
+		meta, _ := json.Marshal(query.Meta)
+		args.Set("meta", string(meta))
+	}
+	return args
+}
+
+// Pins returns a single page of pinning request statuses that match
+// query. To get every matching status, use Iter.
+func (c *Client) Pins(ctx context.Context, query PinQuery) (PinList, error) {
+	var data PinList
+	err := c.do(ctx, &data, http.MethodGet, "/pins", query.values(), nil)
+	return data, err
+}
+
+// AddPin asks the service to pin pin.
+func (c *Client) AddPin(ctx context.Context, pin Pin) (PinStatus, error) {
+	var data PinStatus
+	err := c.do(ctx, &data, http.MethodPost, "/pins", nil, pin)
+	return data, err
+}
+
+// GetPin gets the status of a specific pinning request.
+func (c *Client) GetPin(ctx context.Context, requestID string) (PinStatus, error) {
+	var data PinStatus
+	err := c.do(ctx, &data, http.MethodGet, "/pins/"+url.PathEscape(requestID), nil, nil)
+	return data, err
+}
+
+// UpdatePin replaces a pinning request's pin with pin.
+func (c *Client) UpdatePin(ctx context.Context, requestID string, pin Pin) (PinStatus, error) {
+	var data PinStatus
+	err := c.do(ctx, &data, http.MethodPost, "/pins/"+url.PathEscape(requestID), nil, pin)
+	return data, err
+}
+
+// DeletePin removes a pinning request.
+func (c *Client) DeletePin(ctx context.Context, requestID string) error {
+	return c.do(ctx, nil, http.MethodDelete, "/pins/"+url.PathEscape(requestID), nil, nil)
+}
+
+// Tokens returns the client's auth tokens.
+func (c *Client) Tokens(ctx context.Context) ([]TokenInfo, error) {
+	var data []TokenInfo
+	err := c.do(ctx, &data, http.MethodGet, "/tokens", nil, nil)
+	return data, err
+}
+
+// AddToken creates a new auth token for the client.
+func (c *Client) AddToken(ctx context.Context, tok NewToken) (CreatedToken, error) {
+	var data CreatedToken
+	err := c.do(ctx, &data, http.MethodPost, "/tokens", nil, tok)
+	return data, err
+}
+
+// RevokeToken revokes the client's auth token with the given prefix.
+func (c *Client) RevokeToken(ctx context.Context, prefix string) error {
+	return c.do(ctx, nil, http.MethodDelete, "/tokens/"+url.PathEscape(prefix), nil, nil)
+}
+
+// Iter returns an iterator over every pinning request status that
+// matches query, fetching pages from the service as necessary. The
+// Limit field of query is used as the page size, and Before is used to
+// page backwards through the results.
+func (c *Client) Iter(ctx context.Context, query PinQuery) *PinIter {
+	if query.Limit <= 0 {
+		query.Limit = defaultPinQuery().Limit
+	}
+
+	return &PinIter{
+		ctx:   ctx,
+		c:     c,
+		query: query,
+		limit: query.Limit,
+	}
+}
+
+// maxPageSize is the largest page that the pinning service API allows
+// clients to ask for.
+const maxPageSize = 1000
+
+var errTooManyEqualTimes = fmt.Errorf("more than %v statuses were created at the same time", maxPageSize)
+
+// PinIter iterates over the results of a query, one page at a time.
+// It is not safe for concurrent use.
+type PinIter struct {
+	ctx   context.Context
+	c     *Client
+	query PinQuery
+	limit int
+
+	page []PinStatus
+	cur  PinStatus
+	done bool
+	err  error
+
+	// last is the creation time of the oldest status seen so far, and
+	// seen holds the request IDs of every status that was created at
+	// that time.
+	last time.Time
+	seen map[string]struct{}
+}
+
+// Next advances the iterator to the next status, fetching a new page
+// if necessary. It returns false when there are no more statuses or an
+// error occurs, in which case Err will return it.
+func (iter *PinIter) Next() bool {
+	for len(iter.page) == 0 {
+		if iter.done || (iter.err != nil) {
+			return false
+		}
+		iter.fetch()
+	}
+
+	iter.cur = iter.page[0]
+	iter.page = iter.page[1:]
+	return true
+}
+
+func (iter *PinIter) fetch() {
+	prev := iter.last
+
+	list, err := iter.c.Pins(iter.ctx, iter.query)
+	if err != nil {
+		iter.err = err
+		return
+	}
+
+	// Before is exclusive, so using the creation time of the last
+	// status on the page would skip any others that were created at
+	// exactly the same time. Instead, the next page starts just after
+	// it and statuses that have already been seen are skipped.
+	for _, status := range list.Results {
+		if _, ok := iter.seen[status.RequestID]; ok {
+			continue
+		}
+		iter.page = append(iter.page, status)
+
+		if !status.Created.Equal(iter.last) {
+			iter.last = status.Created
+			iter.seen = make(map[string]struct{})
+		}
+		iter.seen[status.RequestID] = struct{}{}
+	}
+
+	full := len(list.Results) >= iter.query.Limit
+	switch {
+	case !full:
+		iter.done = true
+
+	case len(iter.page) == 0:
+		// Every status on a full page was created at the same time and
+		// has already been seen, so the only way to get past them is to
+		// ask for more at once.
+		if iter.query.Limit >= maxPageSize {
+			iter.err = errTooManyEqualTimes
+			return
+		}
+		iter.query.Limit *= 2
+		if iter.query.Limit > maxPageSize {
+			iter.query.Limit = maxPageSize
+		}
+
+	default:
+		if !iter.last.Equal(prev) {
+			iter.query.Limit = iter.limit
+		}
+		iter.query.Before = iter.last.Add(time.Nanosecond)
+	}
+}
+
+// Pin returns the status that the iterator is currently on.
+func (iter *PinIter) Pin() PinStatus {
+	return iter.cur
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (iter *PinIter) Err() error {
+	return iter.err
+}
+
+type ClientOption func(*Client)
+
+// WithHTTPClient uses the given http.Client instead of
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithBaseURL sets the base URL of the pinning service. The default
+// is "http://localhost:8080". It should not include the "/pins" path.
+func WithBaseURL(base string) ClientOption {
+	return func(c *Client) {
+		c.base = strings.TrimSuffix(base, "/")
+	}
+}
+
+// WithToken sets the token used to authenticate requests whose
+// contexts don't have one.
+func WithToken(token string) ClientOption {
+	return func(c *Client) {
+		c.token = token
+	}
+}
@@ -0,0 +1,167 @@
+package sips_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DeedleFake/sips"
+)
+
+// listPinHandler is a sips.PinHandler that lists a fixed set of
+// statuses, newest first.
+type listPinHandler struct {
+	fakePinHandler
+	statuses []sips.PinStatus
+}
+
+func (h listPinHandler) Pins(ctx context.Context, query sips.PinQuery) (sips.PinList, error) {
+	var list sips.PinList
+	for _, status := range h.statuses {
+		if !query.Before.IsZero() && !status.Created.Before(query.Before) {
+			continue
+		}
+		list.Count++
+		if len(list.Results) < query.Limit {
+			list.Results = append(list.Results, status)
+		}
+	}
+	return list, nil
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	pin := sips.Pin{CID: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", Name: "test"}
+
+	s := httptest.NewServer(sips.Handler(fakePinHandler{}))
+	defer s.Close()
+	c := sips.NewClient(sips.WithBaseURL(s.URL), sips.WithToken("token"))
+
+	status, err := c.AddPin(ctx, pin)
+	if err != nil {
+		t.Fatalf("add pin: %v", err)
+	}
+	if (status.RequestID != "1") || (status.Pin.CID != pin.CID) || (status.Pin.Name != pin.Name) {
+		t.Errorf("unexpected status from add: %+v", status)
+	}
+
+	status, err = c.GetPin(ctx, "abc")
+	if err != nil {
+		t.Fatalf("get pin: %v", err)
+	}
+	if status.RequestID != "abc" {
+		t.Errorf("got request ID %q, want %q", status.RequestID, "abc")
+	}
+
+	err = c.DeletePin(ctx, "abc")
+	if err != nil {
+		t.Fatalf("delete pin: %v", err)
+	}
+
+	es := httptest.NewServer(sips.Handler(fakePinHandler{err: testError{status: http.StatusTooManyRequests, reason: "SLOW_DOWN", wait: time.Second}}))
+	defer es.Close()
+	c = sips.NewClient(sips.WithBaseURL(es.URL), sips.WithToken("token"))
+
+	_, err = c.GetPin(ctx, "abc")
+	var serr *sips.Error
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected *sips.Error, got %#v", err)
+	}
+	if (serr.StatusCode != http.StatusTooManyRequests) || (serr.Mnemonic != "SLOW_DOWN") || (serr.Wait != time.Second) {
+		t.Errorf("unexpected error: %+v", serr)
+	}
+}
+
+func TestPinIter(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name  string
+		times []time.Time
+		limit int
+	}{
+		{name: "Distinct", times: spreadTimes(now, 25, time.Second), limit: 10},
+		{name: "Equal", times: spreadTimes(now, 25, 0), limit: 10},
+		{name: "EqualPageSize", times: spreadTimes(now, 20, 0), limit: 10},
+		{name: "Mixed", times: append(spreadTimes(now, 15, 0), spreadTimes(now.Add(-time.Minute), 12, 0)...), limit: 5},
+		{name: "DefaultLimit", times: spreadTimes(now, 15, 0)},
+		{name: "Empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := listPinHandler{statuses: make([]sips.PinStatus, 0, len(test.times))}
+			for i, created := range test.times {
+				h.statuses = append(h.statuses, sips.PinStatus{
+					RequestID: strconv.FormatInt(int64(i), 10),
+					Status:    sips.Pinned,
+					Created:   created,
+				})
+			}
+			sort.SliceStable(h.statuses, func(i, j int) bool {
+				return h.statuses[i].Created.After(h.statuses[j].Created)
+			})
+
+			s := httptest.NewServer(sips.Handler(h))
+			defer s.Close()
+
+			c := sips.NewClient(sips.WithBaseURL(s.URL), sips.WithToken("token"))
+			iter := c.Iter(context.Background(), sips.PinQuery{Limit: test.limit})
+
+			seen := make(map[string]bool)
+			for iter.Next() {
+				id := iter.Pin().RequestID
+				if seen[id] {
+					t.Fatalf("status %v returned twice", id)
+				}
+				seen[id] = true
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != len(test.times) {
+				t.Fatalf("got %v statuses, want %v", len(seen), len(test.times))
+			}
+		})
+	}
+}
+
+func TestPinIterTooManyEqualTimes(t *testing.T) {
+	h := listPinHandler{statuses: make([]sips.PinStatus, 0, 1001)}
+	now := time.Now().UTC()
+	for i := 0; i < 1001; i++ {
+		h.statuses = append(h.statuses, sips.PinStatus{
+			RequestID: strconv.FormatInt(int64(i), 10),
+			Status:    sips.Pinned,
+			Created:   now,
+		})
+	}
+
+	s := httptest.NewServer(sips.Handler(h))
+	defer s.Close()
+
+	c := sips.NewClient(sips.WithBaseURL(s.URL), sips.WithToken("token"))
+	iter := c.Iter(context.Background(), sips.PinQuery{Limit: 100})
+	var n int
+	for iter.Next() {
+		n++
+	}
+	if iter.Err() == nil {
+		t.Fatalf("iteration stopped after %v statuses without an error", n)
+	}
+}
+
+// spreadTimes returns n times, starting at start and going back by
+// step each time.
+func spreadTimes(start time.Time, n int, step time.Duration) []time.Time {
+	times := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		times = append(times, start.Add(-time.Duration(i)*step))
+	}
+	return times
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/internal/adminapi"
+	"github.com/DeedleFake/sips/internal/log"
+)
+
+// adminHandler returns a handler that serves the admin API using a.
+// Every request must be made with a token that has the admin scope.
+func adminHandler(ph *PinHandler, a adminapi.Admin) http.Handler {
+	h := adminapi.Handler(a, adminapi.WithAuth(ph.adminAuth))
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := log.With(req.Context(), "op", "admin", "method", req.Method, "path", req.URL.Path)
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			ctx = log.With(ctx, "addr", host)
+		}
+		req = req.WithContext(ctx)
+
+		start := time.Now()
+		sr := adminStatusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(&sr, req)
+
+		logger := log.Ctx(log.With(ctx, "status", sr.status, "duration", time.Since(start)))
+		switch {
+		case sr.status >= http.StatusInternalServerError:
+			logger.Errorf("admin request failed")
+		case sr.status >= http.StatusBadRequest:
+			logger.Infof("admin request failed")
+		default:
+			logger.Debugf("admin request succeeded")
+		}
+	})
+}
+
+// adminAuth checks that req was made with a valid token that has the
+// admin scope and, if it was, lets it access everything in the
+// database.
+func (h *PinHandler) adminAuth(req *http.Request) (*http.Request, error) {
+	ctx := req.Context()
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, Unauthorized(errors.New("no bearer token provided"))
+	}
+	tokstr := strings.TrimPrefix(auth, "Bearer ")
+	ctx = log.With(ctx, "token", db.TokenPrefix(tokstr))
+
+	var addr string
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		addr = host
+	}
+	err := h.checkFailures(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := h.DB.Tx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tok, _, err := h.authToken(ctx, tx, tokstr, addr, db.ScopeAdmin)
+	if err != nil {
+		h.recordFailure(addr, err)
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	// Every admin action is logged, even when it succeeds, as they're
+	// rare and significant.
+	ctx = log.With(ctx, "user", tok.Edges.User.Name)
+	log.Ctx(ctx).Infof("admin request authorized")
+	return req.WithContext(viewer.AdminContext(ctx)), nil
+}
+
+// adminStatusRecorder records the status of a response.
+type adminStatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *adminStatusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
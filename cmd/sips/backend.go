@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+
+	"github.com/DeedleFake/sips/internal/clusterapi"
+	"github.com/DeedleFake/sips/internal/ipfsapi"
+)
+
+// maxDelegates is the maximum number of delegates allowed by the
+// pinning service API.
+const maxDelegates = 20
+
+// Backend is the system that pins are actually stored in.
+type Backend interface {
+	// Add pins cid. Origins are addresses of peers that are known to
+	// provide the content. If the backend is able to report progress,
+	// progress is called periodically with the number of blocks that
+	// have been fetched so far.
+	Add(ctx context.Context, cid string, origins []string, progress func(blocks int)) error
+
+	// Update replaces the pin of from with a pin of to. It does not
+	// necessarily unpin from.
+	Update(ctx context.Context, from, to string, origins []string) error
+
+	// Remove unpins cid. It should not return an error if cid was not
+	// pinned in the first place.
+	Remove(ctx context.Context, cid string) error
+
+	// Pins returns the CIDs that are recursively pinned.
+	Pins(ctx context.Context) ([]string, error)
+
+	// Size returns the total size, in bytes, of the pinned content
+	// rooted at cid.
+	Size(ctx context.Context, cid string) (int64, error)
+
+	// Delegates returns the multiaddresses of the IPFS nodes that are
+	// storing cid, or of all nodes that might store pins if cid is
+	// empty.
+	Delegates(ctx context.Context, cid string) ([]string, error)
+}
+
+// limitDelegates limits delegates, as returned by a Backend, to the
+// number allowed by the pinning service API.
+func limitDelegates(delegates []string) []string {
+	if len(delegates) > maxDelegates {
+		return delegates[:maxDelegates]
+	}
+	return delegates
+}
+
+// isTemporary returns true if err, returned by a Backend, is likely
+// to have been caused by a temporary condition.
+func isTemporary(err error) bool {
+	return ipfsapi.IsTemporary(err) && clusterapi.IsTemporary(err)
+}
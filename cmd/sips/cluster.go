@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/DeedleFake/sips/internal/clusterapi"
+	"github.com/DeedleFake/sips/internal/ipfsapi"
+)
+
+const defaultClusterPollInterval = 5 * time.Second
+
+// Cluster is a Backend that pins via the REST API of an IPFS Cluster.
+type Cluster struct {
+	Client *clusterapi.Client
+
+	// IPFS is the API of an IPFS node in the cluster. The cluster API
+	// has no way to measure the size of pins, so it is used for that
+	// instead. If it is nil, sizes can't be measured.
+	IPFS *ipfsapi.Client
+
+	// ReplicationMin and ReplicationMax are the replication factors
+	// to request for new pins. Zero means that the cluster's defaults
+	// are used.
+	ReplicationMin int
+	ReplicationMax int
+
+	// PollInterval is how often the status of a pin is checked while
+	// waiting for the cluster to pin it. If it is zero, a default is
+	// used.
+	PollInterval time.Duration
+}
+
+func (b Cluster) pollInterval() time.Duration {
+	if b.PollInterval <= 0 {
+		return defaultClusterPollInterval
+	}
+	return b.PollInterval
+}
+
+func (b Cluster) Add(ctx context.Context, cid string, origins []string, progress func(int)) error {
+	_, err := b.Client.Pin(ctx, cid, clusterapi.PinOptions{
+		ReplicationMin: b.ReplicationMin,
+		ReplicationMax: b.ReplicationMax,
+		Origins:        origins,
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.wait(ctx, cid)
+}
+
+func (b Cluster) Update(ctx context.Context, from, to string, origins []string) error {
+	_, err := b.Client.Pin(ctx, to, clusterapi.PinOptions{
+		ReplicationMin: b.ReplicationMin,
+		ReplicationMax: b.ReplicationMax,
+		Origins:        origins,
+		Update:         from,
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.wait(ctx, to)
+}
+
+// wait waits until cid has been pinned by every peer that it has been
+// allocated to.
+func (b Cluster) wait(ctx context.Context, cid string) error {
+	ticker := time.NewTicker(b.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		status, err := b.Client.Status(ctx, cid)
+		if err != nil {
+			return err
+		}
+
+		done, err := pinDone(status)
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// pinDone checks if a pin has been pinned by every peer that it has
+// been allocated to. If any of them have failed to pin it, an error is
+// returned.
+func pinDone(status clusterapi.GlobalPinInfo) (bool, error) {
+	var errs []string
+	allocated := 0
+	pinned := 0
+	for id, info := range status.PeerMap {
+		switch info.Status {
+		case clusterapi.StatusRemote:
+			continue
+		case clusterapi.StatusPinned:
+			pinned++
+		case clusterapi.StatusPinError, clusterapi.StatusClusterErr, clusterapi.StatusUnexpected:
+			name := info.Peername
+			if name == "" {
+				name = id
+			}
+			errs = append(errs, fmt.Sprintf("%v: %v", name, info.Error))
+		}
+		allocated++
+	}
+
+	if len(errs) > 0 {
+		return false, errors.New(strings.Join(errs, "; "))
+	}
+	return (allocated > 0) && (pinned == allocated), nil
+}
+
+func (b Cluster) Remove(ctx context.Context, cid string) error {
+	err := b.Client.Unpin(ctx, cid)
+	if err != nil && !clusterapi.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (b Cluster) Pins(ctx context.Context) ([]string, error) {
+	pins, err := b.Client.Allocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]string, 0, len(pins))
+	for _, pin := range pins {
+		cids = append(cids, pin.CID)
+	}
+	return cids, nil
+}
+
+func (b Cluster) Size(ctx context.Context, cid string) (int64, error) {
+	if b.IPFS == nil {
+		return 0, errors.New("no IPFS API available to measure size with")
+	}
+
+	stat, err := b.IPFS.DagStat(ctx, cid)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size, nil
+}
+
+func (b Cluster) Delegates(ctx context.Context, cid string) ([]string, error) {
+	if cid == "" {
+		peers, err := b.Client.Peers(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var delegates []string
+		for _, peer := range peers {
+			delegates = append(delegates, peer.IPFS.Addresses...)
+		}
+		return limitDelegates(delegates), nil
+	}
+
+	status, err := b.Client.Status(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	var delegates []string
+	for _, info := range status.PeerMap {
+		if info.Status == clusterapi.StatusRemote {
+			continue
+		}
+		delegates = append(delegates, info.IPFSPeerAddresses...)
+	}
+	return limitDelegates(delegates), nil
+}
@@ -1,9 +1,14 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 type statusError struct {
 	StatusCode int
+	Mnemonic   string
+	Wait       time.Duration
 	Err        error
 }
 
@@ -28,6 +33,40 @@ func BadRequest(err error) error {
 	}
 }
 
+func Forbidden(err error) error {
+	return statusError{
+		StatusCode: http.StatusForbidden,
+		Err:        err,
+	}
+}
+
+func Conflict(err error) error {
+	return statusError{
+		StatusCode: http.StatusConflict,
+		Err:        err,
+	}
+}
+
+func TooManyRequests(err error, wait time.Duration) error {
+	return statusError{
+		StatusCode: http.StatusTooManyRequests,
+		Wait:       wait,
+		Err:        err,
+	}
+}
+
+// WithReason sets the reason that is sent to the client in place of
+// the default for the status code of err, which must have been
+// returned by one of the other functions in this file.
+func WithReason(err error, reason string) error {
+	serr, ok := err.(statusError)
+	if !ok {
+		return err
+	}
+	serr.Mnemonic = reason
+	return serr
+}
+
 func (err statusError) Error() string {
 	return err.Err.Error()
 }
@@ -39,3 +78,11 @@ func (err statusError) Unwrap() error {
 func (err statusError) Status() int {
 	return err.StatusCode
 }
+
+func (err statusError) Reason() string {
+	return err.Mnemonic
+}
+
+func (err statusError) RetryAfter() time.Duration {
+	return err.Wait
+}
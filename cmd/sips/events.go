@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/ent"
+)
+
+// PinEvents lets subscribers know when pin events have been recorded
+// for a user or organization.
+//
+// Events themselves are read from the database rather than passed
+// through PinEvents, which only wakes up the subscribers of the
+// namespaces that they belong to. This keeps them in order, and means
+// that a subscriber that falls behind, or that is resuming from an
+// earlier event, doesn't need to be handled separately.
+type PinEvents struct {
+	m    sync.Mutex
+	subs map[eventKey]map[chan struct{}]struct{}
+}
+
+// eventKey identifies the namespace that events belong to.
+type eventKey struct {
+	org bool
+	id  int
+}
+
+// Subscribe subscribes to events in o's namespace. The returned
+// channel receives a value whenever events in it are published, though
+// multiple publications may be coalesced into one. The returned
+// function must be called to unsubscribe.
+func (e *PinEvents) Subscribe(o db.Owner) (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+
+	key := eventKey{id: o.User.ID}
+	if o.Org != nil {
+		key = eventKey{org: true, id: o.Org.ID}
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.subs == nil {
+		e.subs = make(map[eventKey]map[chan struct{}]struct{})
+	}
+	if e.subs[key] == nil {
+		e.subs[key] = make(map[chan struct{}]struct{})
+	}
+	e.subs[key][c] = struct{}{}
+
+	return c, func() {
+		e.m.Lock()
+		defer e.m.Unlock()
+
+		delete(e.subs[key], c)
+		if len(e.subs[key]) == 0 {
+			delete(e.subs, key)
+		}
+	}
+}
+
+// Publish wakes up the subscribers of the namespaces that events
+// belong to. The events must have been committed and must have their
+// User or Organization edges loaded, as those returned by
+// db.QueueEvent do. Nil events are ignored. It is safe to call on a
+// nil *PinEvents, in which case it does nothing.
+func (e *PinEvents) Publish(events ...*ent.PinEvent) {
+	if e == nil {
+		return
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	for _, ev := range events {
+		var key eventKey
+		switch {
+		case ev == nil:
+			continue
+		case ev.Edges.Organization != nil:
+			key = eventKey{org: true, id: ev.Edges.Organization.ID}
+		case ev.Edges.User != nil:
+			key = eventKey{id: ev.Edges.User.ID}
+		default:
+			continue
+		}
+
+		for c := range e.subs[key] {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+//go:build sqlite3
+// +build sqlite3
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+)
+
+func TestPinEventsRevoked(t *testing.T) {
+	defer func(d time.Duration) { authRecheckInterval = d }(authRecheckInterval)
+	authRecheckInterval = 10 * time.Millisecond
+
+	ctx := viewer.SystemContext(context.Background())
+
+	entc, err := db.OpenAndMigrate(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_fk=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entc.Close()
+	alice := entc.User.Create().SetName("alice").SaveX(ctx)
+	tok := entc.Token.Create().
+		SetUser(alice).
+		SetHash(db.HashToken(nil, "token")).
+		SetPrefix("token").
+		SaveX(ctx)
+
+	s := httptest.NewServer(sips.Handler(PinHandler{
+		Queue:   &PinQueue{Events: new(PinEvents)},
+		Backend: nopBackend{},
+		DB:      entc,
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL+"/pins/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want %v", rsp.StatusCode, http.StatusOK)
+	}
+
+	entc.Token.DeleteOne(tok).ExecX(ctx)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(io.Discard, rsp.Body)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not closed after its token was revoked")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DeedleFake/sips/internal/ipfsapi"
+)
+
+// Kubo is a Backend that pins directly to a single IPFS node via its
+// HTTP API.
+type Kubo struct {
+	IPFS *ipfsapi.Client
+}
+
+func (b Kubo) connect(ctx context.Context, origins []string) {
+	for _, origin := range origins {
+		go b.IPFS.SwarmConnect(ctx, origin)
+	}
+}
+
+func (b Kubo) Add(ctx context.Context, cid string, origins []string, progress func(int)) error {
+	b.connect(ctx, origins)
+
+	updates, err := b.IPFS.PinAddProgress(ctx, cid)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			if update.Err != nil {
+				return update.Err
+			}
+
+			if progress != nil {
+				progress(update.Progress)
+			}
+		}
+	}
+}
+
+func (b Kubo) Update(ctx context.Context, from, to string, origins []string) error {
+	b.connect(ctx, origins)
+
+	_, err := b.IPFS.PinUpdate(ctx, from, to, false)
+	return err
+}
+
+func (b Kubo) Remove(ctx context.Context, cid string) error {
+	_, err := b.IPFS.PinRm(ctx, cid)
+	if err != nil && !isNotPinned(err) {
+		return err
+	}
+	return nil
+}
+
+func (b Kubo) Pins(ctx context.Context) ([]string, error) {
+	pins, err := b.IPFS.PinLs(ctx, ipfsapi.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]string, 0, len(pins))
+	for _, pin := range pins {
+		cids = append(cids, pin.CID)
+	}
+	return cids, nil
+}
+
+func (b Kubo) Size(ctx context.Context, cid string) (int64, error) {
+	stat, err := b.IPFS.DagStat(ctx, cid)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size, nil
+}
+
+func (b Kubo) Delegates(ctx context.Context, cid string) ([]string, error) {
+	id, err := b.IPFS.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return limitDelegates(id.Addresses), nil
+}
+
+// isNotPinned returns true if err indicates that a CID could not be
+// unpinned because it wasn't pinned to begin with.
+func isNotPinned(err error) bool {
+	var apierr *ipfsapi.Error
+	return errors.As(err, &apierr) && (apierr.Message == "not pinned or pinned indirectly")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/internal/log"
+)
+
+// loggingHandler wraps a PinHandler, attaching information about each
+// request to the context for logging and logging the result. Errors
+// returned by the wrapped handler are logged here, once, rather than
+// where they occur.
+type loggingHandler struct {
+	h sips.PinHandler
+}
+
+// newLoggingHandler returns a loggingHandler for h that also
+// implements sips.PinEventHandler and sips.TokenHandler if, and only
+// if, h does, so that sips.Handler only serves the routes that h can
+// actually handle.
+func newLoggingHandler(h sips.PinHandler) sips.PinHandler {
+	lh := loggingHandler{h: h}
+	eh, events := h.(sips.PinEventHandler)
+	th, tokens := h.(sips.TokenHandler)
+
+	switch {
+	case events && tokens:
+		return struct {
+			loggingHandler
+			loggingEventHandler
+			loggingTokenHandler
+		}{lh, loggingEventHandler{h: eh}, loggingTokenHandler{h: th}}
+	case events:
+		return struct {
+			loggingHandler
+			loggingEventHandler
+		}{lh, loggingEventHandler{h: eh}}
+	case tokens:
+		return struct {
+			loggingHandler
+			loggingTokenHandler
+		}{lh, loggingTokenHandler{h: th}}
+	default:
+		return lh
+	}
+}
+
+// loggingEventHandler and loggingTokenHandler are the parts of a
+// loggingHandler for the optional interfaces. See newLoggingHandler.
+type loggingEventHandler struct {
+	h sips.PinEventHandler
+}
+
+type loggingTokenHandler struct {
+	h sips.TokenHandler
+}
+
+func begin(ctx context.Context, op string, extra ...interface{}) (context.Context, func(error)) {
+	kv := append([]interface{}{"op", op}, extra...)
+	if id, ok := sips.RequestID(ctx); ok {
+		kv = append(kv, "request", id)
+	}
+	if addr, ok := sips.RemoteAddr(ctx); ok {
+		kv = append(kv, "addr", addr)
+	}
+	if tok, ok := sips.Token(ctx); ok {
+		kv = append(kv, "token", db.TokenPrefix(tok))
+	}
+	if cert, ok := sips.ClientCertificate(ctx); ok {
+		kv = append(kv, "cert", cert.Subject.CommonName)
+	}
+	ctx = log.With(ctx, kv...)
+
+	start := time.Now()
+	return ctx, func(err error) {
+		logger := log.Ctx(log.With(ctx, "duration", time.Since(start)))
+		if err == nil {
+			logger.Debugf("request succeeded")
+			return
+		}
+
+		var serr sips.StatusError
+		if errors.As(err, &serr) && (serr.Status() < http.StatusInternalServerError) {
+			logger.Infof("request failed: %v", err)
+			return
+		}
+		logger.Errorf("request failed: %w", err)
+	}
+}
+
+func (h loggingHandler) Pins(ctx context.Context, query sips.PinQuery) (list sips.PinList, err error) {
+	ctx, done := begin(ctx, "pins")
+	defer func() { done(err) }()
+
+	return h.h.Pins(ctx, query)
+}
+
+func (h loggingHandler) AddPin(ctx context.Context, pin sips.Pin) (status sips.PinStatus, err error) {
+	ctx, done := begin(ctx, "add")
+	defer func() { done(err) }()
+
+	return h.h.AddPin(ctx, pin)
+}
+
+func (h loggingHandler) GetPin(ctx context.Context, requestID string) (status sips.PinStatus, err error) {
+	ctx, done := begin(ctx, "get", "pin", requestID)
+	defer func() { done(err) }()
+
+	return h.h.GetPin(ctx, requestID)
+}
+
+func (h loggingHandler) UpdatePin(ctx context.Context, requestID string, pin sips.Pin) (status sips.PinStatus, err error) {
+	ctx, done := begin(ctx, "update", "pin", requestID)
+	defer func() { done(err) }()
+
+	return h.h.UpdatePin(ctx, requestID, pin)
+}
+
+func (h loggingHandler) DeletePin(ctx context.Context, requestID string) (err error) {
+	ctx, done := begin(ctx, "delete", "pin", requestID)
+	defer func() { done(err) }()
+
+	return h.h.DeletePin(ctx, requestID)
+}
+
+func (h loggingEventHandler) PinEvents(ctx context.Context, lastEventID string) (events <-chan sips.PinEvent, err error) {
+	ctx, done := begin(ctx, "events")
+	defer func() { done(err) }()
+
+	return h.h.PinEvents(ctx, lastEventID)
+}
+
+func (h loggingTokenHandler) Tokens(ctx context.Context) (toks []sips.TokenInfo, err error) {
+	ctx, done := begin(ctx, "tokens")
+	defer func() { done(err) }()
+
+	return h.h.Tokens(ctx)
+}
+
+func (h loggingTokenHandler) AddToken(ctx context.Context, tok sips.NewToken) (created sips.CreatedToken, err error) {
+	ctx, done := begin(ctx, "addtoken", "label", tok.Label)
+	defer func() { done(err) }()
+
+	return h.h.AddToken(ctx, tok)
+}
+
+func (h loggingTokenHandler) RevokeToken(ctx context.Context, prefix string) (err error) {
+	ctx, done := begin(ctx, "revoketoken", "prefix", prefix)
+	defer func() { done(err) }()
+
+	return h.h.RevokeToken(ctx, prefix)
+}
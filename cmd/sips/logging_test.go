@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DeedleFake/sips"
+)
+
+func TestLoggingHandlerInterfaces(t *testing.T) {
+	type pins struct{ sips.PinHandler }
+	type events struct {
+		sips.PinHandler
+		sips.PinEventHandler
+	}
+	type tokens struct {
+		sips.PinHandler
+		sips.TokenHandler
+	}
+	type both struct {
+		sips.PinHandler
+		sips.PinEventHandler
+		sips.TokenHandler
+	}
+
+	tests := []struct {
+		name           string
+		h              sips.PinHandler
+		events, tokens bool
+	}{
+		{"Pins", pins{}, false, false},
+		{"Events", events{}, true, false},
+		{"Tokens", tokens{}, false, true},
+		{"Both", both{}, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newLoggingHandler(test.h)
+			if _, ok := h.(sips.PinEventHandler); ok != test.events {
+				t.Errorf("implements PinEventHandler: %v, want %v", ok, test.events)
+			}
+			if _, ok := h.(sips.TokenHandler); ok != test.tokens {
+				t.Errorf("implements TokenHandler: %v, want %v", ok, test.tokens)
+			}
+		})
+	}
+}
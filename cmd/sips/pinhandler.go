@@ -2,52 +2,323 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
 	"github.com/DeedleFake/sips/ent"
 	"github.com/DeedleFake/sips/ent/pin"
 	"github.com/DeedleFake/sips/ent/token"
-	"github.com/DeedleFake/sips/internal/ipfsapi"
+	"github.com/DeedleFake/sips/ent/user"
 	"github.com/DeedleFake/sips/internal/log"
 )
 
-func auth(ctx context.Context, db *ent.Tx) (u *ent.User, err error) {
-	tokstr, _ := sips.Token(ctx)
+// authRecheckInterval is how often long-running requests, such as
+// event streams, check that the client is still allowed to make them.
+var authRecheckInterval = 30 * time.Second
 
-	tok, err := db.Token.Query().
+type PinHandler struct {
+	Queue   *PinQueue
+	Backend Backend
+	DB      *ent.Client
+
+	// TokenKey is the key used to hash tokens before looking them up
+	// in the database.
+	TokenKey []byte
+
+	// MaxQueued is the maximum number of pins that a single user may
+	// have queued or being pinned at once. Zero means no limit.
+	MaxQueued int
+
+	// Limiter limits the rate of requests made with each token and
+	// client certificate. If it is nil, there is no limit.
+	Limiter *RateLimiter
+
+	// FailLimiter limits the rate of failed attempts to authenticate
+	// from each address. It is separate from Limiter so that guessing
+	// at tokens can be limited far more strictly than using them. If
+	// it is nil, there is no limit.
+	FailLimiter *RateLimiter
+}
+
+// auth finds the namespace that the token associated with ctx acts in.
+// It returns an Unauthorized error if the token doesn't exist or has
+// expired and a Forbidden error if it hasn't been granted scope. If
+// the token is valid, its last use is recorded in a transaction of its
+// own, so that the record is kept even if the rest of the request
+// fails.
+//
+// If there is no token but the client presented a verified TLS
+// certificate, the user whose name matches the certificate's common
+// name is returned instead. Certificates are granted the default
+// scopes.
+//
+// Requests are rate limited once the token or certificate that they
+// were made with is known. Failed attempts are rate limited by the
+// client's address instead, and clients that have made too many are
+// turned away before the database is consulted at all.
+//
+// The returned context must be used for all further queries, as the
+// database only allows access to the namespace's pins and tokens with
+// it.
+func (h PinHandler) auth(ctx context.Context, scope db.Scope) (context.Context, db.Owner, error) {
+	ctx, o, _, err := h.authGrant(ctx, scope)
+	return ctx, o, err
+}
+
+// grant is what a client has been granted by the token or certificate
+// that it authenticated with.
+type grant struct {
+	// Scopes are every scope that the client has.
+	Scopes []db.Scope
+
+	// Expires is when the client's token or certificate expires. If it
+	// is nil, it never does.
+	Expires *time.Time
+}
+
+// authGrant is like auth, but also returns what the client has been
+// granted.
+func (h PinHandler) authGrant(ctx context.Context, scope db.Scope) (context.Context, db.Owner, grant, error) {
+	o, g, err := h.authOwner(ctx, scope)
+	if err != nil {
+		return ctx, db.Owner{}, grant{}, err
+	}
+	return o.Context(ctx), o, g, nil
+}
+
+// authOwner is like authGrant, but doesn't return a context.
+func (h PinHandler) authOwner(ctx context.Context, scope db.Scope) (db.Owner, grant, error) {
+	addr, _ := sips.RemoteAddr(ctx)
+	err := h.checkFailures(addr)
+	if err != nil {
+		return db.Owner{}, grant{}, err
+	}
+
+	o, g, key, err := h.authLookup(ctx, addr, scope)
+	if err != nil {
+		h.recordFailure(addr, err)
+		return db.Owner{}, grant{}, err
+	}
+
+	if ok, wait := h.Limiter.allow(key, time.Now()); !ok {
+		return db.Owner{}, grant{}, TooManyRequests(errors.New("rate limit exceeded"), wait)
+	}
+	return o, g, nil
+}
+
+// authLookup does the work of authOwner, additionally returning the
+// key that the request should be rate limited by.
+func (h PinHandler) authLookup(ctx context.Context, addr string, scope db.Scope) (db.Owner, grant, string, error) {
+	tx, err := h.DB.Tx(ctx)
+	if err != nil {
+		return db.Owner{}, grant{}, "", fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The transaction is over by the time that the owner is used, so
+	// its entities need to be unwrapped from it.
+	tokstr, ok := sips.Token(ctx)
+	if !ok {
+		if cert, ok := sips.ClientCertificate(ctx); ok {
+			u, err := h.authCert(ctx, tx, cert, scope)
+			if err != nil {
+				return db.Owner{}, grant{}, "", err
+			}
+			g := grant{Scopes: db.DefaultScopes, Expires: &cert.NotAfter}
+			return db.Owner{User: u.Unwrap()}, g, "cert:" + strconv.Itoa(u.ID), nil
+		}
+	}
+
+	tok, scopes, err := h.authToken(ctx, tx, tokstr, addr, scope)
+	if err != nil {
+		return db.Owner{}, grant{}, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return db.Owner{}, grant{}, "", fmt.Errorf("commit transaction: %w", err)
+	}
+
+	o := db.Owner{User: tok.Edges.User.Unwrap()}
+	if org := tok.Edges.Organization; org != nil {
+		o.Org = org.Unwrap()
+	}
+	g := grant{Scopes: scopes, Expires: tok.Expires}
+	return o, g, "token:" + strconv.Itoa(tok.ID), nil
+}
+
+// checkFailures returns a TooManyRequests error if the client at addr
+// has failed to authenticate too many times recently.
+func (h PinHandler) checkFailures(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	if wait := h.FailLimiter.wait(addr, time.Now()); wait > 0 {
+		return TooManyRequests(fmt.Errorf("too many failed attempts to authenticate from %v", addr), wait)
+	}
+	return nil
+}
+
+// recordFailure counts err against the client at addr if it means
+// that the client failed to authenticate.
+func (h PinHandler) recordFailure(addr string, err error) {
+	if addr == "" {
+		return
+	}
+
+	var serr statusError
+	if errors.As(err, &serr) && (serr.StatusCode == http.StatusUnauthorized) {
+		h.FailLimiter.allow(addr, time.Now())
+	}
+}
+
+// authToken returns tokstr's token, with its user and organization
+// loaded, and the scopes that it has, if it grants scope, recording
+// that it was used by a client at addr, if addr is not empty.
+//
+// A token that acts on behalf of an organization is limited to the
+// scopes that its user's role in the organization allows, and stops
+// working altogether if the user leaves it.
+func (h PinHandler) authToken(ctx context.Context, tx *ent.Tx, tokstr, addr string, scope db.Scope) (*ent.Token, []db.Scope, error) {
+	prefix := db.TokenPrefix(tokstr)
+
+	// Who the token belongs to isn't known until it's been found.
+	ctx = viewer.SystemContext(ctx)
+
+	tok, err := tx.Token.Query().
 		WithUser().
-		Where(token.Token(tokstr)).
+		WithOrganization().
+		Where(token.Hash(db.HashToken(h.TokenKey, tokstr))).
 		Only(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("find token %q: %w", tokstr, err)
+		if ent.IsNotFound(err) {
+			return nil, nil, Unauthorized(fmt.Errorf("find token %q: %w", prefix, err))
+		}
+		return nil, nil, fmt.Errorf("find token %q: %w", prefix, err)
+	}
+
+	now := time.Now()
+	if db.TokenExpired(tok, now) {
+		return nil, nil, WithReason(Unauthorized(fmt.Errorf("token %q expired at %v", prefix, tok.Expires.Format(time.RFC3339))), "TOKEN_EXPIRED")
+	}
+	if tok.Edges.User == nil {
+		return nil, nil, Unauthorized(fmt.Errorf("token %q has no user", prefix))
+	}
+
+	scopes := db.TokenScopes(tok)
+	if org := tok.Edges.Organization; org != nil {
+		m, err := db.Membership(ctx, tx, tok.Edges.User.ID, org.ID)
+		if err != nil {
+			if ent.IsNotFound(err) {
+				return nil, nil, Unauthorized(fmt.Errorf("user of token %q is not a member of organization %q", prefix, org.Name))
+			}
+			return nil, nil, fmt.Errorf("find membership for token %q: %w", prefix, err)
+		}
+		scopes = db.LimitScopes(scopes, db.RoleScopes(m.Role))
+	}
+	if !db.ScopesAllow(scopes, scope) {
+		return nil, nil, WithReason(Forbidden(fmt.Errorf("token %q does not have %q scope", prefix, scope)), "INSUFFICIENT_SCOPE")
+	}
+
+	update := tx.Token.UpdateOne(tok).SetLastUsed(now)
+	if addr != "" {
+		update.SetLastIP(addr)
+	}
+	err = update.Exec(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("update last use of token %q: %w", prefix, err)
 	}
 
-	return tok.Edges.User, nil
+	return tok, scopes, nil
 }
 
-type PinHandler struct {
-	Queue *PinQueue
-	IPFS  *ipfsapi.Client
-	DB    *ent.Client
+func (h PinHandler) authCert(ctx context.Context, tx *ent.Tx, cert *x509.Certificate, scope db.Scope) (*ent.User, error) {
+	name := cert.Subject.CommonName
+
+	allowed := false
+	for _, s := range db.DefaultScopes {
+		if s == scope {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, WithReason(Forbidden(fmt.Errorf("client certificate %q does not have %q scope", name, scope)), "INSUFFICIENT_SCOPE")
+	}
+
+	u, err := tx.User.Query().Where(user.Name(name)).Only(ctx)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return nil, Unauthorized(fmt.Errorf("find user for client certificate %q: %w", name, err))
+		}
+		return nil, fmt.Errorf("find user for client certificate %q: %w", name, err)
+	}
+	return u, nil
 }
 
-func (h PinHandler) Pins(ctx context.Context, query sips.PinQuery) ([]sips.PinStatus, error) {
-	tx, err := h.DB.Tx(ctx)
+// checkQueued returns a TooManyRequests error if o can't queue any
+// more pins. See db.CheckQueued.
+func (h PinHandler) checkQueued(ctx context.Context, o db.Owner, replacing int) error {
+	err := db.CheckQueued(ctx, o, h.MaxQueued, replacing)
+	if err != nil {
+		if errors.Is(err, db.ErrTooManyQueued) {
+			// The queue looks for new jobs once per poll interval, so
+			// that's a reasonable guess at how long a slot will take to
+			// free up.
+			return WithReason(TooManyRequests(err, h.Queue.pollInterval()), "TOO_MANY_QUEUED")
+		}
+		return err
+	}
+	return nil
+}
+
+// delegates returns the delegates for cid, or for the service as a
+// whole if cid is empty.
+func (h PinHandler) delegates(ctx context.Context, cid string) []string {
+	delegates, err := h.Backend.Delegates(ctx, cid)
 	if err != nil {
-		return nil, log.Errorf("begin transaction: %w", err)
+		log.Ctx(ctx).Errorf("get delegates for %q: %w", cid, err)
+		return []string{}
+	}
+	if delegates == nil {
+		return []string{}
+	}
+	return delegates
+}
+
+func (h PinHandler) Pins(ctx context.Context, query sips.PinQuery) (sips.PinList, error) {
+	ctx, o, err := h.auth(ctx, db.ScopeRead)
+	if err != nil {
+		return sips.PinList{}, fmt.Errorf("authenticate: %w", err)
+	}
+
+	// The page and the count should agree with each other, so they're
+	// read from the same snapshot.
+	tx, err := h.DB.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return sips.PinList{}, fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	u, err := auth(ctx, tx)
+	o, err = o.In(ctx, tx)
 	if err != nil {
-		return nil, Unauthorized(log.Errorf("authenticate: %w", err))
+		return sips.PinList{}, err
 	}
 
-	q := u.QueryPins().
-		Order(ent.Desc(pin.FieldCreateTime)).
-		Limit(query.Limit)
+	q := o.QueryPins().Where(db.NotDeleted())
 	if len(query.Status) > 0 {
 		q = q.Where(pin.StatusIn(query.Status...))
 	}
@@ -60,159 +331,180 @@ func (h PinHandler) Pins(ctx context.Context, query sips.PinQuery) ([]sips.PinSt
 	if !query.After.IsZero() {
 		q = q.Where(pin.CreateTimeGT(query.After))
 	}
-	pins, err := q.All(ctx)
-	if err != nil {
-		return nil, log.Errorf("query pins: %w", err)
+	if query.Name != "" {
+		q = q.Where(nameMatches(query.Match, query.Name))
+	}
+	if len(query.Meta) > 0 {
+		q = q.Where(metaContains(query.Meta))
 	}
 
-	if query.Name != "" {
-		// TODO: Handle this in the query.
-		for i := range pins {
-			if !query.Match.Match(pins[i].Name, query.Name) {
-				pins = append(pins[:i], pins[i+1:]...)
-				i--
-			}
-		}
+	pins, err := q.Clone().
+		Order(ent.Desc(pin.FieldCreateTime)).
+		Limit(query.Limit).
+		All(ctx)
+	if err != nil {
+		return sips.PinList{}, fmt.Errorf("query pins: %w", err)
 	}
 
-	statuses := make([]sips.PinStatus, len(pins))
-	for i, pin := range pins {
-		statuses[i] = sips.PinStatus{
-			RequestID: strconv.FormatInt(int64(pin.ID), 16),
-			Status:    pin.Status,
-			Created:   pin.CreateTime,
-			Pin: sips.Pin{
-				CID:     pin.CID,
-				Name:    pin.Name,
-				Origins: pin.Origins,
-			},
-		}
+	count, err := q.Count(ctx)
+	if err != nil {
+		return sips.PinList{}, fmt.Errorf("count pins: %w", err)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return nil, log.Errorf("commit transaction: %w", err)
+		return sips.PinList{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	delegates := h.delegates(ctx, "")
+	statuses := make([]sips.PinStatus, len(pins))
+	for i, pin := range pins {
+		statuses[i] = db.PinStatus(pin, delegates)
 	}
 
-	return statuses, nil
+	return sips.PinList{
+		Count:   count,
+		Results: statuses,
+	}, nil
 }
 
 func (h PinHandler) AddPin(ctx context.Context, pin sips.Pin) (sips.PinStatus, error) {
+	ctx, o, err := h.auth(ctx, db.ScopePin)
+	if err != nil {
+		return sips.PinStatus{}, fmt.Errorf("authenticate: %w", err)
+	}
+
 	tx, err := h.DB.Tx(ctx)
 	if err != nil {
-		return sips.PinStatus{}, log.Errorf("begin transaction: %w", err)
+		return sips.PinStatus{}, fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	u, err := auth(ctx, tx)
+	o, err = o.Lock(ctx, tx)
 	if err != nil {
-		return sips.PinStatus{}, Unauthorized(log.Errorf("authenticate: %w", err))
+		return sips.PinStatus{}, err
+	}
+
+	err = db.CheckQuota(ctx, o, 0)
+	if err != nil {
+		if errors.Is(err, db.ErrQuotaExceeded) {
+			return sips.PinStatus{}, Conflict(fmt.Errorf("check quota: %w", err))
+		}
+		return sips.PinStatus{}, fmt.Errorf("check quota: %w", err)
 	}
 
-	dbpin, err := h.DB.Pin.Create().
-		SetUser(u).
+	err = h.checkQueued(ctx, o, 0)
+	if err != nil {
+		return sips.PinStatus{}, err
+	}
+
+	create := tx.Pin.Create().
+		SetUser(o.User).
 		SetCID(pin.CID).
 		SetName(pin.Name).
 		SetOrigins(pin.Origins).
-		Save(ctx)
+		SetMeta(pin.Meta)
+	if o.Org != nil {
+		create.SetOrganization(o.Org)
+	}
+	dbpin, err := create.Save(ctx)
 	if err != nil {
-		return sips.PinStatus{}, log.Errorf("create pin: %w", err)
+		return sips.PinStatus{}, fmt.Errorf("create pin: %w", err)
 	}
 
-	select {
-	case <-ctx.Done():
-		return sips.PinStatus{}, log.Errorf("queue add %q: %w", pin.CID, ctx.Err())
-	case h.Queue.Add() <- dbpin:
+	err = db.QueueAdd(ctx, tx, dbpin)
+	if err != nil {
+		return sips.PinStatus{}, fmt.Errorf("queue add %q: %w", pin.CID, err)
 	}
 
-	id, err := h.IPFS.ID(ctx)
+	ev, err := db.QueueEvent(ctx, tx, dbpin, db.EventQueued)
 	if err != nil {
-		log.Errorf("get IPFS ID: %w", err)
-		// Purposefully don't return here.
+		return sips.PinStatus{}, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return sips.PinStatus{}, log.Errorf("commit transaction: %w", err)
+		return sips.PinStatus{}, fmt.Errorf("commit transaction: %w", err)
 	}
+	h.Queue.Notify()
+	h.Queue.publish(ev)
 
-	return sips.PinStatus{
-		RequestID: strconv.FormatInt(int64(dbpin.ID), 16),
-		Status:    dbpin.Status,
-		Created:   dbpin.CreateTime,
-		Delegates: id.Addresses,
-		Pin:       pin,
-	}, nil
+	return db.PinStatus(dbpin, h.delegates(ctx, dbpin.CID)), nil
 }
 
 func (h PinHandler) GetPin(ctx context.Context, requestID string) (sips.PinStatus, error) {
 	pinID, err := strconv.ParseInt(requestID, 16, 64)
 	if err != nil {
-		return sips.PinStatus{}, BadRequest(log.Errorf("parse request ID %q: %w", requestID, err))
-	}
-
-	tx, err := h.DB.Tx(ctx)
-	if err != nil {
-		return sips.PinStatus{}, log.Errorf("begin transaction: %w", err)
+		return sips.PinStatus{}, BadRequest(fmt.Errorf("parse request ID %q: %w", requestID, err))
 	}
-	defer tx.Rollback()
 
-	u, err := auth(ctx, tx)
+	ctx, o, err := h.auth(ctx, db.ScopeRead)
 	if err != nil {
-		return sips.PinStatus{}, Unauthorized(log.Errorf("authenticate: %w", err))
+		return sips.PinStatus{}, fmt.Errorf("authenticate: %w", err)
 	}
 
-	pin, err := u.QueryPins().
-		Where(pin.ID(int(pinID))).
+	pin, err := o.QueryPins().
+		Where(
+			pin.ID(int(pinID)),
+			db.NotDeleted(),
+		).
 		Only(ctx)
 	if err != nil {
 		if ent.IsNotFound(err) {
-			return sips.PinStatus{}, NotFound(log.Errorf("query pin %q: %w", requestID, err))
+			return sips.PinStatus{}, NotFound(fmt.Errorf("query pin %q: %w", requestID, err))
 		}
-		return sips.PinStatus{}, log.Errorf("query pin %q: %w", requestID, err)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return sips.PinStatus{}, log.Errorf("commit transaction: %w", err)
+		return sips.PinStatus{}, fmt.Errorf("query pin %q: %w", requestID, err)
 	}
 
-	return sips.PinStatus{
-		RequestID: requestID,
-		Status:    pin.Status,
-		Created:   pin.CreateTime,
-		Pin: sips.Pin{
-			CID:  pin.CID,
-			Name: pin.Name,
-		},
-	}, nil
+	return db.PinStatus(pin, h.delegates(ctx, pin.CID)), nil
 }
 
 func (h PinHandler) UpdatePin(ctx context.Context, requestID string, spin sips.Pin) (sips.PinStatus, error) {
 	pinID, err := strconv.ParseInt(requestID, 16, 64)
 	if err != nil {
-		return sips.PinStatus{}, BadRequest(log.Errorf("parse request ID %q: %w", requestID, err))
+		return sips.PinStatus{}, BadRequest(fmt.Errorf("parse request ID %q: %w", requestID, err))
+	}
+
+	ctx, o, err := h.auth(ctx, db.ScopePin)
+	if err != nil {
+		return sips.PinStatus{}, fmt.Errorf("authenticate: %w", err)
 	}
 
 	tx, err := h.DB.Tx(ctx)
 	if err != nil {
-		return sips.PinStatus{}, log.Errorf("begin transaction: %w", err)
+		return sips.PinStatus{}, fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	u, err := auth(ctx, tx)
+	o, err = o.Lock(ctx, tx)
 	if err != nil {
-		return sips.PinStatus{}, Unauthorized(log.Errorf("authenticate: %w", err))
+		return sips.PinStatus{}, err
 	}
 
-	oldpin, err := u.QueryPins().
-		Where(pin.ID(int(pinID))).
+	oldpin, err := o.QueryPins().
+		Where(
+			pin.ID(int(pinID)),
+			db.NotDeleted(),
+		).
 		Only(ctx)
 	if err != nil {
 		if ent.IsNotFound(err) {
-			return sips.PinStatus{}, NotFound(log.Errorf("query pin %q: %w", requestID, err))
+			return sips.PinStatus{}, NotFound(fmt.Errorf("query pin %q: %w", requestID, err))
 		}
-		return sips.PinStatus{}, log.Errorf("query pin %q: %w", requestID, err)
+		return sips.PinStatus{}, fmt.Errorf("query pin %q: %w", requestID, err)
+	}
+
+	err = db.CheckQuota(ctx, o, oldpin.ID)
+	if err != nil {
+		if errors.Is(err, db.ErrQuotaExceeded) {
+			return sips.PinStatus{}, Conflict(fmt.Errorf("check quota: %w", err))
+		}
+		return sips.PinStatus{}, fmt.Errorf("check quota: %w", err)
+	}
+
+	err = h.checkQueued(ctx, o, oldpin.ID)
+	if err != nil {
+		return sips.PinStatus{}, err
 	}
 
 	newpin, err := tx.Pin.UpdateOne(oldpin).
@@ -220,77 +512,183 @@ func (h PinHandler) UpdatePin(ctx context.Context, requestID string, spin sips.P
 		SetCID(spin.CID).
 		SetName(spin.Name).
 		SetOrigins(spin.Origins).
+		SetMeta(spin.Meta).
+		SetProgress(0).
+		SetSize(0).
+		ClearLastError().
+		ClearStarted().
+		ClearFinished().
 		Save(ctx)
 	if err != nil {
-		return sips.PinStatus{}, log.Errorf("update pin %q: %w", requestID, err)
+		return sips.PinStatus{}, fmt.Errorf("update pin %q: %w", requestID, err)
 	}
 
-	select {
-	case <-ctx.Done():
-		return sips.PinStatus{}, log.Errorf("queue update %q: %w", requestID, ctx.Err())
-	case h.Queue.Update() <- [2]*ent.Pin{oldpin, newpin}:
+	err = db.QueueUpdate(ctx, tx, oldpin, newpin)
+	if err != nil {
+		return sips.PinStatus{}, fmt.Errorf("queue update %q: %w", requestID, err)
 	}
 
-	id, err := h.IPFS.ID(ctx)
+	ev, err := db.QueueEvent(ctx, tx, newpin, db.EventQueued)
 	if err != nil {
-		log.Errorf("get IPFS ID: %w", err)
-		// Purposefully don't return here.
+		return sips.PinStatus{}, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return sips.PinStatus{}, log.Errorf("commit transaction: %w", err)
+		return sips.PinStatus{}, fmt.Errorf("commit transaction: %w", err)
 	}
+	h.Queue.Notify()
+	h.Queue.publish(ev)
 
-	return sips.PinStatus{
-		RequestID: requestID,
-		Status:    newpin.Status,
-		Created:   newpin.CreateTime,
-		Delegates: id.Addresses,
-		Pin: sips.Pin{
-			CID:  newpin.CID,
-			Name: newpin.Name,
-		},
-	}, nil
+	return db.PinStatus(newpin, h.delegates(ctx, newpin.CID)), nil
 }
 
 func (h PinHandler) DeletePin(ctx context.Context, requestID string) error {
 	pinID, err := strconv.ParseInt(requestID, 16, 64)
 	if err != nil {
-		return BadRequest(log.Errorf("parse request ID %q: %w", requestID, err))
+		return BadRequest(fmt.Errorf("parse request ID %q: %w", requestID, err))
+	}
+
+	ctx, o, err := h.auth(ctx, db.ScopeUnpin)
+	if err != nil {
+		return fmt.Errorf("authenticate: %w", err)
 	}
 
 	tx, err := h.DB.Tx(ctx)
 	if err != nil {
-		return log.Errorf("begin transaction: %w", err)
+		return fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	u, err := auth(ctx, tx)
+	o, err = o.Lock(ctx, tx)
 	if err != nil {
-		return Unauthorized(log.Errorf("authenticate: %w", err))
+		return err
 	}
 
-	pin, err := u.QueryPins().
-		Where(pin.ID(int(pinID))).
+	pin, err := o.QueryPins().
+		Where(
+			pin.ID(int(pinID)),
+			db.NotDeleted(),
+		).
 		Only(ctx)
 	if err != nil {
 		if ent.IsNotFound(err) {
-			return NotFound(log.Errorf("query pin %q: %w", requestID, err))
+			return NotFound(fmt.Errorf("query pin %q: %w", requestID, err))
 		}
-		return log.Errorf("query pin %q: %w", requestID, err)
+		return fmt.Errorf("query pin %q: %w", requestID, err)
 	}
 
-	select {
-	case <-ctx.Done():
-		return log.Errorf("queue delete %q: %w", requestID, ctx.Err())
-	case h.Queue.Delete() <- pin:
+	err = db.QueueDelete(ctx, tx, pin)
+	if err != nil {
+		return fmt.Errorf("queue delete %q: %w", requestID, err)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return log.Errorf("commit transaction: %w", err)
+		return fmt.Errorf("commit transaction: %w", err)
 	}
+	h.Queue.Notify()
+
+	return nil
+}
+
+func (h PinHandler) PinEvents(ctx context.Context, lastEventID string) (<-chan sips.PinEvent, error) {
+	ctx, o, err := h.auth(ctx, db.ScopeRead)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	seq := o.EventSeq()
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 0)
+		if (err != nil) || (id < 0) {
+			return nil, BadRequest(fmt.Errorf("invalid last event ID %q", lastEventID))
+		}
+		seq = int(id)
+	}
+
+	// Subscribing before reading the events means that nothing can be
+	// missed in between.
+	wake, unsubscribe := h.Queue.Events.Subscribe(o)
+
+	events := make(chan sips.PinEvent)
+	go func() {
+		defer close(events)
+		defer unsubscribe()
+
+		// Events recorded by other processes, such as sipsctl, aren't
+		// published, so they're found by polling instead.
+		ticker := time.NewTicker(h.Queue.pollInterval())
+		defer ticker.Stop()
+
+		// Streams last indefinitely, so the client is checked again
+		// every so often in case its token has been revoked or has
+		// expired since it connected.
+		recheck := time.NewTicker(authRecheckInterval)
+		defer recheck.Stop()
+
+		for {
+			evs, err := db.EventsSince(ctx, h.DB, o, seq)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Ctx(ctx).Errorf("stream events: %w", err)
+				}
+				return
+			}
 
+			for _, ev := range evs {
+				seq = ev.Seq
+
+				var status sips.PinStatus
+				err := json.Unmarshal([]byte(ev.Payload), &status)
+				if err != nil {
+					log.Ctx(ctx).Errorf("unmarshal event %v of %v: %w", ev.Seq, o, err)
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case events <- sips.PinEvent{
+					ID:     strconv.FormatInt(int64(ev.Seq), 10),
+					Type:   ev.Type,
+					Status: status,
+				}:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			case <-ticker.C:
+			case <-recheck.C:
+				err := h.recheck(ctx, db.ScopeRead)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Ctx(ctx).Infof("closing event stream: %v", err)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// recheck returns an error if the client that ctx belongs to no longer
+// has scope, such as because its token has been revoked or its token
+// or certificate has expired. Unlike auth, it is meant for requests
+// that are already in progress, so it doesn't rate limit the client
+// or record its address.
+func (h PinHandler) recheck(ctx context.Context, scope db.Scope) error {
+	_, g, _, err := h.authLookup(ctx, "", scope)
+	if err != nil {
+		return err
+	}
+	if (g.Expires != nil) && time.Now().After(*g.Expires) {
+		return Unauthorized(fmt.Errorf("credentials expired at %v", g.Expires.Format(time.RFC3339)))
+	}
 	return nil
 }
@@ -2,28 +2,95 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"entgo.io/ent/dialect/sql"
 	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/cids"
+	"github.com/DeedleFake/sips/db/viewer"
 	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/job"
 	"github.com/DeedleFake/sips/ent/pin"
-	"github.com/DeedleFake/sips/internal/ipfsapi"
 	"github.com/DeedleFake/sips/internal/log"
+	"github.com/DeedleFake/sips/internal/metrics"
 )
 
-// PinQueue handles queued pin requests, synchronizing them to both
-// the database and IPFS.
+var (
+	queueDepth = metrics.NewGauge(
+		"sips_queue_jobs",
+		"Number of jobs in the pin queue, including running ones, by action.",
+		"action",
+	)
+	queueRunning = metrics.NewGauge(
+		"sips_queue_jobs_running",
+		"Number of jobs in the pin queue that are currently running, by action.",
+		"action",
+	)
+	pinOutcomes = metrics.NewCounter(
+		"sips_pin_outcomes_total",
+		"Number of add and update jobs that finished, by outcome (\"pinned\" or \"failed\").",
+		"outcome",
+	)
+)
+
+const (
+	// progressInterval is the minimum amount of time between writes of
+	// a pin's progress to the database.
+	progressInterval = time.Second
+
+	defaultPollInterval = 10 * time.Second
+
+	// repollInterval is the minimum amount of time between polls for
+	// more jobs when a user runs out of pending ones while workers are
+	// free.
+	repollInterval = time.Second
+)
+
+// PinQueue handles queued pin jobs, synchronizing them to both the
+// database and the pinning backend.
+//
+// Jobs are stored in the database, so they survive restarts. Jobs
+// that fail due to temporary problems, such as the backend being
+// unreachable, are retried with exponential backoff until MaxRetries
+// is exceeded, at which point the pin is marked as failed.
 type PinQueue struct {
 	running uint32
 	cancel  context.CancelFunc
 	done    chan struct{}
-
-	add    chan *ent.Pin
-	update chan [2]*ent.Pin
-	del    chan *ent.Pin
-
-	IPFS *ipfsapi.Client
-	DB   *ent.Client
+	wake    chan struct{}
+	locks   cidLocks
+
+	Backend Backend
+	DB      *ent.Client
+
+	// Events and Webhooks, if not nil, are told about changes in the
+	// status of pins after they are committed.
+	Events   *PinEvents
+	Webhooks *Webhooks
+
+	// MaxRetries is the number of times that a job is retried after
+	// failing due to a temporary error.
+	MaxRetries int
+
+	// Backoff is the delay before the first retry of a failed job. It
+	// is doubled for every subsequent retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// PollInterval is how often the database is checked for jobs that
+	// have become due. If it is zero, a default is used.
+	PollInterval time.Duration
+
+	// Workers is the maximum number of jobs that may run at once, and
+	// UserWorkers is the maximum number of jobs that may run at once
+	// for pins belonging to a single user. Zero means no limit.
+	Workers     int
+	UserWorkers int
 }
 
 func (q *PinQueue) setRunning() bool {
@@ -42,42 +109,63 @@ func (q *PinQueue) Start(ctx context.Context) {
 		panic("already running")
 	}
 
+	// The queue works on every user's pins.
+	ctx = viewer.SystemContext(ctx)
+
 	ctx, q.cancel = context.WithCancel(ctx)
 	q.done = make(chan struct{})
-
-	q.add = make(chan *ent.Pin)
-	q.update = make(chan [2]*ent.Pin)
-	q.del = make(chan *ent.Pin)
+	q.wake = make(chan struct{}, 1)
 
 	go q.run(ctx)
-	q.queueExisting(ctx)
 }
 
-// Stop stops a running queue. It does not return until the queue has
-// completely flushed all of its jobs.
+// Stop stops a running queue. It does not return until all jobs that
+// were in progress have been interrupted. Interrupted jobs will be
+// resumed the next time the queue is started.
 func (q *PinQueue) Stop() {
 	q.cancel()
 	<-q.done
 }
 
-// Add returns a channel to which pins that are to be added should be
-// sent.
-func (q *PinQueue) Add() chan<- *ent.Pin {
-	return q.add
+// Notify tells the queue that new jobs have been committed to the
+// database so that it can check for them without waiting for the
+// next poll.
+func (q *PinQueue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *PinQueue) pollInterval() time.Duration {
+	if q.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return q.PollInterval
 }
 
-// Update returns a channel to which pairs of pins should be sent
-// where the first pin is to be updated to the second one.
-func (q *PinQueue) Update() chan<- [2]*ent.Pin {
-	return q.update
+// backoff returns the delay before the given retry attempt.
+func (q *PinQueue) backoff(attempt int) time.Duration {
+	return backoff(q.Backoff, q.MaxBackoff, attempt)
 }
 
-// Delete returns a channel to which pins that are to be deleted
-// should be sent.
-func (q *PinQueue) Delete() chan<- *ent.Pin {
-	return q.del
+// backoff returns the delay before the given retry attempt, starting
+// at base and doubling with every attempt up to max. If max is not
+// positive, there is no limit.
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if (max > 0) && (d >= max) {
+			return max
+		}
+	}
+	return d
 }
 
+// queueExisting creates jobs for pins that are waiting to be pinned
+// but have no job, such as those that were queued by an older version
+// or reset using sipsctl.
 func (q *PinQueue) queueExisting(ctx context.Context) {
 	tx, err := q.DB.Tx(ctx)
 	if err != nil {
@@ -87,20 +175,22 @@ func (q *PinQueue) queueExisting(ctx context.Context) {
 	defer tx.Rollback()
 
 	pins, err := tx.Pin.Query().
-		Where(pin.StatusIn(sips.Queued, sips.Pinning)).
+		Where(
+			pin.StatusIn(sips.Queued, sips.Pinning),
+			pin.Not(pin.HasJobs()),
+		).
 		All(ctx)
 	if err != nil {
-		if ent.IsNotFound(err) {
-			log.Infof("no existing queued or in-progress pins")
-			return
-		}
-
 		log.Errorf("query existing queued pins: %w", err)
 		return
 	}
 
-	for _, pin := range pins {
-		q.add <- pin
+	for _, p := range pins {
+		err := db.QueueAdd(ctx, tx, p)
+		if err != nil {
+			log.Errorf("queue existing pin %v: %w", p.ID, err)
+			return
+		}
 	}
 
 	err = tx.Commit()
@@ -110,217 +200,723 @@ func (q *PinQueue) queueExisting(ctx context.Context) {
 	}
 }
 
+// measureDepth updates the queue depth metrics from the database.
+func (q *PinQueue) measureDepth(ctx context.Context) {
+	var rows []struct {
+		Action string `json:"action"`
+		Count  int    `json:"count"`
+	}
+	err := q.DB.Job.Query().
+		GroupBy(job.FieldAction).
+		Aggregate(ent.Count()).
+		Scan(ctx, &rows)
+	if err != nil {
+		log.Errorf("count queued jobs: %w", err)
+		return
+	}
+
+	depth := map[string]int{
+		string(job.ActionAdd):    0,
+		string(job.ActionUpdate): 0,
+		string(job.ActionDelete): 0,
+	}
+	for _, row := range rows {
+		depth[row.Action] = row.Count
+	}
+	for action, n := range depth {
+		queueDepth.With(action).Set(float64(n))
+	}
+}
+
+// dueJobs returns jobs that are ready to be run, grouped by the ID of
+// the user that owns the job's pin. Jobs for pins in the running set
+// are excluded, and at most limit jobs are returned per user if limit
+// is positive.
+func (q *PinQueue) dueJobs(ctx context.Context, running map[int]runningJob, limit int) (map[int][]*ent.Job, error) {
+	now := time.Now()
+	pinIDs := make([]interface{}, 0, len(running))
+	for id := range running {
+		pinIDs = append(pinIDs, id)
+	}
+
+	// due limits s to jobs that are due, given the column of s that
+	// holds the ID of the job's pin.
+	due := func(s *sql.Selector, pinColumn string) {
+		s.Where(sql.And(
+			sql.LTE(s.C(job.FieldNextAttempt), now),
+			sql.NotNull(pinColumn),
+		))
+		if len(pinIDs) > 0 {
+			s.Where(sql.NotIn(pinColumn, pinIDs...))
+		}
+	}
+
+	query := q.DB.Job.Query().
+		Where(func(s *sql.Selector) { due(s, s.C(job.PinColumn)) }).
+		WithPin(func(q *ent.PinQuery) { q.WithUser() }).
+		Order(ent.Asc(job.FieldNextAttempt), ent.Asc(job.FieldID))
+	if limit > 0 {
+		// Rather than querying each user's jobs separately, number each
+		// user's due jobs in order and only keep the first few.
+		query = query.Where(func(s *sql.Selector) {
+			b := sql.Dialect(s.Dialect())
+			jobs := b.Table(job.Table).As("j")
+			pins := b.Table(pin.Table).As("p")
+			ranked := b.Select(
+				jobs.C(job.FieldID),
+				fmt.Sprintf(
+					"ROW_NUMBER() OVER (PARTITION BY %v ORDER BY %v, %v) AS n",
+					pins.C(pin.UserColumn),
+					jobs.C(job.FieldNextAttempt),
+					jobs.C(job.FieldID),
+				),
+			).
+				From(jobs).
+				Join(pins).
+				On(jobs.C(job.PinColumn), pins.C(pin.FieldID))
+			due(ranked, pins.C(pin.FieldID))
+
+			s.Where(sql.In(
+				s.C(job.FieldID),
+				b.Select(job.FieldID).
+					From(ranked.As("ranked")).
+					Where(sql.LTE("n", limit)),
+			))
+		})
+	}
+
+	all, err := query.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query due jobs: %w", err)
+	}
+
+	// Pins whose user has been deleted are grouped together.
+	jobs := make(map[int][]*ent.Job)
+	for _, j := range all {
+		var uid int
+		if u := j.Edges.Pin.Edges.User; u != nil {
+			uid = u.ID
+		}
+		jobs[uid] = append(jobs[uid], j)
+	}
+
+	return jobs, nil
+}
+
+// superseded returns the IDs of pins in the running set that have had
+// their running job replaced by a different one.
+func (q *PinQueue) superseded(ctx context.Context, running map[int]runningJob) ([]int, error) {
+	if len(running) == 0 {
+		return nil, nil
+	}
+
+	pinIDs := make([]int, 0, len(running))
+	jobIDs := make([]int, 0, len(running))
+	for pinID, r := range running {
+		pinIDs = append(pinIDs, pinID)
+		jobIDs = append(jobIDs, r.id)
+	}
+
+	return q.DB.Pin.Query().
+		Where(
+			pin.IDIn(pinIDs...),
+			pin.HasJobsWith(job.IDNotIn(jobIDs...)),
+		).
+		IDs(ctx)
+}
+
+type runningJob struct {
+	id         int
+	user       int
+	cancel     context.CancelFunc
+	superseded bool
+}
+
 func (q *PinQueue) run(ctx context.Context) {
 	defer close(q.done)
 	defer q.unsetRunning()
 
-	add := q.add
-	update := q.update
-	del := q.del
+	// Running jobs are keyed by pin ID, as only one job may run for a
+	// given pin at a time.
+	jobs := make(map[int]runningJob)
+	perUser := make(map[int]int)
+	jobdone := make(chan *ent.Job)
+
+	// Jobs waiting for a worker are kept per user. Users are served in
+	// order of ID, starting after the last one that had a job started,
+	// so that no one user can starve the others.
+	var pending map[int][]*ent.Job
+	var lastUser int
+
+	// more holds the users that had as many due jobs as could be
+	// loaded at once during the last poll, and so might have more.
+	more := make(map[int]bool)
+	var lastPoll time.Time
+
+	start := func(uid int, j *ent.Job) {
+		sub, cancel := context.WithCancel(ctx)
+		sub = log.With(
+			sub,
+			"job", j.ID,
+			"action", j.Action,
+			"pin", j.Edges.Pin.ID,
+			"cid", j.Edges.Pin.CID,
+			"user", uid,
+		)
+		jobs[j.Edges.Pin.ID] = runningJob{id: j.ID, user: uid, cancel: cancel}
+		perUser[uid]++
+		go func() {
+			defer cancel()
+
+			running := queueRunning.With(string(j.Action))
+			running.Inc()
+			defer running.Dec()
+
+			q.runJob(sub, j)
+			jobdone <- j
+		}()
+	}
 
-	var stopping bool
-	jobs := make(map[int]context.CancelFunc)
-	jobdone := make(chan int)
-	jobctx := func(id int) context.Context {
-		if cancel, ok := jobs[id]; ok {
-			cancel()
-			// TODO: Wait for the job to actually cancel completely?
+	dispatch := func() {
+		users := make([]int, 0, len(pending))
+		for uid := range pending {
+			users = append(users, uid)
+		}
+		sort.Ints(users)
+
+		for (q.Workers <= 0) || (len(jobs) < q.Workers) {
+			i := sort.SearchInts(users, lastUser+1)
+
+			var started bool
+			for n := 0; n < len(users); n++ {
+				uid := users[(i+n)%len(users)]
+				if (len(pending[uid]) == 0) || ((q.UserWorkers > 0) && (perUser[uid] >= q.UserWorkers)) {
+					continue
+				}
+
+				start(uid, pending[uid][0])
+				pending[uid] = pending[uid][1:]
+				lastUser = uid
+				started = true
+				break
+			}
+			if !started {
+				return
+			}
+		}
+	}
+
+	// starved reports whether a worker is free for a user that might
+	// have more due jobs than were loaded.
+	starved := func() bool {
+		if (q.Workers > 0) && (len(jobs) >= q.Workers) {
+			return false
+		}
+		for uid := range more {
+			if (len(pending[uid]) == 0) && ((q.UserWorkers <= 0) || (perUser[uid] < q.UserWorkers)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	poll := func() {
+		lastPoll = time.Now()
+
+		q.queueExisting(ctx)
+		q.measureDepth(ctx)
+
+		superseded, err := q.superseded(ctx, jobs)
+		if err != nil {
+			log.Errorf("query superseded jobs: %w", err)
+			return
+		}
+		for _, pinID := range superseded {
+			// The replacement will be started once the running job exits.
+			r := jobs[pinID]
+			r.superseded = true
+			jobs[pinID] = r
+			r.cancel()
+		}
+
+		limit := q.UserWorkers
+		if limit <= 0 {
+			limit = q.Workers
+		}
+		pending, err = q.dueJobs(ctx, jobs, limit)
+		if err != nil {
+			log.Errorf("query due jobs: %w", err)
+			return
+		}
+		more = make(map[int]bool)
+		if limit > 0 {
+			for uid, ujobs := range pending {
+				if len(ujobs) >= limit {
+					more[uid] = true
+				}
+			}
 		}
 
-		ctx, cancel := context.WithCancel(ctx)
-		jobs[id] = cancel
-		return ctx
+		dispatch()
 	}
 
+	ticker := time.NewTicker(q.pollInterval())
+	defer ticker.Stop()
+	tick := ticker.C
+	wake := q.wake
+	var repoll <-chan time.Time
+
+	poll()
+
+	var stopping bool
 	ctxdone := ctx.Done()
 	for {
 		select {
 		case <-ctxdone:
 			ctxdone = nil
-
-			add = nil
-			update = nil
-			del = nil
+			tick = nil
+			wake = nil
+			repoll = nil
 
 			stopping = true
 			if len(jobs) == 0 {
 				return
 			}
 
-		case id := <-jobdone:
-			delete(jobs, id)
-			if stopping && (len(jobs) == 0) {
-				return
+		case j := <-jobdone:
+			r := jobs[j.Edges.Pin.ID]
+			delete(jobs, j.Edges.Pin.ID)
+			perUser[r.user]--
+			if perUser[r.user] <= 0 {
+				delete(perUser, r.user)
+			}
+
+			if stopping {
+				if len(jobs) == 0 {
+					return
+				}
+				continue
+			}
+
+			if r.superseded {
+				poll()
+				continue
+			}
+			dispatch()
+
+			// The pending jobs only go so far, so check for more before
+			// the next regular poll if they've run out, but not too often.
+			if (repoll == nil) && starved() {
+				if wait := repollInterval - time.Since(lastPoll); wait > 0 {
+					repoll = time.After(wait)
+					continue
+				}
+				poll()
 			}
 
-		case pin := <-add:
-			sub := jobctx(pin.ID)
-			go func() {
-				q.addPin(sub, pin)
-				jobdone <- pin.ID
-			}()
-
-		case pins := <-update:
-			sub := jobctx(pins[1].ID)
-			go func() {
-				q.updatePin(sub, pins[0], pins[1])
-				jobdone <- pins[1].ID
-			}()
-
-		case pin := <-del:
-			sub := jobctx(pin.ID)
-			go func() {
-				q.deletePin(sub, pin)
-				jobdone <- pin.ID
-			}()
+		case <-repoll:
+			repoll = nil
+			poll()
+
+		case <-tick:
+			poll()
+
+		case <-wake:
+			poll()
 		}
 	}
 }
 
-func (q *PinQueue) connect(ctx context.Context, origins []string) {
-	for _, origin := range origins {
-		go q.IPFS.SwarmConnect(ctx, origin)
+// runJob runs j and then records the result in the database.
+func (q *PinQueue) runJob(ctx context.Context, j *ent.Job) {
+	p := j.Edges.Pin
+
+	// The job might have been replaced while it was waiting.
+	exists, err := q.DB.Job.Query().Where(job.ID(j.ID)).Exist(ctx)
+	if err != nil {
+		log.Ctx(ctx).Errorf("check job %v: %w", j.ID, err)
+		return
+	}
+	if !exists {
+		return
 	}
+
+	log.Ctx(ctx).Debugf("running job %v", j.ID)
+	switch j.Action {
+	case job.ActionAdd:
+		err = q.addPin(ctx, p)
+	case job.ActionUpdate:
+		err = q.updatePin(ctx, j.OldCID, p)
+	case job.ActionDelete:
+		err = q.deletePin(ctx, j.OldCID, p)
+	}
+	if ctx.Err() != nil {
+		// The job was either superseded or the queue is stopping. In the
+		// latter case, it will be resumed next time.
+		return
+	}
+
+	q.finishJob(ctx, j, err)
 }
 
-func (q *PinQueue) addPin(ctx context.Context, pin *ent.Pin) {
-	tx, err := q.DB.Tx(ctx)
-	if err != nil {
-		log.Errorf("begin transaction for pin %d: %w", pin.ID, err)
+// finishJob records the result of running j. If err is nil, the job
+// is considered to have succeeded. Otherwise, it is either scheduled
+// to be retried or, if err is not temporary or the job has run out of
+// retries, the pin is marked as failed.
+func (q *PinQueue) finishJob(ctx context.Context, j *ent.Job, err error) {
+	p := j.Edges.Pin
+
+	tx, txerr := q.DB.Tx(ctx)
+	if txerr != nil {
+		log.Ctx(ctx).Errorf("begin transaction for job %v: %w", j.ID, txerr)
 		return
 	}
 	defer tx.Rollback()
 
-	q.connect(ctx, pin.Origins)
-
-	switch pin.Status {
-	case "", sips.Queued:
-		pin, err = tx.Pin.UpdateOne(pin).
-			SetStatus(sips.Pinning).
-			Save(ctx)
-		if err != nil {
-			log.Errorf("update pin %v status to pinning: %w", pin.ID, err)
+	_, txerr = tx.Job.Get(ctx, j.ID)
+	if txerr != nil {
+		if ent.IsNotFound(txerr) {
+			// Superseded by another job while running.
 			return
 		}
+		log.Ctx(ctx).Errorf("query job %v: %w", j.ID, txerr)
+		return
 	}
 
-	status := pin.Status
-	defer func() {
-		_, err := tx.Pin.UpdateOne(pin).
-			SetStatus(status).
-			Save(ctx)
-		if err != nil {
-			log.Errorf("update pin %v status to %v: %w", pin.ID, pin.Status, err)
-			return
+	var outcome string
+	var ev *ent.PinEvent
+	attempt := j.Attempts + 1
+	switch {
+	case err == nil:
+		ev, txerr = q.jobSucceeded(ctx, tx, j)
+		outcome = "pinned"
+
+	case isTemporary(err) && (attempt <= q.MaxRetries):
+		next := time.Now().Add(q.backoff(attempt))
+		log.Ctx(ctx).Infof("retrying job %v for pin %v at %v (attempt %v of %v): %v", j.ID, p.ID, next.Format(time.RFC3339), attempt, q.MaxRetries, err)
+
+		txerr = tx.Job.UpdateOne(j).
+			SetAttempts(attempt).
+			SetNextAttempt(next).
+			Exec(ctx)
+		if txerr != nil {
+			break
 		}
-
-		err = tx.Commit()
-		if err != nil {
-			log.Errorf("commit transaction for pin %v: %w", pin.ID, err)
-			return
+		if j.Action != job.ActionDelete {
+			var up *ent.Pin
+			up, txerr = tx.Pin.UpdateOne(p).
+				SetStatus(sips.Queued).
+				SetProgress(p.Progress).
+				SetLastError(err.Error()).
+				Save(ctx)
+			if txerr != nil {
+				break
+			}
+			ev, txerr = db.QueueEvent(ctx, tx, up, db.EventQueued)
 		}
-	}()
 
-	progress, err := q.IPFS.PinAddProgress(ctx, pin.CID)
-	if err != nil {
-		log.Errorf("pin %v to IPFS: %w", pin.CID, err)
-		status = sips.Failed
+	default:
+		ev, txerr = q.jobFailed(ctx, tx, j, err)
+		outcome = "failed"
+	}
+	if txerr != nil {
+		log.Ctx(ctx).Errorf("update job %v: %w", j.ID, txerr)
 		return
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case progress, closed := <-progress:
-			if closed {
-				log.Infof("pinned %v as %q (%v)", pin.CID, pin.Name, pin.ID)
-				status = sips.Pinned
-				return
-			}
+	txerr = tx.Commit()
+	if txerr != nil {
+		log.Ctx(ctx).Errorf("commit transaction for job %v: %w", j.ID, txerr)
+		return
+	}
 
-			if progress.Err != nil {
-				log.Errorf("pin %v to IPFS: %w", pin.CID, progress.Err)
-				status = sips.Failed
-				return
-			}
-		}
+	q.publish(ev)
+
+	if (outcome != "") && (j.Action != job.ActionDelete) {
+		pinOutcomes.With(outcome).Inc()
+	}
+}
+
+func (q *PinQueue) jobSucceeded(ctx context.Context, tx *ent.Tx, j *ent.Job) (*ent.PinEvent, error) {
+	p := j.Edges.Pin
+
+	err := tx.Job.DeleteOne(j).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Action == job.ActionDelete {
+		return deletePin(ctx, tx, p)
 	}
+
+	up, err := tx.Pin.UpdateOne(p).
+		SetStatus(sips.Pinned).
+		SetProgress(p.Progress).
+		SetSize(p.Size).
+		SetFinished(time.Now()).
+		ClearLastError().
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueueEvent(ctx, tx, up, db.EventPinned)
 }
 
-func (q *PinQueue) updatePin(ctx context.Context, from, to *ent.Pin) {
+func (q *PinQueue) jobFailed(ctx context.Context, tx *ent.Tx, j *ent.Job, jerr error) (*ent.PinEvent, error) {
+	p := j.Edges.Pin
+	log.Ctx(ctx).Errorf("job %v for pin %v failed: %w", j.ID, p.ID, jerr)
+
+	err := tx.Job.DeleteOne(j).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Action == job.ActionDelete {
+		// The user has already been told that the pin is gone, so
+		// delete it from the database regardless.
+		return deletePin(ctx, tx, p)
+	}
+
+	up, err := tx.Pin.UpdateOne(p).
+		SetStatus(sips.Failed).
+		SetProgress(p.Progress).
+		SetFinished(time.Now()).
+		SetLastError(jerr.Error()).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueueEvent(ctx, tx, up, db.EventFailed)
+}
+
+// deletePin removes p from the database, recording an event for its
+// deletion first, while its owner can still be found.
+func deletePin(ctx context.Context, tx *ent.Tx, p *ent.Pin) (*ent.PinEvent, error) {
+	ev, err := db.QueueEvent(ctx, tx, p, db.EventDeleted)
+	if err != nil {
+		return nil, err
+	}
+
+	return ev, tx.Pin.DeleteOne(p).Exec(ctx)
+}
+
+// publish tells subscribers and the webhook dispatcher about events
+// that have been committed. Nil events are ignored.
+func (q *PinQueue) publish(events ...*ent.PinEvent) {
+	q.Events.Publish(events...)
+	q.Webhooks.Notify()
+}
+
+// setPinning marks p as being in the process of being pinned.
+func (q *PinQueue) setPinning(ctx context.Context, p *ent.Pin) error {
 	tx, err := q.DB.Tx(ctx)
 	if err != nil {
-		log.Errorf("begin transaction for pin %d: %w", from.ID, err)
-		return
+		return fmt.Errorf("begin transaction for pin %v: %w", p.ID, err)
 	}
 	defer tx.Rollback()
 
-	q.connect(ctx, to.Origins)
+	now := time.Now()
+	up, err := tx.Pin.UpdateOne(p).
+		SetStatus(sips.Pinning).
+		SetStarted(now).
+		ClearFinished().
+		Save(ctx)
+	if err != nil {
+		return fmt.Errorf("update pin %v status to pinning: %w", p.ID, err)
+	}
 
-	if to.Status == sips.Queued {
-		to, err = tx.Pin.UpdateOne(to).
-			SetStatus(sips.Pinning).
-			Save(ctx)
-		if err != nil {
-			log.Errorf("update pin %v status from queued to pinning: %w", to.ID, err)
-			return
-		}
+	ev, err := db.QueueEvent(ctx, tx, up, db.EventPinning)
+	if err != nil {
+		return err
 	}
 
-	status := to.Status
-	defer func() {
-		_, err := tx.Pin.UpdateOne(to).
-			SetStatus(status).
-			Save(ctx)
-		if err != nil {
-			log.Errorf("update pin %v status to %v: %w", to.ID, to.Status, err)
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction for pin %v: %w", p.ID, err)
+	}
+	q.publish(ev)
+
+	p.Status = sips.Pinning
+	p.Started = &now
+	p.Finished = nil
+	return nil
+}
+
+func (q *PinQueue) addPin(ctx context.Context, p *ent.Pin) error {
+	err := q.setPinning(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	unlock := q.locks.lock(p.CID)
+	defer unlock()
+
+	var lastWrite time.Time
+	err = q.Backend.Add(ctx, p.CID, p.Origins, func(progress int) {
+		p.Progress = progress
+		if time.Since(lastWrite) < progressInterval {
 			return
 		}
+		lastWrite = time.Now()
 
-		err = tx.Commit()
+		err := q.DB.Pin.UpdateOne(p).
+			SetProgress(progress).
+			Exec(ctx)
 		if err != nil {
-			log.Errorf("commit transaction for pin %v: %w", to.ID, err)
-			return
+			log.Ctx(ctx).Errorf("update pin %v progress: %w", p.ID, err)
 		}
-	}()
-
-	// TODO: Unpin updated pins manually if nothing else has pinned them.
-	_, err = q.IPFS.PinUpdate(ctx, from.CID, to.CID, false)
+	})
 	if err != nil {
-		log.Errorf("update pin %v to %v: %w", from.ID, to.CID, err)
-		status = sips.Failed
-		return
+		return fmt.Errorf("pin %v: %w", p.CID, err)
 	}
-	log.Infof("pin %v updated from %v to %v", to.ID, from.CID, to.CID)
+	log.Ctx(ctx).Infof("pinned %v as %q (%v)", p.CID, p.Name, p.ID)
 
-	status = sips.Pinned
+	q.measure(ctx, p)
+	return nil
 }
 
-func (q *PinQueue) deletePin(ctx context.Context, pin *ent.Pin) {
-	tx, err := q.DB.Tx(ctx)
+func (q *PinQueue) updatePin(ctx context.Context, from string, to *ent.Pin) error {
+	err := q.setPinning(ctx, to)
 	if err != nil {
-		log.Errorf("begin transaction for pin %d: %w", pin.ID, err)
-		return
+		return err
 	}
-	defer tx.Rollback()
 
-	_, err = q.IPFS.PinRm(ctx, pin.CID)
+	unlock := q.locks.lock(from, to.CID)
+	err = q.Backend.Update(ctx, from, to.CID, to.Origins)
+	unlock()
 	if err != nil {
-		log.Errorf("remove pin %v from IPFS: %w", pin.CID, err)
-		return
+		return fmt.Errorf("update pin %v to %v: %w", to.ID, to.CID, err)
 	}
-	log.Infof("pin %v (%q, %v) deleted", pin.ID, pin.Name, pin.CID)
+	log.Ctx(ctx).Infof("pin %v updated from %v to %v", to.ID, from, to.CID)
 
-	err = tx.Pin.DeleteOneID(pin.ID).Exec(ctx)
+	// The new CID is pinned at this point, so failing to remove the
+	// old one isn't a reason to fail the whole update.
+	err = q.release(ctx, from, to)
 	if err != nil {
-		log.Errorf("delete pin %v from database: %w", pin.ID, err)
-		return
+		log.Ctx(ctx).Errorf("remove old pin %v of pin %v: %w", from, to.ID, err)
 	}
 
-	err = tx.Commit()
+	q.measure(ctx, to)
+	return nil
+}
+
+// measure sets the size of p to the size of its content as reported
+// by the backend. Failure is only logged, as the pin itself has
+// already succeeded by the time that this is called.
+func (q *PinQueue) measure(ctx context.Context, p *ent.Pin) {
+	size, err := q.Backend.Size(ctx, p.CID)
 	if err != nil {
-		log.Errorf("commit transaction for pin %v: %w", pin.ID, err)
+		log.Ctx(ctx).Errorf("measure size of %v: %w", p.CID, err)
 		return
 	}
+	p.Size = size
+}
+
+func (q *PinQueue) deletePin(ctx context.Context, from string, p *ent.Pin) error {
+	cids := []string{p.CID}
+	if from != "" {
+		cids = append(cids, from)
+	}
+
+	for _, cid := range cids {
+		err := q.release(ctx, cid, p)
+		if err != nil {
+			return fmt.Errorf("remove pin %v: %w", cid, err)
+		}
+	}
+	log.Ctx(ctx).Infof("pin %v (%q, %v) deleted", p.ID, p.Name, p.CID)
+
+	return nil
+}
+
+// release removes cid from the backend on behalf of p, unless another
+// pin still needs it. See db.CIDInUse for details.
+//
+// The check and the removal happen while holding cid's lock, which
+// pinning also holds, so a pin of the same content that is added in
+// the meantime either is seen by the check or is pinned again after
+// the removal, rather than having its content removed out from under
+// it.
+func (q *PinQueue) release(ctx context.Context, cid string, p *ent.Pin) error {
+	unlock := q.locks.lock(cid)
+	defer unlock()
+
+	inuse, err := db.CIDInUse(ctx, q.DB, cid, p.ID)
+	if err != nil {
+		return err
+	}
+	if inuse {
+		log.Ctx(ctx).Infof("leaving %v pinned, as it is still in use by another pin", cid)
+		return nil
+	}
+
+	return q.Backend.Remove(ctx, cid)
+}
+
+// cidLocks is a set of locks keyed by the content that CIDs refer to,
+// so that pinning and unpinning the same content can't interleave. The
+// zero value is ready to use.
+type cidLocks struct {
+	m     sync.Mutex
+	locks map[string]*cidLock
+}
+
+type cidLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the content of each of the given CIDs, in a consistent
+// order so that overlapping calls can't deadlock, and returns a
+// function that unlocks them again.
+func (l *cidLocks) lock(strs ...string) (unlock func()) {
+	keys := make([]string, 0, len(strs))
+	for _, str := range strs {
+		keys = append(keys, cids.Key(str))
+	}
+	sort.Strings(keys)
+
+	locked := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if (i > 0) && (key == keys[i-1]) {
+			continue
+		}
+		l.ref(key).Lock()
+		locked = append(locked, key)
+	}
+
+	return func() {
+		for _, key := range locked {
+			l.unref(key)
+		}
+	}
+}
+
+func (l *cidLocks) ref(key string) *cidLock {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[string]*cidLock)
+	}
+
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = new(cidLock)
+		l.locks[key] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *cidLocks) unref(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	lock := l.locks[key]
+	lock.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, key)
+	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"entgo.io/ent/dialect"
+	"entgo.io/ent/dialect/sql"
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/DeedleFake/sips/ent/predicate"
+)
+
+// nameMatches returns a predicate that matches pin names against
+// name using the given strategy. It will panic if the strategy is
+// invalid.
+//
+// The generated Contains and Fold predicates are built on LIKE, which
+// would treat any '%' or '_' in name as wildcards, so the partial and
+// case-insensitive strategies are implemented manually instead.
+func nameMatches(match sips.TextMatchingStrategy, name string) predicate.Pin {
+	switch match {
+	case sips.Exact:
+		return pin.NameEQ(name)
+
+	case sips.IExact:
+		return predicate.Pin(func(s *sql.Selector) {
+			s.Where(sql.P(func(b *sql.Builder) {
+				b.WriteString("LOWER(").Ident(s.C(pin.FieldName)).WriteString(") = LOWER(").Arg(name).WriteString(")")
+			}))
+		})
+
+	case sips.Partial:
+		return predicate.Pin(func(s *sql.Selector) {
+			s.Where(sql.P(func(b *sql.Builder) {
+				b.WriteString(strpos(b)).WriteString("(").Ident(s.C(pin.FieldName)).Comma().Arg(name).WriteString(") > 0")
+			}))
+		})
+
+	case sips.IPartial:
+		return predicate.Pin(func(s *sql.Selector) {
+			s.Where(sql.P(func(b *sql.Builder) {
+				b.WriteString(strpos(b)).WriteString("(LOWER(").Ident(s.C(pin.FieldName)).WriteString("), LOWER(").Arg(name).WriteString(")) > 0")
+			}))
+		})
+
+	default:
+		panic(fmt.Errorf("invalid text matching strategy: %q", match))
+	}
+}
+
+// strpos returns the name of the substring search function for the
+// builder's dialect.
+func strpos(b *sql.Builder) string {
+	if b.Dialect() == dialect.Postgres {
+		return "STRPOS"
+	}
+	return "INSTR"
+}
+
+// metaContains returns a predicate that matches pins whose metadata
+// contains every key in meta with the same value.
+func metaContains(meta map[string]string) predicate.Pin {
+	return predicate.Pin(func(s *sql.Selector) {
+		col := s.C(pin.FieldMeta)
+
+		switch s.Dialect() {
+		case dialect.Postgres:
+			buf, _ := json.Marshal(meta)
+			s.Where(sql.P(func(b *sql.Builder) {
+				b.Ident(col).WriteString(" @> ").Arg(string(buf)).WriteString("::jsonb")
+			}))
+
+		default:
+			// SQLite's JSON functions aren't available in every build, so
+			// each pair is instead searched for in the stored text. Meta
+			// is always encoded by encoding/json, which sorts keys and
+			// doesn't add whitespace, so a pair is present exactly when
+			// its encoding appears preceded by '{' or ',' and followed by
+			// ',' or '}'. Quotes inside of keys and values are escaped,
+			// so a match can't start or end in the middle of one.
+			preds := make([]*sql.Predicate, 0, len(meta))
+			for k, v := range meta {
+				buf, _ := json.Marshal(map[string]string{k: v})
+				pair := string(buf[1 : len(buf)-1])
+
+				var alts []*sql.Predicate
+				for _, before := range []string{"{", ","} {
+					for _, after := range []string{",", "}"} {
+						pattern := before + pair + after
+						alts = append(alts, sql.P(func(b *sql.Builder) {
+							b.WriteString("INSTR(").Ident(col).Comma().Arg(pattern).WriteString(") > 0")
+						}))
+					}
+				}
+				preds = append(preds, sql.Or(alts...))
+			}
+			s.Where(sql.And(preds...))
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled completely are
+// removed from a RateLimiter.
+const sweepInterval = time.Minute
+
+// RateLimiter is a token bucket rate limiter with a separate bucket for
+// each key. A nil RateLimiter allows everything.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a RateLimiter that allows rate requests per
+// second for each key, with bursts of up to burst requests. If rate is
+// zero or less, it returns nil.
+func newRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket for key. If there aren't any, it
+// returns false along with how long it will be until there is one.
+func (l *RateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b := l.fill(key, now)
+	if b.tokens < 1 {
+		return false, l.waitFor(b)
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// wait returns how long it will be until there is a token in the
+// bucket for key, without taking one.
+func (l *RateLimiter) wait(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b := l.fill(key, now)
+	if b.tokens < 1 {
+		return l.waitFor(b)
+	}
+	return 0
+}
+
+// fill returns the bucket for key after refilling it for the time
+// that has passed since it was last used.
+func (l *RateLimiter) fill(key string, now time.Time) *bucket {
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+func (l *RateLimiter) waitFor(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,76 @@
+//go:build sqlite3
+// +build sqlite3
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+)
+
+func TestAuthRateLimit(t *testing.T) {
+	ctx := viewer.SystemContext(context.Background())
+
+	entc, err := db.OpenAndMigrate(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_fk=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entc.Close()
+	alice := entc.User.Create().SetName("alice").SaveX(ctx)
+	for _, tok := range []string{"first", "second", "third"} {
+		entc.Token.Create().
+			SetUser(alice).
+			SetHash(db.HashToken(nil, tok)).
+			SetPrefix(tok).
+			SaveX(ctx)
+	}
+
+	h := sips.Handler(PinHandler{
+		Backend:     nopBackend{},
+		DB:          entc,
+		Limiter:     newRateLimiter(0.001, 1),
+		FailLimiter: newRateLimiter(0.001, 1),
+	})
+
+	do := func(token, addr string) int {
+		req := httptest.NewRequest("GET", "/pins", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = addr + ":1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if (rec.Code == http.StatusTooManyRequests) && (rec.Header().Get("Retry-After") == "") {
+			t.Errorf("no Retry-After header for %q from %v", token, addr)
+		}
+		return rec.Code
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		addr   string
+		status int
+	}{
+		{name: "First", token: "first", addr: "192.0.2.1", status: http.StatusOK},
+		{name: "FirstAgain", token: "first", addr: "192.0.2.2", status: http.StatusTooManyRequests},
+		{name: "OtherToken", token: "second", addr: "192.0.2.1", status: http.StatusOK},
+
+		// Bad tokens can't use up a real token's requests, but do use
+		// up those of the address that they come from, even when it
+		// then tries a valid token.
+		{name: "BadToken", token: "first-but-wrong", addr: "192.0.2.3", status: http.StatusUnauthorized},
+		{name: "BadTokenAgain", token: "first-but-wrong", addr: "192.0.2.3", status: http.StatusTooManyRequests},
+		{name: "AfterBadToken", token: "third", addr: "192.0.2.3", status: http.StatusTooManyRequests},
+		{name: "BadTokenElsewhere", token: "wrong", addr: "192.0.2.4", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		if status := do(test.token, test.addr); status != test.status {
+			t.Errorf("%v: got status %v, want %v", test.name, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %v within burst was denied", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("request over burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("got wait %v, want %v", wait, 500*time.Millisecond)
+	}
+	if got := l.wait("a", now); got != wait {
+		t.Errorf("got wait %v without taking a token, want %v", got, wait)
+	}
+
+	if ok, _ := l.allow("b", now); !ok {
+		t.Fatal("request with another key was denied")
+	}
+
+	now = now.Add(wait)
+	if got := l.wait("a", now); got != 0 {
+		t.Errorf("got wait %v after refilling, want 0", got)
+	}
+	if ok, _ := l.allow("a", now); !ok {
+		t.Fatal("request after refilling was denied")
+	}
+}
+
+func TestRateLimiterNil(t *testing.T) {
+	l := newRateLimiter(0, 10)
+	if l != nil {
+		t.Fatal("got a limiter with no rate")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("a", time.Now()); !ok {
+			t.Fatal("nil limiter denied a request")
+		}
+	}
+	if wait := l.wait("a", time.Now()); wait != 0 {
+		t.Fatalf("nil limiter returned wait %v", wait)
+	}
+}
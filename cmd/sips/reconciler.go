@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/internal/log"
+)
+
+// Reconciler periodically compares the pins in the database with the
+// pins in the backend, requeuing pins that have gone missing and
+// reporting, and optionally removing, pins that the database doesn't
+// know about.
+type Reconciler struct {
+	Queue   *PinQueue
+	Backend Backend
+	DB      *ent.Client
+
+	// Interval is the time between reconciliations.
+	Interval time.Duration
+
+	// Unpin causes orphaned pins to be removed from the backend. This
+	// should only be enabled if nothing other than SIPS pins to the
+	// backend.
+	Unpin bool
+
+	// DryRun causes problems to be logged without being fixed.
+	DryRun bool
+}
+
+// Run reconciles once every interval until ctx is canceled.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reconcile(ctx)
+		}
+	}
+}
+
+// Reconcile performs a single reconciliation.
+func (r *Reconciler) Reconcile(ctx context.Context) {
+	ctx = viewer.SystemContext(ctx)
+
+	pinned, err := r.Backend.Pins(ctx)
+	if err != nil {
+		log.Errorf("list backend pins: %w", err)
+		return
+	}
+
+	result, err := db.Reconcile(ctx, r.DB, pinned, r.DryRun)
+	if err != nil {
+		log.Errorf("reconcile: %w", err)
+		return
+	}
+
+	for _, p := range result.Missing {
+		log.Infof("pin %v (%q, %v) is missing from the backend", p.ID, p.Name, p.CID)
+	}
+	if (len(result.Missing) > 0) && !r.DryRun {
+		log.Infof("requeued %v missing pins", len(result.Missing))
+		r.Queue.Notify()
+		r.Queue.publish(result.Events...)
+	}
+
+	for _, cid := range result.Orphans {
+		if !r.Unpin || r.DryRun {
+			log.Infof("%v is pinned but not in the database", cid)
+			continue
+		}
+
+		err := r.Backend.Remove(ctx, cid)
+		if err != nil {
+			log.Errorf("remove orphaned pin %v: %w", cid, err)
+			continue
+		}
+		log.Infof("removed orphaned pin %v", cid)
+	}
+}
@@ -15,21 +15,106 @@ import (
 
 	"github.com/DeedleFake/sips"
 	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/internal/adminapi"
 	"github.com/DeedleFake/sips/internal/cli"
+	"github.com/DeedleFake/sips/internal/clusterapi"
+	"github.com/DeedleFake/sips/internal/config"
 	"github.com/DeedleFake/sips/internal/ipfsapi"
 	"github.com/DeedleFake/sips/internal/log"
+	"github.com/DeedleFake/sips/internal/metrics"
 )
 
-func run(ctx context.Context) error {
-	addr := flag.String("addr", ":8080", "address to serve HTTP on")
-	api := flag.String("api", "http://127.0.0.1:5001", "IPFS API to contact")
-	apitimeout := flag.Duration("apitimeout", 30*time.Second, "timeout for requests to the IPFS API")
-	dbdriver := flag.String("dbdriver", "postgres", "database driver to use (\"list\" to show available)")
-	rawdbpath := flag.String("db", "host=/var/run/postgresql dbname=sips", "path to database ($CONFIG will be replaced with user config dir path)")
-	domigration := flag.Bool("migrate", true, "perform a database migration upon starting")
+// loadConfig loads the configuration from the config file, the
+// environment, and the command-line flags, in that order of
+// precedence.
+func loadConfig() (config.Config, error) {
+	cfg := config.Default()
+
+	configpath := flag.String("config", "", "path to YAML config file (default $SIPS_CONFIG or sips/config.yaml in the user config dir, if it exists)")
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to serve HTTP on")
+	flag.StringVar(&cfg.MetricsAddr, "metricsaddr", cfg.MetricsAddr, "address to serve Prometheus metrics on at /metrics (empty to disable)")
+	flag.StringVar(&cfg.AdminAddr, "adminaddr", cfg.AdminAddr, "address to serve the admin API on (empty to serve it on addr under /admin/)")
+	flag.Float64Var(&cfg.RateLimit, "ratelimit", cfg.RateLimit, "maximum requests per second per token (0 for no limit)")
+	flag.IntVar(&cfg.RateBurst, "rateburst", cfg.RateBurst, "number of requests per token allowed in a burst above ratelimit")
+	flag.Float64Var(&cfg.AuthFailRate, "authfailrate", cfg.AuthFailRate, "maximum failed authentication attempts per second per address (0 for no limit)")
+	flag.IntVar(&cfg.AuthFailBurst, "authfailburst", cfg.AuthFailBurst, "number of failed authentication attempts per address allowed in a burst above authfailrate")
+	flag.IntVar(&cfg.MaxBodySize, "maxbodysize", cfg.MaxBodySize, "maximum size of request bodies in bytes (0 for no limit)")
+	flag.IntVar(&cfg.MaxQueued, "maxqueued", cfg.MaxQueued, "maximum number of pins a single user may have queued at once (0 for no limit)")
+	flag.StringVar(&cfg.TLSCert, "tlscert", cfg.TLSCert, "path to TLS certificate to serve HTTPS with, reloaded on SIGHUP or when changed ($CONFIG will be replaced with user config dir path)")
+	flag.StringVar(&cfg.TLSKey, "tlskey", cfg.TLSKey, "path to TLS private key ($CONFIG will be replaced with user config dir path)")
+	flag.StringVar(&cfg.TLSClientCA, "tlsclientca", cfg.TLSClientCA, "path to CA certificates that may sign client certificates, which authenticate as the user named by their common name ($CONFIG will be replaced with user config dir path)")
+	flag.StringVar(&cfg.Backend, "backend", cfg.Backend, "pinning backend to use (\"kubo\" or \"cluster\")")
+	flag.StringVar(&cfg.API, "api", cfg.API, "IPFS API to contact (used only to measure pin sizes with the cluster backend)")
+	flag.StringVar(&cfg.Cluster, "cluster", cfg.Cluster, "IPFS Cluster REST API to contact")
+	flag.DurationVar(&cfg.APITimeout, "apitimeout", cfg.APITimeout, "timeout for requests to the IPFS or IPFS Cluster API")
+	flag.IntVar(&cfg.ReplMin, "replmin", cfg.ReplMin, "minimum replication factor for cluster pins (0 for cluster default)")
+	flag.IntVar(&cfg.ReplMax, "replmax", cfg.ReplMax, "maximum replication factor for cluster pins (0 for cluster default)")
+	flag.StringVar(&cfg.DBDriver, "dbdriver", cfg.DBDriver, "database driver to use (\"list\" to show available)")
+	flag.StringVar(&cfg.DB, "db", cfg.DB, "path to database ($CONFIG will be replaced with user config dir path)")
+	flag.BoolVar(&cfg.Migrate, "migrate", cfg.Migrate, "perform a database migration upon starting")
+	flag.StringVar(&cfg.TokenKey, "tokenkey", cfg.TokenKey, "path to file containing the key used to hash auth tokens, which is generated if it doesn't exist ($CONFIG will be replaced with user config dir path)")
+	flag.IntVar(&cfg.MaxRetries, "maxretries", cfg.MaxRetries, "number of times to retry pin jobs that fail due to temporary errors")
+	flag.DurationVar(&cfg.RetryBackoff, "retrybackoff", cfg.RetryBackoff, "delay before the first retry of a failed pin job")
+	flag.DurationVar(&cfg.MaxRetryBackoff, "maxretrybackoff", cfg.MaxRetryBackoff, "maximum delay between retries of a failed pin job")
+	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "maximum number of pin jobs to run at once (0 for no limit)")
+	flag.IntVar(&cfg.UserWorkers, "userworkers", cfg.UserWorkers, "maximum number of pin jobs to run at once for a single user (0 for no limit)")
+	flag.IntVar(&cfg.WebhookRetries, "webhookretries", cfg.WebhookRetries, "number of times to retry failed webhook deliveries, using the same backoff as pin jobs")
+	flag.DurationVar(&cfg.WebhookTimeout, "webhooktimeout", cfg.WebhookTimeout, "timeout for webhook deliveries")
+	flag.IntVar(&cfg.WebhookWorkers, "webhookworkers", cfg.WebhookWorkers, "maximum number of webhook deliveries to send at once")
+	flag.DurationVar(&cfg.Reconcile, "reconcile", cfg.Reconcile, "interval between reconciliations of the database with the backend (0 to disable)")
+	flag.BoolVar(&cfg.ReconcileUnpin, "reconcileunpin", cfg.ReconcileUnpin, "remove pins from the backend that aren't in the database when reconciling")
+	flag.BoolVar(&cfg.ReconcileDryRun, "reconciledryrun", cfg.ReconcileDryRun, "only log problems found when reconciling without fixing them")
+	flag.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, "minimum level of messages to log (\"debug\", \"info\", or \"error\")")
+	flag.StringVar(&cfg.LogFormat, "logformat", cfg.LogFormat, "format to write logs in (\"logfmt\" or \"json\")")
 	flag.Parse()
 
-	if *dbdriver == "list" {
+	// Flags take precedence over everything else, so the ones that were
+	// set are set again after loading the rest of the configuration.
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	path, err := config.File(*configpath)
+	if err != nil {
+		return cfg, err
+	}
+	err = cfg.Load(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	for name, val := range set {
+		err := flag.Set(name, val)
+		if err != nil {
+			return cfg, fmt.Errorf("set flag %q: %w", name, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+func run(ctx context.Context) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	level, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+
+	format, err := log.ParseFormat(cfg.LogFormat)
+	if err != nil {
+		return err
+	}
+	log.SetFormat(format)
+
+	if cfg.DBDriver == "list" {
 		fmt.Println("Available database drivers:")
 		for _, t := range db.Drivers() {
 			fmt.Printf("  %s\n", t)
@@ -37,60 +122,236 @@ func run(ctx context.Context) error {
 		return nil
 	}
 
-	dbpath, configDirUsed, err := cli.ExpandConfig(*rawdbpath)
+	dbpath, configDirUsed, err := cli.ExpandConfig(cfg.DB)
+	if err != nil {
+		return err
+	}
+
+	tokenkeypath, _, err := cli.ExpandConfig(cfg.TokenKey)
 	if err != nil {
 		return err
 	}
 
 	ipfs := ipfsapi.NewClient(
-		ipfsapi.WithBaseURL(*api),
+		ipfsapi.WithBaseURL(cfg.API),
 		ipfsapi.WithHTTPClient(&http.Client{
-			Timeout: *apitimeout,
+			Timeout: cfg.APITimeout,
 		}),
 	)
 
+	var backend Backend
+	switch cfg.Backend {
+	case "kubo":
+		backend = Kubo{
+			IPFS: ipfs,
+		}
+
+	case "cluster":
+		backend = Cluster{
+			Client: clusterapi.NewClient(
+				clusterapi.WithBaseURL(cfg.Cluster),
+				clusterapi.WithHTTPClient(&http.Client{
+					Timeout: cfg.APITimeout,
+				}),
+			),
+			IPFS:           ipfs,
+			ReplicationMin: cfg.ReplMin,
+			ReplicationMax: cfg.ReplMax,
+		}
+
+	default:
+		return fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+
 	if configDirUsed {
 		err := os.MkdirAll(filepath.Dir(dbpath), 0770)
 		if err != nil {
 			return fmt.Errorf("create config directory: %w", err)
 		}
 	}
-	entc, err := db.Open(*dbdriver, dbpath)
+	entc, err := db.Open(cfg.DBDriver, dbpath)
 	if err != nil {
 		return fmt.Errorf("open database: %w", err)
 	}
 	defer entc.Close()
 	log.Infof("database opened at %q", dbpath)
 
-	if *domigration {
+	if cfg.Migrate {
 		log.Infof("running database migration")
 		err = entc.Schema.Create(ctx)
 		if err != nil {
 			return fmt.Errorf("migrate database: %w", err)
 		}
+
+		n, err := db.FillCIDKeys(viewer.SystemContext(ctx), entc)
+		if err != nil {
+			return fmt.Errorf("fill CID keys: %w", err)
+		}
+		if n > 0 {
+			log.Infof("filled CID keys of %v pins and jobs", n)
+		}
 	}
 
+	tokenkey, created, err := db.LoadTokenKey(viewer.SystemContext(ctx), entc, tokenkeypath)
+	if err != nil {
+		return fmt.Errorf("load token key: %w", err)
+	}
+	if created {
+		log.Infof("generated new token key at %q", tokenkeypath)
+	}
+
+	// Plaintext tokens are hashed even if migration is disabled so that
+	// they're never left lying around in the database.
+	n, err := db.HashTokens(viewer.SystemContext(ctx), entc, tokenkey)
+	if err != nil {
+		return fmt.Errorf("hash plaintext tokens: %w", err)
+	}
+	if n > 0 {
+		log.Infof("hashed %v plaintext tokens", n)
+	}
+
+	webhooks := Webhooks{
+		DB: entc,
+		Client: &http.Client{
+			Timeout: cfg.WebhookTimeout,
+		},
+		MaxRetries: cfg.WebhookRetries,
+		Backoff:    cfg.RetryBackoff,
+		MaxBackoff: cfg.MaxRetryBackoff,
+		Workers:    cfg.WebhookWorkers,
+	}
+	webhooks.Start(ctx)
+	defer webhooks.Stop()
+
+	var events PinEvents
+
 	queue := PinQueue{
-		IPFS: ipfs,
-		DB:   entc,
+		Backend:    backend,
+		DB:         entc,
+		Events:     &events,
+		Webhooks:   &webhooks,
+		MaxRetries: cfg.MaxRetries,
+		Backoff:    cfg.RetryBackoff,
+		MaxBackoff: cfg.MaxRetryBackoff,
+
+		Workers:     cfg.Workers,
+		UserWorkers: cfg.UserWorkers,
 	}
 	queue.Start(ctx)
 	defer queue.Stop()
 
+	if cfg.Reconcile > 0 {
+		reconciler := Reconciler{
+			Queue:    &queue,
+			Backend:  backend,
+			DB:       entc,
+			Interval: cfg.Reconcile,
+			Unpin:    cfg.ReconcileUnpin,
+			DryRun:   cfg.ReconcileDryRun,
+		}
+		go reconciler.Run(ctx)
+	}
+
 	ph := PinHandler{
-		Queue: &queue,
-		IPFS:  ipfs,
-		DB:    entc,
+		Queue:   &queue,
+		Backend: backend,
+		DB:      entc,
+
+		TokenKey:    tokenkey,
+		MaxQueued:   cfg.MaxQueued,
+		Limiter:     newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+		FailLimiter: newRateLimiter(cfg.AuthFailRate, cfg.AuthFailBurst),
+	}
+
+	handler := sips.Handler(
+		newLoggingHandler(&ph),
+		sips.WithMaxBodySize(int64(cfg.MaxBodySize)),
+	)
+
+	admin := adminHandler(&ph, &adminapi.DB{
+		Client:   entc,
+		TokenKey: tokenkey,
+		Committed: func(events ...*ent.PinEvent) {
+			queue.Notify()
+			queue.publish(events...)
+		},
+	})
+
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		adminServer = &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: admin,
+			BaseContext: func(lis net.Listener) context.Context {
+				return ctx
+			},
+		}
+	} else {
+		mux := http.NewServeMux()
+		mux.Handle("/admin/", admin)
+		mux.Handle("/", handler)
+		handler = mux
 	}
 
 	server := http.Server{
-		Addr:    *addr,
-		Handler: sips.Handler(&ph),
+		Addr:    cfg.Addr,
+		Handler: handler,
 		BaseContext: func(lis net.Listener) context.Context {
 			return ctx
 		},
 	}
 
+	switch {
+	case (cfg.TLSCert != "") && (cfg.TLSKey != ""):
+		certs, err := newCertReloader(cfg)
+		if err != nil {
+			return err
+		}
+		go certs.Watch(ctx)
+		server.TLSConfig = certs.TLSConfig()
+
+	case (cfg.TLSCert != "") || (cfg.TLSKey != ""):
+		return errors.New("both tlscert and tlskey must be set to serve HTTPS")
+
+	case cfg.TLSClientCA != "":
+		return errors.New("tlsclientca requires tlscert and tlskey to be set")
+	}
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.MetricsAddr,
+			Handler: mux,
+		}
+
+		go func() {
+			log.Infof("serving metrics on %q", cfg.MetricsAddr)
+			err := metricsServer.ListenAndServe()
+			if (err != nil) && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("serve metrics: %w", err)
+			}
+		}()
+	}
+
+	if adminServer != nil {
+		adminServer.TLSConfig = server.TLSConfig
+		go func() {
+			var err error
+			if adminServer.TLSConfig != nil {
+				log.Infof("serving admin API over HTTPS on %q", cfg.AdminAddr)
+				err = adminServer.ListenAndServeTLS("", "")
+			} else {
+				log.Infof("serving admin API on %q", cfg.AdminAddr)
+				err = adminServer.ListenAndServe()
+			}
+			if (err != nil) && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("serve admin API: %w", err)
+			}
+		}()
+	}
+
 	shutdown := make(chan error, 1)
 	go func() {
 		<-ctx.Done()
@@ -99,11 +360,22 @@ func run(ctx context.Context) error {
 		defer cancel()
 
 		log.Infof("exiting")
+		if metricsServer != nil {
+			metricsServer.Shutdown(sctx)
+		}
+		if adminServer != nil {
+			adminServer.Shutdown(sctx)
+		}
 		shutdown <- server.Shutdown(sctx)
 	}()
 
-	log.Infof("starting server on %q", *addr)
-	err = server.ListenAndServe()
+	if server.TLSConfig != nil {
+		log.Infof("starting HTTPS server on %q", cfg.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Infof("starting server on %q", cfg.Addr)
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		if !errors.Is(err, http.ErrServerClosed) {
 			return fmt.Errorf("start server: %w", err)
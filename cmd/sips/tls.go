@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/DeedleFake/sips/internal/cli"
+	"github.com/DeedleFake/sips/internal/config"
+	"github.com/DeedleFake/sips/internal/log"
+)
+
+const defaultTLSWatchInterval = 10 * time.Second
+
+// CertReloader serves a TLS certificate from files on disk, reloading
+// it when the files change. Connections that are already open keep
+// using the certificate that they were established with, so none are
+// dropped by a reload.
+//
+// If ClientCAFile is set, clients may authenticate with a certificate
+// signed by one of the CAs in it. Requests from such clients are
+// authenticated as the user whose name matches the certificate's
+// common name if they don't also include a bearer token.
+type CertReloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	// WatchInterval is how often the files are checked for changes. If
+	// it is zero, a default is used.
+	WatchInterval time.Duration
+
+	m       sync.RWMutex
+	cert    *tls.Certificate
+	clients *x509.CertPool
+	mod     map[string]time.Time
+}
+
+func newCertReloader(cfg config.Config) (*CertReloader, error) {
+	var r CertReloader
+	paths := []struct {
+		dst *string
+		src string
+	}{
+		{&r.CertFile, cfg.TLSCert},
+		{&r.KeyFile, cfg.TLSKey},
+		{&r.ClientCAFile, cfg.TLSClientCA},
+	}
+	for _, p := range paths {
+		path, _, err := cli.ExpandConfig(p.src)
+		if err != nil {
+			return nil, err
+		}
+		*p.dst = path
+	}
+
+	err := r.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Load loads the certificate, key, and client CAs from disk. If it
+// fails, whatever was loaded previously continues to be used.
+func (r *CertReloader) Load() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+
+	var clients *x509.CertPool
+	if r.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client CAs: %w", err)
+		}
+		clients = x509.NewCertPool()
+		if !clients.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %q", r.ClientCAFile)
+		}
+	}
+
+	mod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.cert = &cert
+	r.clients = clients
+	r.mod = mod
+	return nil
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.CertFile, r.KeyFile}
+	if r.ClientCAFile != "" {
+		files = append(files, r.ClientCAFile)
+	}
+	return files
+}
+
+func (r *CertReloader) modTimes() (map[string]time.Time, error) {
+	mod := make(map[string]time.Time, 3)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		mod[file] = info.ModTime()
+	}
+	return mod, nil
+}
+
+// changed returns true if any of the files have been modified since
+// they were last loaded.
+func (r *CertReloader) changed() bool {
+	mod, err := r.modTimes()
+	if err != nil {
+		// The files might be in the middle of being replaced, so just
+		// try again next time.
+		return false
+	}
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+	for file, t := range mod {
+		if !t.Equal(r.mod[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CertReloader) watchInterval() time.Duration {
+	if r.WatchInterval <= 0 {
+		return defaultTLSWatchInterval
+	}
+	return r.WatchInterval
+}
+
+// Watch reloads the files whenever they change or a reload signal,
+// such as SIGHUP, is received, until ctx is canceled.
+func (r *CertReloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(r.watchInterval())
+	defer ticker.Stop()
+
+	var sig chan os.Signal
+	if len(cli.ReloadSignals) > 0 {
+		sig = make(chan os.Signal, 1)
+		signal.Notify(sig, cli.ReloadSignals...)
+		defer signal.Stop(sig)
+	}
+
+	reload := func(reason string) {
+		err := r.Load()
+		if err != nil {
+			log.Errorf("reload TLS certificate after %v: %w", reason, err)
+			return
+		}
+		log.Infof("reloaded TLS certificate after %v", reason)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case s := <-sig:
+			reload(s.String())
+
+		case <-ticker.C:
+			if r.changed() {
+				reload("file change")
+			}
+		}
+	}
+}
+
+// TLSConfig returns a TLS config that uses the currently loaded
+// certificate and client CAs for every new connection.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.m.RLock()
+			defer r.m.RUnlock()
+
+			if r.cert == nil {
+				return nil, errors.New("no certificate loaded")
+			}
+
+			config := tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if r.clients != nil {
+				config.ClientCAs = r.clients
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return &config, nil
+		},
+	}
+}
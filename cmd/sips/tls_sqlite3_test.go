@@ -0,0 +1,98 @@
+//go:build sqlite3
+// +build sqlite3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+)
+
+// nopBackend is a Backend that has nothing pinned.
+type nopBackend struct {
+	Backend
+}
+
+func (nopBackend) Delegates(ctx context.Context, cid string) ([]string, error) {
+	return nil, nil
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ctx := viewer.SystemContext(context.Background())
+
+	entc, err := db.OpenAndMigrate(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_fk=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entc.Close()
+	entc.User.Create().SetName("alice").SaveX(ctx)
+
+	pki := newTestPKI(t)
+	serverCert, serverKey := pki.issue(t, "server", true)
+	certs := CertReloader{
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: pki.caFile,
+	}
+	err = certs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(sips.Handler(PinHandler{
+		Backend: nopBackend{},
+		DB:      entc,
+	}))
+	server.TLS = certs.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca)
+
+	tests := []struct {
+		name   string
+		user   string
+		status int
+	}{
+		{name: "User", user: "alice", status: http.StatusOK},
+		{name: "UnknownUser", user: "mallory", status: http.StatusUnauthorized},
+		{name: "NoCertOrToken", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := tls.Config{RootCAs: roots}
+			if test.user != "" {
+				certFile, keyFile := pki.issue(t, test.user, false)
+				cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.Certificates = []tls.Certificate{cert}
+			}
+			client := http.Client{
+				Transport: &http.Transport{TLSClientConfig: &config},
+			}
+			defer client.CloseIdleConnections()
+
+			rsp, err := client.Get(server.URL + "/pins")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != test.status {
+				t.Fatalf("got status %v, want %v", rsp.StatusCode, test.status)
+			}
+		})
+	}
+}
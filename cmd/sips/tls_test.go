@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a certificate authority that issues certificates into a
+// temporary directory.
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki := testPKI{
+		dir:    t.TempDir(),
+		ca:     ca,
+		caKey:  key,
+		serial: 1,
+	}
+	pki.caFile = filepath.Join(pki.dir, "ca.pem")
+	writePEM(t, pki.caFile, "CERTIFICATE", der)
+	return &pki
+}
+
+// issue issues a certificate for name, writing it and its key to
+// name.pem and name-key.pem. Server certificates are valid for
+// 127.0.0.1.
+func (pki *testPKI) issue(t *testing.T, name string, server bool) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki.serial++
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(pki.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, pki.ca, &key.PublicKey, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(pki.dir, name+".pem")
+	keyFile = filepath.Join(pki.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copyFile(t *testing.T, dst, src string) {
+	t.Helper()
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dst, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	pki := newTestPKI(t)
+	oldCert, oldKey := pki.issue(t, "old", true)
+	newCert, newKey := pki.issue(t, "new", true)
+
+	r := CertReloader{
+		CertFile:     filepath.Join(pki.dir, "server.pem"),
+		KeyFile:      filepath.Join(pki.dir, "server-key.pem"),
+		ClientCAFile: pki.caFile,
+	}
+	copyFile(t, r.CertFile, oldCert)
+	copyFile(t, r.KeyFile, oldKey)
+
+	err := r.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.clients == nil {
+		t.Fatal("client CAs not loaded")
+	}
+	commonName := func() string {
+		t.Helper()
+
+		config, err := r.TLSConfig().GetConfigForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if cn := commonName(); cn != "old" {
+		t.Fatalf("got certificate %q, want %q", cn, "old")
+	}
+	if r.changed() {
+		t.Fatal("files reported changed right after loading")
+	}
+
+	// Make sure that the modification times differ even on file
+	// systems with coarse timestamps.
+	copyFile(t, r.CertFile, newCert)
+	copyFile(t, r.KeyFile, newKey)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{r.CertFile, r.KeyFile} {
+		err := os.Chtimes(file, later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !r.changed() {
+		t.Fatal("replaced files not reported changed")
+	}
+
+	err = r.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := commonName(); cn != "new" {
+		t.Fatalf("got certificate %q after reload, want %q", cn, "new")
+	}
+
+	err = os.WriteFile(r.KeyFile, []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Load()
+	if err == nil {
+		t.Fatal("loaded a broken key")
+	}
+	if cn := commonName(); cn != "new" {
+		t.Fatalf("got certificate %q after failed reload, want %q", cn, "new")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/membership"
+	"github.com/DeedleFake/sips/ent/token"
+)
+
+func tokenInfo(tok *ent.Token) sips.TokenInfo {
+	scopes := db.TokenScopes(tok)
+	info := sips.TokenInfo{
+		Prefix:   tok.Prefix,
+		Label:    tok.Label,
+		Scopes:   make([]string, 0, len(scopes)),
+		Created:  tok.CreateTime,
+		Expires:  tok.Expires,
+		LastUsed: tok.LastUsed,
+		LastIP:   tok.LastIP,
+	}
+	for _, s := range scopes {
+		info.Scopes = append(info.Scopes, string(s))
+	}
+	return info
+}
+
+// checkScopes returns a Forbidden error if any of want isn't allowed
+// by have. A client may only create and revoke tokens whose scopes are
+// all allowed by its own so that, for example, a read-only token can't
+// be used to get one that can delete pins.
+func checkScopes(have, want []db.Scope) error {
+	for _, s := range want {
+		if !db.ScopesAllow(have, s) {
+			return WithReason(Forbidden(fmt.Errorf("client does not have %q scope", s)), "INSUFFICIENT_SCOPE")
+		}
+	}
+	return nil
+}
+
+// checkExpires returns when a token that is requested to expire at
+// want should expire if it is created by a client whose own
+// credentials expire at have. A client may not create a token that
+// outlives it, so want is limited to have, and a Forbidden error is
+// returned if want is nil but have isn't.
+func checkExpires(have, want *time.Time) (*time.Time, error) {
+	if have == nil {
+		return want, nil
+	}
+	if want == nil {
+		return nil, Forbidden(fmt.Errorf("client expires at %v, so new tokens must expire as well", have.Format(time.RFC3339)))
+	}
+	if want.After(*have) {
+		return have, nil
+	}
+	return want, nil
+}
+
+// checkOrgOwner returns a Forbidden error if o is an organization that
+// its user doesn't own. Only owners may manage an organization's
+// tokens, as they can act on behalf of every member.
+func checkOrgOwner(ctx context.Context, tx *ent.Tx, o db.Owner) error {
+	if o.Org == nil {
+		return nil
+	}
+
+	m, err := db.Membership(ctx, tx, o.User.ID, o.Org.ID)
+	if err != nil {
+		return fmt.Errorf("find membership in %v: %w", o, err)
+	}
+	if m.Role != membership.RoleOwner {
+		return Forbidden(fmt.Errorf("user %q is not an owner of %v", o.User.Name, o))
+	}
+	return nil
+}
+
+func (h PinHandler) Tokens(ctx context.Context) ([]sips.TokenInfo, error) {
+	ctx, o, err := h.auth(ctx, db.ScopeRead)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	tx, err := h.DB.Tx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Organization tokens can act on behalf of any member, so only
+	// owners may see them, as with creating and revoking them.
+	o, err = o.In(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	err = checkOrgOwner(ctx, tx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	toks, err := o.QueryTokens().
+		Order(ent.Asc(token.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query tokens: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	infos := make([]sips.TokenInfo, 0, len(toks))
+	for _, tok := range toks {
+		infos = append(infos, tokenInfo(tok))
+	}
+	return infos, nil
+}
+
+func (h PinHandler) AddToken(ctx context.Context, nt sips.NewToken) (sips.CreatedToken, error) {
+	scopes := make([]db.Scope, 0, len(nt.Scopes))
+	for _, str := range nt.Scopes {
+		scope, err := db.ParseScope(str)
+		if err != nil {
+			return sips.CreatedToken{}, BadRequest(err)
+		}
+		scopes = append(scopes, scope)
+	}
+	if (nt.Expires != nil) && !nt.Expires.After(time.Now()) {
+		return sips.CreatedToken{}, BadRequest(fmt.Errorf("expiration %v is in the past", nt.Expires.Format(time.RFC3339)))
+	}
+
+	ctx, o, g, err := h.authGrant(ctx, db.ScopeRead)
+	if err != nil {
+		return sips.CreatedToken{}, fmt.Errorf("authenticate: %w", err)
+	}
+
+	tx, err := h.DB.Tx(ctx)
+	if err != nil {
+		return sips.CreatedToken{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err = o.Lock(ctx, tx)
+	if err != nil {
+		return sips.CreatedToken{}, err
+	}
+	err = checkOrgOwner(ctx, tx, o)
+	if err != nil {
+		return sips.CreatedToken{}, err
+	}
+
+	// Tokens created without any scopes get the same ones as the token
+	// that created them.
+	if len(scopes) == 0 {
+		scopes = g.Scopes
+	}
+	err = checkScopes(g.Scopes, scopes)
+	if err != nil {
+		return sips.CreatedToken{}, err
+	}
+	expires, err := checkExpires(g.Expires, nt.Expires)
+	if err != nil {
+		return sips.CreatedToken{}, err
+	}
+
+	strs := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		strs = append(strs, string(s))
+	}
+
+	tokstr, err := db.NewToken()
+	if err != nil {
+		return sips.CreatedToken{}, err
+	}
+
+	create := tx.Token.Create().
+		SetUser(o.User).
+		SetHash(db.HashToken(h.TokenKey, tokstr)).
+		SetPrefix(db.TokenPrefix(tokstr)).
+		SetLabel(nt.Label).
+		SetScopes(strs).
+		SetNillableExpires(expires)
+	if o.Org != nil {
+		create.SetOrganization(o.Org)
+	}
+	tok, err := create.Save(ctx)
+	if err != nil {
+		return sips.CreatedToken{}, fmt.Errorf("create token: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return sips.CreatedToken{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return sips.CreatedToken{
+		Token:     tokstr,
+		TokenInfo: tokenInfo(tok),
+	}, nil
+}
+
+func (h PinHandler) RevokeToken(ctx context.Context, prefix string) error {
+	ctx, o, g, err := h.authGrant(ctx, db.ScopeRead)
+	if err != nil {
+		return fmt.Errorf("authenticate: %w", err)
+	}
+
+	tx, err := h.DB.Tx(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err = o.Lock(ctx, tx)
+	if err != nil {
+		return err
+	}
+	err = checkOrgOwner(ctx, tx, o)
+	if err != nil {
+		return err
+	}
+
+	toks, err := o.QueryTokens().
+		Where(token.Prefix(prefix)).
+		All(ctx)
+	if err != nil {
+		return fmt.Errorf("query token %q: %w", prefix, err)
+	}
+	if len(toks) == 0 {
+		return NotFound(fmt.Errorf("token %q not found", prefix))
+	}
+
+	ids := make([]int, 0, len(toks))
+	for _, tok := range toks {
+		err := checkScopes(g.Scopes, db.TokenScopes(tok))
+		if err != nil {
+			return fmt.Errorf("revoke token %q: %w", prefix, err)
+		}
+		ids = append(ids, tok.ID)
+	}
+
+	_, err = tx.Token.Delete().
+		Where(token.IDIn(ids...)).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete token %q: %w", prefix, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
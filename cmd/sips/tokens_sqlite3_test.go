@@ -0,0 +1,65 @@
+//go:build sqlite3
+// +build sqlite3
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent/membership"
+)
+
+func TestTokensOrgOwner(t *testing.T) {
+	ctx := viewer.SystemContext(context.Background())
+
+	entc, err := db.OpenAndMigrate(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_fk=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entc.Close()
+	team := entc.Organization.Create().SetName("team").SaveX(ctx)
+	for _, m := range []struct {
+		name string
+		role membership.Role
+	}{
+		{"alice", membership.RoleOwner},
+		{"bob", membership.RoleReadonly},
+	} {
+		u := entc.User.Create().SetName(m.name).SaveX(ctx)
+		entc.Membership.Create().SetUser(u).SetOrganization(team).SetRole(m.role).SaveX(ctx)
+		entc.Token.Create().
+			SetUser(u).
+			SetOrganization(team).
+			SetHash(db.HashToken(nil, m.name)).
+			SetPrefix(m.name).
+			SaveX(ctx)
+	}
+
+	h := sips.Handler(PinHandler{
+		Backend: nopBackend{},
+		DB:      entc,
+	})
+
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/tokens", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%v: got status %v, want %v", test.token, rec.Code, test.status)
+		}
+	}
+}
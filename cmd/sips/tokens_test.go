@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckExpires(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(time.Hour)
+	later := now.Add(2 * time.Hour)
+
+	tests := []struct {
+		name   string
+		have   *time.Time
+		want   *time.Time
+		expect *time.Time
+		status int
+	}{
+		{name: "NeverNever", have: nil, want: nil, expect: nil},
+		{name: "NeverExpires", have: nil, want: &later, expect: &later},
+		{name: "Earlier", have: &later, want: &earlier, expect: &earlier},
+		{name: "Later", have: &earlier, want: &later, expect: &earlier},
+		{name: "Never", have: &earlier, want: nil, status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := checkExpires(test.have, test.want)
+			if test.status != 0 {
+				serr, ok := err.(statusError)
+				if !ok || (serr.StatusCode != test.status) {
+					t.Fatalf("got error %v, want status %v", err, test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (got == nil) != (test.expect == nil) {
+				t.Fatalf("got %v, want %v", got, test.expect)
+			}
+			if (got != nil) && !got.Equal(*test.expect) {
+				t.Errorf("got %v, want %v", *got, *test.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/delivery"
+	"github.com/DeedleFake/sips/internal/log"
+	"github.com/DeedleFake/sips/internal/metrics"
+)
+
+var webhookDeliveries = metrics.NewCounter(
+	"sips_webhook_deliveries_total",
+	"Number of webhook delivery attempts, by outcome (\"delivered\", \"retry\", or \"failed\").",
+	"outcome",
+)
+
+const (
+	defaultWebhookWorkers = 4
+
+	// maxWebhookResponse is the amount of a webhook's response body
+	// that is read before the connection is closed. Only enough is
+	// read to allow the connection to be reused.
+	maxWebhookResponse = 64 << 10
+)
+
+// Webhooks sends the webhook deliveries queued in the database, such
+// as by db.QueueEvent.
+//
+// Each delivery is a POST of the event's JSON payload, signed with the
+// webhook's secret along with the time that it was sent. See
+// db.SignPayload for details. Deliveries that fail, either due to an
+// error or a non-2xx response, are retried with exponential backoff
+// until MaxRetries is exceeded, at which point they are marked as
+// failed.
+type Webhooks struct {
+	running uint32
+	cancel  context.CancelFunc
+	done    chan struct{}
+	wake    chan struct{}
+
+	DB     *ent.Client
+	Client *http.Client
+
+	// MaxRetries is the number of times that a failed delivery is
+	// retried.
+	MaxRetries int
+
+	// Backoff is the delay before the first retry of a failed
+	// delivery. It is doubled for every subsequent retry, up to
+	// MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// PollInterval is how often the database is checked for deliveries
+	// that have become due. If it is zero, a default is used.
+	PollInterval time.Duration
+
+	// Workers is the maximum number of deliveries that may be sent at
+	// once. If it is zero, a default is used.
+	Workers int
+}
+
+func (w *Webhooks) setRunning() bool {
+	return atomic.CompareAndSwapUint32(&w.running, 0, 1)
+}
+
+func (w *Webhooks) unsetRunning() {
+	atomic.StoreUint32(&w.running, 0)
+}
+
+// Start starts sending deliveries. No other methods should be called
+// before this one returns, and calls to this method while w is
+// running will panic.
+func (w *Webhooks) Start(ctx context.Context) {
+	if !w.setRunning() {
+		panic("already running")
+	}
+
+	ctx = viewer.SystemContext(ctx)
+
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.done = make(chan struct{})
+	w.wake = make(chan struct{}, 1)
+
+	go w.run(ctx)
+}
+
+// Stop stops sending deliveries. It does not return until all
+// deliveries that were in progress have been interrupted. Interrupted
+// deliveries will be sent again the next time that w is started.
+func (w *Webhooks) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+// Notify tells w that new deliveries have been committed to the
+// database so that it can send them without waiting for the next
+// poll. It is safe to call on a nil *Webhooks, in which case it does
+// nothing.
+func (w *Webhooks) Notify() {
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Webhooks) pollInterval() time.Duration {
+	if w.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return w.PollInterval
+}
+
+func (w *Webhooks) workers() int {
+	if w.Workers <= 0 {
+		return defaultWebhookWorkers
+	}
+	return w.Workers
+}
+
+func (w *Webhooks) client() *http.Client {
+	if w.Client == nil {
+		return http.DefaultClient
+	}
+	return w.Client
+}
+
+// dueDeliveries returns up to limit pending deliveries that are ready
+// to be sent, excluding those in the running set.
+func (w *Webhooks) dueDeliveries(ctx context.Context, running map[int]struct{}, limit int) ([]*ent.Delivery, error) {
+	query := w.DB.Delivery.Query().
+		Where(
+			delivery.StatusEQ(delivery.StatusPending),
+			delivery.NextAttemptLTE(time.Now()),
+		)
+	if len(running) > 0 {
+		ids := make([]int, 0, len(running))
+		for id := range running {
+			ids = append(ids, id)
+		}
+		query = query.Where(delivery.IDNotIn(ids...))
+	}
+
+	return query.
+		WithWebhook().
+		Order(ent.Asc(delivery.FieldNextAttempt), ent.Asc(delivery.FieldID)).
+		Limit(limit).
+		All(ctx)
+}
+
+func (w *Webhooks) run(ctx context.Context) {
+	defer close(w.done)
+	defer w.unsetRunning()
+
+	running := make(map[int]struct{})
+	deliverydone := make(chan int)
+
+	poll := func() {
+		limit := w.workers() - len(running)
+		if limit <= 0 {
+			return
+		}
+
+		deliveries, err := w.dueDeliveries(ctx, running, limit)
+		if err != nil {
+			log.Errorf("query due webhook deliveries: %w", err)
+			return
+		}
+
+		for _, d := range deliveries {
+			d := d
+			sub := log.With(
+				ctx,
+				"delivery", d.ID,
+				"webhook", d.Edges.Webhook.ID,
+				"event", d.Event,
+			)
+			running[d.ID] = struct{}{}
+			go func() {
+				w.deliver(sub, d)
+				deliverydone <- d.ID
+			}()
+		}
+	}
+
+	ticker := time.NewTicker(w.pollInterval())
+	defer ticker.Stop()
+	tick := ticker.C
+	wake := w.wake
+
+	poll()
+
+	var stopping bool
+	ctxdone := ctx.Done()
+	for {
+		select {
+		case <-ctxdone:
+			ctxdone = nil
+			tick = nil
+			wake = nil
+
+			stopping = true
+			if len(running) == 0 {
+				return
+			}
+
+		case id := <-deliverydone:
+			delete(running, id)
+			if stopping {
+				if len(running) == 0 {
+					return
+				}
+				continue
+			}
+			poll()
+
+		case <-tick:
+			poll()
+
+		case <-wake:
+			poll()
+		}
+	}
+}
+
+// deliver sends d and then records the result in the database.
+func (w *Webhooks) deliver(ctx context.Context, d *ent.Delivery) {
+	code, err := w.send(ctx, d)
+	if ctx.Err() != nil {
+		// Stopping, so the delivery will be sent again next time.
+		return
+	}
+
+	attempt := d.Attempts + 1
+	update := w.DB.Delivery.UpdateOne(d).
+		SetAttempts(attempt)
+	if code != 0 {
+		update = update.SetResponseCode(code)
+	}
+
+	switch {
+	case err == nil:
+		update = update.
+			SetStatus(delivery.StatusDelivered).
+			SetDelivered(time.Now()).
+			ClearLastError()
+		webhookDeliveries.With("delivered").Inc()
+		log.Ctx(ctx).Debugf("delivered to %v", d.Edges.Webhook.URL)
+
+	case attempt <= w.MaxRetries:
+		next := time.Now().Add(backoff(w.Backoff, w.MaxBackoff, attempt))
+		update = update.
+			SetNextAttempt(next).
+			SetLastError(err.Error())
+		webhookDeliveries.With("retry").Inc()
+		log.Ctx(ctx).Infof("retrying delivery to %v at %v (attempt %v of %v): %v", d.Edges.Webhook.URL, next.Format(time.RFC3339), attempt, w.MaxRetries, err)
+
+	default:
+		update = update.
+			SetStatus(delivery.StatusFailed).
+			SetLastError(err.Error())
+		webhookDeliveries.With("failed").Inc()
+		log.Ctx(ctx).Errorf("delivery to %v failed: %w", d.Edges.Webhook.URL, err)
+	}
+
+	err = update.Exec(ctx)
+	if err != nil {
+		log.Ctx(ctx).Errorf("update delivery %v: %w", d.ID, err)
+	}
+}
+
+// send POSTs d to its webhook. It returns the status code of the
+// response, if there was one, and an error if the delivery was not
+// successful.
+func (w *Webhooks) send(ctx context.Context, d *ent.Delivery) (int, error) {
+	hook := d.Edges.Webhook
+	payload := []byte(d.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sips")
+	req.Header.Set("X-SIPS-Event", d.Event)
+	req.Header.Set("X-SIPS-Delivery", strconv.FormatInt(int64(d.ID), 10))
+
+	now := time.Now()
+	req.Header.Set("X-SIPS-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-SIPS-Signature", "sha256="+db.SignPayload(hook.Secret, now, payload))
+
+	rsp, err := w.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(rsp.Body, maxWebhookResponse))
+
+	if (rsp.StatusCode < 200) || (rsp.StatusCode >= 300) {
+		return rsp.StatusCode, fmt.Errorf("unexpected status: %v", rsp.Status)
+	}
+	return rsp.StatusCode, nil
+}
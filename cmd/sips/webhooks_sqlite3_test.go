@@ -0,0 +1,196 @@
+//go:build sqlite3
+// +build sqlite3
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/delivery"
+)
+
+const testWebhookSecret = "secret"
+
+// webhookReceiver records the deliveries that it receives, responding
+// to each with status.
+type webhookReceiver struct {
+	t      *testing.T
+	status int
+
+	m        sync.Mutex
+	received int
+}
+
+func (r *webhookReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Errorf("read delivery: %v", err)
+	}
+
+	if event := req.Header.Get("X-SIPS-Event"); event != string(db.EventQueued) {
+		r.t.Errorf("got event %q, want %q", event, db.EventQueued)
+	}
+
+	ts := req.Header.Get("X-SIPS-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		r.t.Errorf("parse timestamp %q: %v", ts, err)
+	}
+	if age := time.Since(time.Unix(sec, 0)); (age < -time.Minute) || (age > time.Minute) {
+		r.t.Errorf("timestamp %v is %v old", ts, age)
+	}
+
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := req.Header.Get("X-SIPS-Signature"); sig != want {
+		r.t.Errorf("got signature %q, want %q", sig, want)
+	}
+
+	r.m.Lock()
+	r.received++
+	r.m.Unlock()
+
+	rw.WriteHeader(r.status)
+}
+
+func (r *webhookReceiver) count() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.received
+}
+
+// queueTestDelivery queues a delivery of an event to a new webhook
+// that points at url.
+func queueTestDelivery(t *testing.T, entc *ent.Client, url string) *ent.Delivery {
+	ctx := viewer.SystemContext(context.Background())
+
+	u := entc.User.Create().SetName("alice").SaveX(ctx)
+	entc.Webhook.Create().
+		SetUser(u).
+		SetURL(url).
+		SetSecret(testWebhookSecret).
+		SaveX(ctx)
+	p := entc.Pin.Create().
+		SetUser(u).
+		SetName("test").
+		SetCID("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG").
+		SaveX(ctx)
+
+	tx, err := entc.Tx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = db.QueueEvent(ctx, tx, p, db.EventQueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entc.Delivery.Query().OnlyX(ctx)
+}
+
+// waitDelivery waits for d to stop being pending and returns it.
+func waitDelivery(t *testing.T, entc *ent.Client, d *ent.Delivery) *ent.Delivery {
+	ctx := viewer.SystemContext(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		d = entc.Delivery.GetX(ctx, d.ID)
+		if d.Status != delivery.StatusPending {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("delivery %v still pending after %v attempts", d.ID, d.Attempts)
+	return nil
+}
+
+func TestWebhooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		result   delivery.Status
+	}{
+		{name: "Delivered", status: http.StatusNoContent, attempts: 1, result: delivery.StatusDelivered},
+		{name: "Failed", status: http.StatusInternalServerError, attempts: 3, result: delivery.StatusFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := viewer.SystemContext(context.Background())
+
+			entc, err := db.OpenAndMigrate(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_fk=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer entc.Close()
+
+			receiver := webhookReceiver{t: t, status: test.status}
+			server := httptest.NewServer(&receiver)
+			defer server.Close()
+
+			d := queueTestDelivery(t, entc, server.URL)
+
+			webhooks := Webhooks{
+				DB:           entc,
+				MaxRetries:   test.attempts - 1,
+				Backoff:      time.Millisecond,
+				PollInterval: 10 * time.Millisecond,
+			}
+			webhooks.Start(ctx)
+			defer webhooks.Stop()
+
+			d = waitDelivery(t, entc, d)
+			if d.Status != test.result {
+				t.Errorf("got status %v, want %v", d.Status, test.result)
+			}
+			if d.Attempts != test.attempts {
+				t.Errorf("got %v attempts, want %v", d.Attempts, test.attempts)
+			}
+			if got := receiver.count(); got != test.attempts {
+				t.Errorf("receiver got %v deliveries, want %v", got, test.attempts)
+			}
+			if (d.ResponseCode == nil) || (*d.ResponseCode != test.status) {
+				t.Errorf("got response code %v, want %v", d.ResponseCode, test.status)
+			}
+
+			switch test.result {
+			case delivery.StatusDelivered:
+				if d.Delivered == nil {
+					t.Error("delivered delivery has no delivery time")
+				}
+				if d.LastError != "" {
+					t.Errorf("delivered delivery has error %q", d.LastError)
+				}
+
+			case delivery.StatusFailed:
+				if d.Delivered != nil {
+					t.Errorf("failed delivery was delivered at %v", d.Delivered)
+				}
+				if d.LastError == "" {
+					t.Error("failed delivery has no error")
+				}
+			}
+		})
+	}
+}
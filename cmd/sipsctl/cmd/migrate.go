@@ -42,8 +42,13 @@ func init() {
 			}
 			defer entc.Close()
 
+			key, err := loadTokenKey(ctx, entc)
+			if err != nil {
+				return err
+			}
+
 			log.Infof("migrating from BoltDB database to ent database")
-			err = db.MigrateFromBolt(ctx, entc, bolt)
+			err = db.MigrateFromBolt(ctx, entc, bolt, key)
 			if err != nil {
 				return fmt.Errorf("migrate: %w", err)
 			}
@@ -55,7 +60,39 @@ func init() {
 	fromboltCmd.Flags().StringVar(&fromboltArgs.BoltDBPath, "boltdb", "", "path to old BoltDB database")
 	fromboltCmd.MarkFlagRequired("boltdb")
 
+	hashtokensCmd := &cobra.Command{
+		Use:   "hashtokens",
+		Short: "replace plaintext tokens with their hashes",
+		Long: `Replace tokens that are stored in plaintext, from before tokens were
+hashed, with their hashes. The server does this automatically upon
+starting. The token key must be the same as the one used by the
+server.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			if err != nil {
+				return fmt.Errorf("open database: %w", err)
+			}
+			defer entc.Close()
+
+			key, err := loadTokenKey(ctx, entc)
+			if err != nil {
+				return err
+			}
+
+			n, err := db.HashTokens(ctx, entc, key)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Hashed %v tokens\n", n)
+			return nil
+		},
+	}
+
 	migrateCmd.AddCommand(
 		fromboltCmd,
+		hashtokensCmd,
 	)
 }
@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DeedleFake/sips/internal/adminapi"
+	"github.com/spf13/cobra"
+)
+
+var orgsCmd = &cobra.Command{
+	Use:   "orgs <subcommand>",
+	Short: "administrate organizations",
+	Long: `Adds, removes, and manages the members of organizations, which share
+a set of pins between their members.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+func init() {
+	addCmd := &cobra.Command{
+		Use:         "add <name>",
+		Short:       "add a new organization",
+		Long:        `Adds a new organization without any members.`,
+		Args:        cobra.ExactArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			o, err := admin.AddOrg(ctx, args[0])
+			if err != nil {
+				return fmt.Errorf("create organization: %w", err)
+			}
+
+			fmt.Printf("Added organization %q\n", o.Name)
+			fmt.Printf("  ID: %d\n", o.ID)
+
+			return nil
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:         "list",
+		Short:       "list all existing organizations",
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			orgs, err := admin.Orgs(ctx)
+			if err != nil {
+				return fmt.Errorf("query organizations: %w", err)
+			}
+
+			for _, o := range orgs {
+				fmt.Printf("%v: %q\n", o.ID, o.Name)
+			}
+
+			return nil
+		},
+	}
+
+	rmCmd := &cobra.Command{
+		Use:   "rm <names...>",
+		Short: "remove organizations from the database",
+		Long: `Removes organizations along with their memberships and tokens.
+Organizations that still have pins can't be removed.`,
+		Args:        cobra.MinimumNArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			var n int
+			for _, name := range args {
+				err := admin.RemoveOrg(ctx, name)
+				if err != nil {
+					if adminapi.IsNotFound(err) {
+						continue
+					}
+					return fmt.Errorf("delete organization %q: %w", name, err)
+				}
+				n++
+			}
+
+			fmt.Printf("Deleted %d organizations\n", n)
+
+			return nil
+		},
+	}
+
+	var quotaFlags struct {
+		Pins  int
+		Bytes int64
+	}
+	quotaCmd := &cobra.Command{
+		Use:   "quota <name>",
+		Short: "show or set an organization's quotas",
+		Long: `Shows an organization's quotas and current usage. If --pins or
+--bytes are given, the corresponding quota is set first. A negative
+value removes the quota.`,
+		Args:        cobra.ExactArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			var quota adminapi.Quota
+			if cmd.Flags().Changed("pins") {
+				quota.MaxPins = &quotaFlags.Pins
+			}
+			if cmd.Flags().Changed("bytes") {
+				quota.MaxBytes = &quotaFlags.Bytes
+			}
+
+			var o adminapi.Org
+			if (quota.MaxPins != nil) || (quota.MaxBytes != nil) {
+				o, err = admin.SetOrgQuota(ctx, args[0], quota)
+			} else {
+				o, err = admin.Org(ctx, args[0])
+			}
+			if err != nil {
+				return fmt.Errorf("update organization: %w", err)
+			}
+
+			fmt.Printf("Organization %q\n", o.Name)
+			if o.MaxPins != nil {
+				fmt.Printf("  Pins: %v of %v\n", o.Pins, *o.MaxPins)
+			} else {
+				fmt.Printf("  Pins: %v (no limit)\n", o.Pins)
+			}
+			if o.MaxBytes != nil {
+				fmt.Printf("  Bytes: %v of %v\n", o.Bytes, *o.MaxBytes)
+			} else {
+				fmt.Printf("  Bytes: %v (no limit)\n", o.Bytes)
+			}
+
+			return nil
+		},
+	}
+	quotaCmd.Flags().IntVar(&quotaFlags.Pins, "pins", 0, "maximum number of pins")
+	quotaCmd.Flags().Int64Var(&quotaFlags.Bytes, "bytes", 0, "maximum total size of pins in bytes, which is a soft limit, as pins are only rejected once it has been reached")
+
+	membersCmd := &cobra.Command{
+		Use:         "members <name>",
+		Short:       "list the members of an organization",
+		Args:        cobra.ExactArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			members, err := admin.Members(ctx, args[0])
+			if err != nil {
+				return fmt.Errorf("query members: %w", err)
+			}
+
+			for _, m := range members {
+				fmt.Printf("%q: %v since %v\n", m.User, m.Role, m.Since.Format(time.RFC3339))
+			}
+
+			return nil
+		},
+	}
+
+	var addmemberFlags struct {
+		Role string
+	}
+	addmemberCmd := &cobra.Command{
+		Use:   "addmember [--role <role>] <name> <username>",
+		Short: "add a user to an organization",
+		Long: `Adds a user to an organization, or changes their role if they are
+already a member. Owners and members may add and remove the
+organization's pins, while read-only members may only list them. Only
+owners may manage the organization's tokens.`,
+		Args:        cobra.ExactArgs(2),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			m, err := admin.SetMember(ctx, args[0], args[1], addmemberFlags.Role)
+			if err != nil {
+				return fmt.Errorf("add member: %w", err)
+			}
+
+			fmt.Printf("User %q is now in %q as %v\n", m.User, args[0], m.Role)
+
+			return nil
+		},
+	}
+	addmemberCmd.Flags().StringVar(&addmemberFlags.Role, "role", "member", "role of the user: owner, member, or readonly")
+
+	rmmemberCmd := &cobra.Command{
+		Use:         "rmmember <name> <usernames...>",
+		Short:       "remove users from an organization",
+		Args:        cobra.MinimumNArgs(2),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			var n int
+			for _, name := range args[1:] {
+				err := admin.RemoveMember(ctx, args[0], name)
+				if err != nil {
+					if adminapi.IsNotFound(err) {
+						continue
+					}
+					return fmt.Errorf("remove member %q: %w", name, err)
+				}
+				n++
+			}
+
+			fmt.Printf("Removed %d members\n", n)
+
+			return nil
+		},
+	}
+
+	orgsCmd.AddCommand(
+		addCmd,
+		listCmd,
+		rmCmd,
+		quotaCmd,
+		membersCmd,
+		addmemberCmd,
+		rmmemberCmd,
+	)
+}
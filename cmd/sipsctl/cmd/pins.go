@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"strconv"
 
 	"github.com/DeedleFake/sips"
 	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/ent/job"
+	"github.com/DeedleFake/sips/ent/organization"
 	"github.com/DeedleFake/sips/ent/pin"
 	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/internal/adminapi"
+	"github.com/DeedleFake/sips/internal/clusterapi"
+	"github.com/DeedleFake/sips/internal/config"
+	"github.com/DeedleFake/sips/internal/ipfsapi"
 	"github.com/spf13/cobra"
 )
 
@@ -23,10 +29,11 @@ var pinsCmd = &cobra.Command{
 func init() {
 	var addFlags struct {
 		User string
+		Org  string
 		Name string
 	}
 	addCmd := &cobra.Command{
-		Use:   "add --user <username> --name <name> <CID>",
+		Use:   "add --user <username> [--org <org>] --name <name> <CID>",
 		Short: "add a pin to just the database",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -51,11 +58,20 @@ func init() {
 				return fmt.Errorf("find user: %w", err)
 			}
 
-			pin, err := tx.Pin.Create().
+			create := tx.Pin.Create().
 				SetUser(u).
 				SetName(addFlags.Name).
-				SetCID(args[0]).
-				Save(ctx)
+				SetCID(args[0])
+			if addFlags.Org != "" {
+				org, err := tx.Organization.Query().
+					Where(organization.Name(addFlags.Org)).
+					Only(ctx)
+				if err != nil {
+					return fmt.Errorf("find organization: %w", err)
+				}
+				create.SetOrganization(org)
+			}
+			pin, err := create.Save(ctx)
 			if err != nil {
 				return fmt.Errorf("create pin: %w", err)
 			}
@@ -72,28 +88,33 @@ func init() {
 	}
 	addCmd.Flags().StringVar(&addFlags.User, "user", "", "pin owner")
 	addCmd.MarkFlagRequired("user")
+	addCmd.Flags().StringVar(&addFlags.Org, "org", "", "organization to add the pin to instead of the user's own pins")
 	addCmd.Flags().StringVar(&addFlags.Name, "name", "", "name to identify pin with in the database")
 	addCmd.MarkFlagRequired("name")
 
+	var listFlags struct {
+		User   string
+		Org    string
+		Status string
+	}
 	listCmd := &cobra.Command{
-		Use:   "list",
-		Short: "list all pins in the database",
+		Use:         "list",
+		Short:       "list all pins in the database",
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("open database: %w", err)
+				return err
 			}
-			defer entc.Close()
+			defer done()
 
-			tx, err := entc.Tx(ctx)
-			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
-			}
-			defer tx.Rollback()
-
-			pins, err := tx.Pin.Query().All(ctx)
+			pins, err := admin.Pins(ctx, adminapi.PinQuery{
+				User:   listFlags.User,
+				Org:    listFlags.Org,
+				Status: sips.RequestStatus(listFlags.Status),
+			})
 			if err != nil {
 				return fmt.Errorf("query pins: %w", err)
 			}
@@ -105,14 +126,22 @@ func init() {
 			return nil
 		},
 	}
+	listCmd.Flags().StringVar(&listFlags.User, "user", "", "only list pins belonging to this user")
+	listCmd.Flags().StringVar(&listFlags.Org, "org", "", "only list pins belonging to this organization")
+	listCmd.Flags().StringVar(&listFlags.Status, "status", "", "only list pins with this status")
 
 	var rmFlags struct {
-		Force bool
+		Force  bool
+		DBOnly bool
 	}
 	rmCmd := &cobra.Command{
 		Use:   "rm <names...>",
-		Short: "remove pins from the database",
-		Args:  cobra.MinimumNArgs(1),
+		Short: "remove pins",
+		Long: `Removes pins. By default, the pins are queued to be unpinned by the
+server, which will leave their CIDs pinned if other pins still need
+them. With --dbonly, they are instead removed from just the database
+immediately.`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
@@ -129,11 +158,37 @@ func init() {
 			defer tx.Rollback()
 
 			for _, name := range args {
-				_, err := tx.Pin.Delete().
-					Where(pin.Name(name)).
-					Exec(ctx)
+				if rmFlags.DBOnly {
+					_, err := tx.Job.Delete().
+						Where(job.HasPinWith(pin.Name(name))).
+						Exec(ctx)
+					if err != nil {
+						return fmt.Errorf("delete jobs for pin %q: %w", name, err)
+					}
+
+					_, err = tx.Pin.Delete().
+						Where(pin.Name(name)).
+						Exec(ctx)
+					if err != nil {
+						return fmt.Errorf("delete pin %q: %w", name, err)
+					}
+					continue
+				}
+
+				pins, err := tx.Pin.Query().
+					Where(
+						pin.Name(name),
+						db.NotDeleted(),
+					).
+					All(ctx)
 				if err != nil {
-					return fmt.Errorf("delete pin %q: %w", name, err)
+					return fmt.Errorf("query pin %q: %w", name, err)
+				}
+				for _, p := range pins {
+					err := db.QueueDelete(ctx, tx, p)
+					if err != nil {
+						return fmt.Errorf("queue delete %v: %w", p.ID, err)
+					}
 				}
 			}
 
@@ -146,14 +201,88 @@ func init() {
 		},
 	}
 	rmCmd.Flags().BoolVar(&rmFlags.Force, "force", false, "allow deletion of multiple matching pins per name")
+	rmCmd.Flags().BoolVar(&rmFlags.DBOnly, "dbonly", false, "remove pins from just the database without unpinning them")
 
 	var setstatusFlags struct {
 		Status string
 	}
 	setstatusCmd := &cobra.Command{
-		Use:   "setstatus <pin IDs...>",
-		Short: "manually sets the status of pins",
-		Args:  cobra.MinimumNArgs(1),
+		Use:         "setstatus <pin IDs...>",
+		Short:       "manually sets the status of pins",
+		Args:        cobra.MinimumNArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			ids, err := parseIDs(args)
+			if err != nil {
+				return err
+			}
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			_, err = admin.SetStatus(ctx, sips.RequestStatus(setstatusFlags.Status), ids...)
+			if err != nil {
+				return fmt.Errorf("update pins: %w", err)
+			}
+
+			return nil
+		},
+	}
+	setstatusCmd.Flags().StringVar(&setstatusFlags.Status, "status", string(sips.Queued), "status to reset pins to")
+
+	requeueCmd := &cobra.Command{
+		Use:   "requeue <pin IDs...>",
+		Short: "queue pins to be pinned again",
+		Long: `Queues pins to be pinned again by the server, such as after they
+failed. Pins that are already waiting to be pinned or unpinned are left
+alone.`,
+		Args:        cobra.MinimumNArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			ids, err := parseIDs(args)
+			if err != nil {
+				return err
+			}
+
+			admin, done, err := openAdmin(ctx)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			n, err := admin.Requeue(ctx, ids...)
+			if err != nil {
+				return fmt.Errorf("requeue pins: %w", err)
+			}
+
+			fmt.Printf("Requeued %v pins\n", n)
+
+			return nil
+		},
+	}
+
+	var reconcileFlags struct {
+		Backend string
+		API     string
+		Cluster string
+		DryRun  bool
+		Unpin   bool
+	}
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "compare the database with the backend's pins",
+		Long: `Compares the pins in the database that are marked as pinned with the
+recursive pins on the backend, which is either an IPFS node or an IPFS
+Cluster, as with the server. Pins that are missing from the backend are
+queued to be pinned again by the server. Pins on the backend that are
+not in the database are listed and, if --unpin is given, removed.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
@@ -163,41 +292,131 @@ func init() {
 			}
 			defer entc.Close()
 
-			tx, err := entc.Tx(ctx)
-			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
+			if !cmd.Flags().Changed("backend") {
+				reconcileFlags.Backend = rootConfig.Backend
+			}
+			if !cmd.Flags().Changed("api") {
+				reconcileFlags.API = rootConfig.API
+			}
+			if !cmd.Flags().Changed("cluster") {
+				reconcileFlags.Cluster = rootConfig.Cluster
 			}
-			defer tx.Rollback()
 
-			for _, strid := range args {
-				id, err := strconv.ParseInt(strid, 10, 0)
-				if err != nil {
-					return fmt.Errorf("parse pin ID %q: %w", strid, err)
-				}
+			var backend pinset
+			switch reconcileFlags.Backend {
+			case "kubo":
+				backend = kuboPinset{ipfsapi.NewClient(ipfsapi.WithBaseURL(reconcileFlags.API))}
+			case "cluster":
+				backend = clusterPinset{clusterapi.NewClient(clusterapi.WithBaseURL(reconcileFlags.Cluster))}
+			default:
+				return fmt.Errorf("unknown backend %q", reconcileFlags.Backend)
+			}
 
-				err = tx.Pin.Update().
-					Where(pin.ID(int(id))).
-					SetStatus(sips.RequestStatus(setstatusFlags.Status)).
-					Exec(ctx)
-				if err != nil {
-					return fmt.Errorf("update pin %v: %w", id, err)
-				}
+			pinned, err := backend.Pins(ctx)
+			if err != nil {
+				return fmt.Errorf("list %v pins: %w", reconcileFlags.Backend, err)
 			}
 
-			err = tx.Commit()
+			result, err := db.Reconcile(ctx, entc, pinned, reconcileFlags.DryRun)
 			if err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
+				return fmt.Errorf("reconcile: %w", err)
+			}
+
+			verb := "Requeued"
+			if reconcileFlags.DryRun {
+				verb = "Would requeue"
+			}
+			for _, p := range result.Missing {
+				fmt.Printf("%v missing pin %v: %v as %q\n", verb, p.ID, p.CID, p.Name)
 			}
 
+			verb = "Orphaned"
+			if reconcileFlags.Unpin {
+				verb = "Unpinned orphaned"
+				if reconcileFlags.DryRun {
+					verb = "Would unpin orphaned"
+				}
+			}
+			for _, cid := range result.Orphans {
+				if reconcileFlags.Unpin && !reconcileFlags.DryRun {
+					err := backend.Remove(ctx, cid)
+					if err != nil {
+						return fmt.Errorf("unpin %v: %w", cid, err)
+					}
+				}
+				fmt.Printf("%v pin %v\n", verb, cid)
+			}
+
+			fmt.Printf("%v missing, %v orphaned\n", len(result.Missing), len(result.Orphans))
+
 			return nil
 		},
 	}
-	setstatusCmd.Flags().StringVar(&setstatusFlags.Status, "status", string(sips.Queued), "status to reset pins to")
+	reconcileCmd.Flags().StringVar(&reconcileFlags.Backend, "backend", config.Default().Backend, "backend to compare with: kubo or cluster")
+	reconcileCmd.Flags().StringVar(&reconcileFlags.API, "api", config.Default().API, "IPFS API to contact with the kubo backend")
+	reconcileCmd.Flags().StringVar(&reconcileFlags.Cluster, "cluster", config.Default().Cluster, "IPFS Cluster API to contact with the cluster backend")
+	reconcileCmd.Flags().BoolVar(&reconcileFlags.DryRun, "dry-run", false, "show what would be done without changing anything")
+	reconcileCmd.Flags().BoolVar(&reconcileFlags.Unpin, "unpin", false, "unpin orphaned pins from the backend")
 
 	pinsCmd.AddCommand(
 		addCmd,
 		listCmd,
 		rmCmd,
 		setstatusCmd,
+		requeueCmd,
+		reconcileCmd,
 	)
 }
+
+// pinset is the part of a backend that reconcile needs. It mirrors the
+// backends of the server, which sipsctl can't use directly.
+type pinset interface {
+	// Pins returns the CIDs that are recursively pinned.
+	Pins(ctx context.Context) ([]string, error)
+
+	// Remove unpins cid.
+	Remove(ctx context.Context, cid string) error
+}
+
+type kuboPinset struct {
+	ipfs *ipfsapi.Client
+}
+
+func (p kuboPinset) Pins(ctx context.Context) ([]string, error) {
+	pins, err := p.ipfs.PinLs(ctx, ipfsapi.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]string, 0, len(pins))
+	for _, pin := range pins {
+		cids = append(cids, pin.CID)
+	}
+	return cids, nil
+}
+
+func (p kuboPinset) Remove(ctx context.Context, cid string) error {
+	_, err := p.ipfs.PinRm(ctx, cid)
+	return err
+}
+
+type clusterPinset struct {
+	cluster *clusterapi.Client
+}
+
+func (p clusterPinset) Pins(ctx context.Context) ([]string, error) {
+	pins, err := p.cluster.Allocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]string, 0, len(pins))
+	for _, pin := range pins {
+		cids = append(cids, pin.CID)
+	}
+	return cids, nil
+}
+
+func (p clusterPinset) Remove(ctx context.Context, cid string) error {
+	return p.cluster.Unpin(ctx, cid)
+}
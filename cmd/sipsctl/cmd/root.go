@@ -6,7 +6,12 @@ import (
 	"fmt"
 
 	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/internal/adminapi"
 	"github.com/DeedleFake/sips/internal/cli"
+	"github.com/DeedleFake/sips/internal/config"
+	"github.com/DeedleFake/sips/internal/log"
 	"github.com/spf13/cobra"
 )
 
@@ -24,6 +29,15 @@ var rootCmd = &cobra.Command{
 		return cmd.Help()
 	},
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		err := loadConfig(cmd)
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+
+		if (rootFlags.Server != "") && !cmd.HasSubCommands() && (cmd.Annotations[serverAnnotation] == "") {
+			return fmt.Errorf("%q is not supported with --server", cmd.CommandPath())
+		}
+
 		if rootFlags.DBDriver == "list" {
 			fmt.Println("Available database drivers:")
 			for _, t := range db.Drivers() {
@@ -37,38 +51,176 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("expand database path: %w", err)
 		}
 		rootFlags.DBPath = dbpath
+
+		tokenkeypath, _, err := cli.ExpandConfig(rootFlags.TokenKey)
+		if err != nil {
+			return fmt.Errorf("expand token key path: %w", err)
+		}
+		rootFlags.TokenKey = tokenkeypath
+
 		return nil
 	},
 }
 
+// rootConfig is the configuration loaded from the config file and
+// the environment. Flags that weren't set on the command-line should
+// default to the values in it.
+var rootConfig config.Config
+
 var rootFlags struct {
-	DBDriver string
-	DBPath   string
+	Config     string
+	DBDriver   string
+	DBPath     string
+	TokenKey   string
+	Server     string
+	AdminToken string
+}
+
+// serverAnnotation is the annotation on commands that support being
+// run against a server with --server. Every other command refuses to
+// run if --server is given.
+const serverAnnotation = "sipsctl.server"
+
+// serverCommand returns annotations marking a command as supporting
+// --server.
+func serverCommand() map[string]string {
+	return map[string]string{serverAnnotation: "true"}
+}
+
+// openAdmin returns a client for the admin API of the server given
+// with --server, or, if there isn't one, an implementation of it that
+// uses the database directly. The returned function must be called
+// when it is no longer needed.
+func openAdmin(ctx context.Context) (adminapi.Admin, func(), error) {
+	if rootFlags.Server != "" {
+		c := adminapi.NewClient(
+			adminapi.WithBaseURL(rootFlags.Server),
+			adminapi.WithToken(rootFlags.AdminToken),
+		)
+		return c, func() {}, nil
+	}
+
+	entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open database: %w", err)
+	}
+
+	key, err := loadTokenKey(ctx, entc)
+	if err != nil {
+		entc.Close()
+		return nil, nil, err
+	}
+
+	a := adminapi.DB{
+		Client:   entc,
+		TokenKey: key,
+	}
+	return &a, func() { entc.Close() }, nil
+}
+
+// loadTokenKey loads the token key given with --tokenkey, generating
+// it if it doesn't exist yet. See db.LoadTokenKey.
+func loadTokenKey(ctx context.Context, entc *ent.Client) ([]byte, error) {
+	key, created, err := db.LoadTokenKey(ctx, entc, rootFlags.TokenKey)
+	if err != nil {
+		return nil, fmt.Errorf("load token key: %w", err)
+	}
+	if created {
+		log.Infof("generated new token key at %q", rootFlags.TokenKey)
+	}
+	return key, nil
+}
+
+// loadConfig fills in the flags that weren't set on the command-line
+// from the config file and the environment.
+func loadConfig(cmd *cobra.Command) error {
+	path, err := config.File(rootFlags.Config)
+	if err != nil {
+		return err
+	}
+
+	cfg := config.Default()
+	err = cfg.Load(path)
+	if err != nil {
+		return err
+	}
+
+	rootConfig = cfg
+
+	flags := cmd.Flags()
+	if !flags.Changed("dbdriver") {
+		rootFlags.DBDriver = cfg.DBDriver
+	}
+	if !flags.Changed("db") {
+		rootFlags.DBPath = cfg.DB
+	}
+	if !flags.Changed("tokenkey") {
+		rootFlags.TokenKey = cfg.TokenKey
+	}
+	if !flags.Changed("server") {
+		rootFlags.Server = cfg.Server
+	}
+	if !flags.Changed("admintoken") {
+		rootFlags.AdminToken = cfg.AdminToken
+	}
+
+	return nil
 }
 
 func init() {
+	defaults := config.Default()
+
+	rootCmd.PersistentFlags().StringVar(
+		&rootFlags.Config,
+		"config",
+		"",
+		"path to YAML config file shared with sips (default $SIPS_CONFIG or sips/config.yaml in the user config dir, if it exists)",
+	)
 	rootCmd.PersistentFlags().StringVar(
 		&rootFlags.DBDriver,
 		"dbdriver",
-		"postgres",
+		defaults.DBDriver,
 		"database driver to use (\"list\" to show available)",
 	)
 	rootCmd.PersistentFlags().StringVar(
 		&rootFlags.DBPath,
 		"db",
-		"host=/var/run/postgresql dbname=sips",
+		defaults.DB,
 		"database connection string ($CONFIG will be replaced with user config dir path)",
 	)
+	rootCmd.PersistentFlags().StringVar(
+		&rootFlags.TokenKey,
+		"tokenkey",
+		defaults.TokenKey,
+		"path to file containing the key used to hash auth tokens, which must match the server's and is generated if it doesn't exist ($CONFIG will be replaced with user config dir path)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&rootFlags.Server,
+		"server",
+		defaults.Server,
+		"base URL of a sips server to administrate using its admin API instead of opening the database",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&rootFlags.AdminToken,
+		"admintoken",
+		defaults.AdminToken,
+		"token with the admin scope to authenticate with --server",
+	)
 
 	rootCmd.AddCommand(
 		tokensCmd,
 		usersCmd,
+		orgsCmd,
 		pinsCmd,
+		webhooksCmd,
 		migrateCmd,
 	)
 }
 
 func ExecuteContext(ctx context.Context) error {
+	// sipsctl is run by operators, who can access everything.
+	ctx = viewer.AdminContext(ctx)
+
 	err := rootCmd.ExecuteContext(ctx)
 	if errors.Is(err, errEarlyExit) {
 		return nil
@@ -1,14 +1,11 @@
 package cmd
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/DeedleFake/sips/db"
-	"github.com/DeedleFake/sips/ent/token"
-	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/internal/adminapi"
 	"github.com/spf13/cobra"
 )
 
@@ -22,100 +19,133 @@ var tokensCmd = &cobra.Command{
 }
 
 var tokenFlags struct {
-	User string
+	User    string
+	Org     string
+	Label   string
+	Expires string
+	Scopes  []string
+}
+
+// parseExpires parses an expiration time for a token from either a
+// duration relative to now or an RFC 3339 timestamp.
+func parseExpires(str string, now time.Time) (time.Time, error) {
+	d, err := time.ParseDuration(str)
+	if err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("expiration duration must be positive: %v", d)
+		}
+		return now.Add(d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiration %q is neither a duration nor an RFC 3339 time", str)
+	}
+	return t, nil
 }
 
 func init() {
 	addCmd := &cobra.Command{
-		Use:   "add",
-		Short: "generate a new auth token",
+		Use:         "add",
+		Short:       "generate a new auth token",
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("open database: %w", err)
+				return err
 			}
-			defer entc.Close()
+			defer done()
 
-			tx, err := entc.Tx(ctx)
-			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
-			}
-			defer tx.Rollback()
-
-			u, err := tx.User.Query().
-				Where(user.Name(tokenFlags.User)).
-				Only(ctx)
-			if err != nil {
-				return fmt.Errorf("find user: %w", err)
-			}
-
-			var buf [256]byte
-			_, err = rand.Read(buf[:])
-			if err != nil {
-				return fmt.Errorf("generate random bytes for token: %v", err)
+			var expires *time.Time
+			if tokenFlags.Expires != "" {
+				t, err := parseExpires(tokenFlags.Expires, time.Now())
+				if err != nil {
+					return err
+				}
+				expires = &t
 			}
-			sum := sha256.Sum256(buf[:])
 
-			tok, err := tx.Token.Create().
-				SetUser(u).
-				SetToken(base64.URLEncoding.EncodeToString(sum[:])).
-				Save(ctx)
+			tok, err := admin.AddToken(ctx, adminapi.NewToken{
+				User:    tokenFlags.User,
+				Org:     tokenFlags.Org,
+				Label:   tokenFlags.Label,
+				Scopes:  tokenFlags.Scopes,
+				Expires: expires,
+			})
 			if err != nil {
 				return fmt.Errorf("create token: %w", err)
 			}
 
-			fmt.Println(tok.Token)
-
-			err = tx.Commit()
-			if err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
-			}
+			// This is the only time that the token is available, as only
+			// its hash is stored.
+			fmt.Println(tok)
 
 			return nil
 		},
 	}
+	addCmd.Flags().StringVar(&tokenFlags.Org, "org", "", "organization that the token acts on behalf of, which the user must be a member of")
+	addCmd.Flags().StringVar(&tokenFlags.Label, "label", "", "label to help tell the token apart from others")
+	addCmd.Flags().StringVar(&tokenFlags.Expires, "expires", "", "when the token expires, either as a duration from now, such as \"720h\", or an RFC 3339 time (default never)")
+	addCmd.Flags().StringSliceVar(&tokenFlags.Scopes, "scope", nil, "scopes to grant the token: read, pin, unpin, or admin (default read,pin,unpin)")
 	addCmd.MarkPersistentFlagRequired("user")
 
 	listCmd := &cobra.Command{
-		Use:   "list",
-		Short: "list all tokens",
+		Use:         "list",
+		Short:       "list all tokens",
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("open database: %w", err)
+				return err
 			}
-			defer entc.Close()
+			defer done()
 
-			tx, err := entc.Tx(ctx)
-			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
-			}
-			defer tx.Rollback()
-
-			q := tx.Token.Query()
-			if tokenFlags.User != "" {
-				q = q.Where(token.HasUserWith(user.Name(tokenFlags.User)))
-			}
-			toks, err := q.WithUser().All(ctx)
+			toks, err := admin.Tokens(ctx, tokenFlags.User)
 			if err != nil {
 				return fmt.Errorf("list tokens: %w", err)
 			}
 
+			now := time.Now()
 			for _, tok := range toks {
 				userName := "<no user>"
-				if tok.Edges.User != nil {
-					userName = tok.Edges.User.Name
+				if tok.User != "" {
+					userName = tok.User
+				}
+				prefix := tok.Prefix
+				if tok.Unhashed {
+					prefix += " (unhashed)"
+				}
+				fmt.Printf("%v %v\n", prefix, userName)
+				if tok.Org != "" {
+					fmt.Printf("  Organization: %v\n", tok.Org)
+				}
+				if tok.Label != "" {
+					fmt.Printf("  Label: %v\n", tok.Label)
+				}
+				fmt.Printf("  Created: %v\n", tok.Created.Format(time.RFC3339))
+				fmt.Printf("  Scopes: %v\n", strings.Join(tok.Scopes, ", "))
+
+				switch {
+				case tok.Expires == nil:
+					fmt.Printf("  Expires: never\n")
+				case !now.Before(*tok.Expires):
+					fmt.Printf("  Expired: %v\n", tok.Expires.Format(time.RFC3339))
+				default:
+					fmt.Printf("  Expires: %v\n", tok.Expires.Format(time.RFC3339))
 				}
-				fmt.Printf("%v %v\n", tok.Token, userName)
-			}
 
-			err = tx.Commit()
-			if err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
+				switch {
+				case tok.LastUsed == nil:
+					fmt.Printf("  Last used: never\n")
+				case tok.LastIP != "":
+					fmt.Printf("  Last used: %v from %v\n", tok.LastUsed.Format(time.RFC3339), tok.LastIP)
+				default:
+					fmt.Printf("  Last used: %v\n", tok.LastUsed.Format(time.RFC3339))
+				}
 			}
 
 			return nil
@@ -123,38 +153,29 @@ func init() {
 	}
 
 	rmCmd := &cobra.Command{
-		Use:   "rm <tokens...>",
+		Use:   "rm <tokens or prefixes...>",
 		Short: "remove a token from the database, thus invalidating it",
-		Args:  cobra.MinimumNArgs(1),
+		Long: `Remove tokens from the database, thus invalidating them. Tokens
+may be specified either in full or by the prefixes shown by the list
+subcommand.`,
+		Args:        cobra.MinimumNArgs(1),
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
-			if err != nil {
-				return fmt.Errorf("open database: %w", err)
-			}
-			defer entc.Close()
-
-			tx, err := entc.Tx(ctx)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
+				return err
 			}
-			defer tx.Rollback()
+			defer done()
 
-			n, err := tx.Token.Delete().
-				Where(token.TokenIn(args...)).
-				Exec(ctx)
+			n, err := admin.RemoveTokens(ctx, args...)
 			if err != nil {
 				return fmt.Errorf("delete tokens: %w", err)
 			}
 
 			fmt.Printf("Deleted %v tokens\n", n)
 
-			err = tx.Commit()
-			if err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
-			}
-
 			return nil
 		},
 	}
@@ -2,15 +2,11 @@ package cmd
 
 import (
 	"fmt"
-	"regexp"
 
-	"github.com/DeedleFake/sips/db"
-	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/internal/adminapi"
 	"github.com/spf13/cobra"
 )
 
-var validUserRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
-
 var usersCmd = &cobra.Command{
 	Use:   "users <subcommand>",
 	Short: "administrate users",
@@ -23,41 +19,25 @@ database.`,
 
 func init() {
 	addCmd := &cobra.Command{
-		Use:   "add <username>",
-		Short: "add a new user",
-		Long:  `Adds a new user.`,
-		Args:  cobra.ExactArgs(1),
+		Use:         "add <username>",
+		Short:       "add a new user",
+		Long:        `Adds a new user.`,
+		Args:        cobra.ExactArgs(1),
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
-			if err != nil {
-				return fmt.Errorf("open database: %w", err)
-			}
-			defer entc.Close()
-
-			tx, err := entc.Tx(ctx)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
+				return err
 			}
-			defer tx.Rollback()
+			defer done()
 
-			if !validUserRE.MatchString(args[0]) {
-				return fmt.Errorf("invalid username: %q", args[0])
-			}
-
-			u, err := tx.User.Create().
-				SetName(args[0]).
-				Save(ctx)
+			u, err := admin.AddUser(ctx, args[0])
 			if err != nil {
 				return fmt.Errorf("create user: %w", err)
 			}
 
-			err = tx.Commit()
-			if err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
-			}
-
 			fmt.Printf("Added user %q\n", u.Name)
 			fmt.Printf("  ID: %d\n", u.ID)
 
@@ -66,25 +46,20 @@ func init() {
 	}
 
 	listCmd := &cobra.Command{
-		Use:   "list",
-		Short: "list all existing users",
-		Long:  `Lists all registered users in the database.`,
+		Use:         "list",
+		Short:       "list all existing users",
+		Long:        `Lists all registered users in the database.`,
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
-			if err != nil {
-				return fmt.Errorf("open database: %w", err)
-			}
-			defer entc.Close()
-
-			tx, err := entc.Tx(ctx)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
+				return err
 			}
-			defer tx.Rollback()
+			defer done()
 
-			users, err := tx.User.Query().All(ctx)
+			users, err := admin.Users(ctx)
 			if err != nil {
 				return fmt.Errorf("query users: %w", err)
 			}
@@ -98,45 +73,98 @@ func init() {
 	}
 
 	rmCmd := &cobra.Command{
-		Use:   "rm <names...>",
-		Short: "remove users from the database",
-		Args:  cobra.MinimumNArgs(1),
+		Use:         "rm <names...>",
+		Short:       "remove users from the database",
+		Args:        cobra.MinimumNArgs(1),
+		Annotations: serverCommand(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("open database: %w", err)
+				return err
 			}
-			defer entc.Close()
+			defer done()
+
+			var n int
+			for _, name := range args {
+				err := admin.RemoveUser(ctx, name)
+				if err != nil {
+					if adminapi.IsNotFound(err) {
+						continue
+					}
+					return fmt.Errorf("delete user %q: %w", name, err)
+				}
+				n++
+			}
+
+			fmt.Printf("Deleted %d users\n", n)
 
-			tx, err := entc.Tx(ctx)
+			return nil
+		},
+	}
+
+	var quotaFlags struct {
+		Pins  int
+		Bytes int64
+	}
+	quotaCmd := &cobra.Command{
+		Use:   "quota <username>",
+		Short: "show or set a user's quotas",
+		Long: `Shows a user's quotas and current usage. If --pins or --bytes are
+given, the corresponding quota is set first. A negative value removes
+the quota.`,
+		Args:        cobra.ExactArgs(1),
+		Annotations: serverCommand(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			admin, done, err := openAdmin(ctx)
 			if err != nil {
-				return fmt.Errorf("begin transaction: %w", err)
+				return err
 			}
-			defer tx.Rollback()
+			defer done()
 
-			n, err := tx.User.Delete().
-				Where(user.NameIn(args...)).
-				Exec(ctx)
-			if err != nil {
-				return fmt.Errorf("delete users: %w", err)
+			var quota adminapi.Quota
+			if cmd.Flags().Changed("pins") {
+				quota.MaxPins = &quotaFlags.Pins
+			}
+			if cmd.Flags().Changed("bytes") {
+				quota.MaxBytes = &quotaFlags.Bytes
 			}
 
-			err = tx.Commit()
+			var u adminapi.User
+			if (quota.MaxPins != nil) || (quota.MaxBytes != nil) {
+				u, err = admin.SetQuota(ctx, args[0], quota)
+			} else {
+				u, err = admin.User(ctx, args[0])
+			}
 			if err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
+				return fmt.Errorf("update user: %w", err)
 			}
 
-			fmt.Printf("Deleted %d users\n", n)
+			fmt.Printf("User %q\n", u.Name)
+			if u.MaxPins != nil {
+				fmt.Printf("  Pins: %v of %v\n", u.Pins, *u.MaxPins)
+			} else {
+				fmt.Printf("  Pins: %v (no limit)\n", u.Pins)
+			}
+			if u.MaxBytes != nil {
+				fmt.Printf("  Bytes: %v of %v\n", u.Bytes, *u.MaxBytes)
+			} else {
+				fmt.Printf("  Bytes: %v (no limit)\n", u.Bytes)
+			}
 
 			return nil
 		},
 	}
+	quotaCmd.Flags().IntVar(&quotaFlags.Pins, "pins", 0, "maximum number of pins")
+	quotaCmd.Flags().Int64Var(&quotaFlags.Bytes, "bytes", 0, "maximum total size of pins in bytes, which is a soft limit, as pins are only rejected once it has been reached")
 
 	usersCmd.AddCommand(
 		addCmd,
 		listCmd,
 		rmCmd,
+		quotaCmd,
 	)
 }
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/delivery"
+	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/ent/webhook"
+	"github.com/spf13/cobra"
+)
+
+var webhooksCmd = &cobra.Command{
+	Use:   "webhooks <subcommand>",
+	Short: "administrate webhooks",
+	Long: `Administrate the webhooks that are notified when the status of a
+user's pins changes, and inspect their deliveries.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var webhookFlags struct {
+	User string
+}
+
+func parseIDs(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("parse ID %q: %w", arg, err)
+		}
+		ids = append(ids, int(id))
+	}
+	return ids, nil
+}
+
+func init() {
+	var addFlags struct {
+		Events []string
+	}
+	addCmd := &cobra.Command{
+		Use:   "add --user <username> <URL>",
+		Short: "register a new webhook",
+		Long: `Register a new webhook for a user. The secret that deliveries to it
+are signed with is printed, and is only shown this once.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			u, err := url.Parse(args[0])
+			if err != nil {
+				return fmt.Errorf("parse URL: %w", err)
+			}
+			if (u.Scheme != "http") && (u.Scheme != "https") {
+				return fmt.Errorf("URL must be http or https: %q", args[0])
+			}
+
+			events := make([]string, 0, len(addFlags.Events))
+			for _, str := range addFlags.Events {
+				t, err := db.ParseEventType(str)
+				if err != nil {
+					return err
+				}
+				events = append(events, string(t))
+			}
+
+			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			if err != nil {
+				return fmt.Errorf("open database: %w", err)
+			}
+			defer entc.Close()
+
+			tx, err := entc.Tx(ctx)
+			if err != nil {
+				return fmt.Errorf("begin transaction: %w", err)
+			}
+			defer tx.Rollback()
+
+			owner, err := tx.User.Query().
+				Where(user.Name(webhookFlags.User)).
+				Only(ctx)
+			if err != nil {
+				return fmt.Errorf("find user: %w", err)
+			}
+
+			secret, err := db.NewWebhookSecret()
+			if err != nil {
+				return err
+			}
+
+			hook, err := tx.Webhook.Create().
+				SetUser(owner).
+				SetURL(u.String()).
+				SetSecret(secret).
+				SetEvents(events).
+				Save(ctx)
+			if err != nil {
+				return fmt.Errorf("create webhook: %w", err)
+			}
+
+			err = tx.Commit()
+			if err != nil {
+				return fmt.Errorf("commit transaction: %w", err)
+			}
+
+			fmt.Printf("New webhook ID: %v\n", hook.ID)
+			fmt.Printf("Secret: %v\n", secret)
+
+			return nil
+		},
+	}
+	addCmd.Flags().StringSliceVar(&addFlags.Events, "event", nil, "events to send to the webhook: pin.queued, pin.pinning, pin.pinned, pin.failed, or pin.deleted (default all)")
+	addCmd.MarkPersistentFlagRequired("user")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "list webhooks",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			if err != nil {
+				return fmt.Errorf("open database: %w", err)
+			}
+			defer entc.Close()
+
+			q := entc.Webhook.Query()
+			if webhookFlags.User != "" {
+				q = q.Where(webhook.HasUserWith(user.Name(webhookFlags.User)))
+			}
+			hooks, err := q.WithUser().
+				Order(ent.Asc(webhook.FieldID)).
+				All(ctx)
+			if err != nil {
+				return fmt.Errorf("list webhooks: %w", err)
+			}
+
+			for _, hook := range hooks {
+				userName := "<no user>"
+				if hook.Edges.User != nil {
+					userName = hook.Edges.User.Name
+				}
+				events := "all"
+				if len(hook.Events) > 0 {
+					events = strings.Join(hook.Events, ", ")
+				}
+
+				fmt.Printf("%v: %v %v\n", hook.ID, hook.URL, userName)
+				fmt.Printf("  Events: %v\n", events)
+			}
+
+			return nil
+		},
+	}
+
+	rmCmd := &cobra.Command{
+		Use:   "rm <IDs...>",
+		Short: "remove webhooks and their deliveries",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			ids, err := parseIDs(args)
+			if err != nil {
+				return err
+			}
+
+			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			if err != nil {
+				return fmt.Errorf("open database: %w", err)
+			}
+			defer entc.Close()
+
+			tx, err := entc.Tx(ctx)
+			if err != nil {
+				return fmt.Errorf("begin transaction: %w", err)
+			}
+			defer tx.Rollback()
+
+			n, err := db.DeleteWebhooks(ctx, tx, webhook.IDIn(ids...))
+			if err != nil {
+				return err
+			}
+
+			err = tx.Commit()
+			if err != nil {
+				return fmt.Errorf("commit transaction: %w", err)
+			}
+
+			fmt.Printf("Deleted %v webhooks\n", n)
+
+			return nil
+		},
+	}
+
+	var deliveriesFlags struct {
+		Webhook int
+		Status  string
+		Limit   int
+	}
+	deliveriesCmd := &cobra.Command{
+		Use:   "deliveries",
+		Short: "list webhook deliveries, most recent first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			entc, err := db.OpenAndMigrate(ctx, rootFlags.DBDriver, rootFlags.DBPath)
+			if err != nil {
+				return fmt.Errorf("open database: %w", err)
+			}
+			defer entc.Close()
+
+			q := entc.Delivery.Query()
+			if deliveriesFlags.Webhook != 0 {
+				q = q.Where(delivery.HasWebhookWith(webhook.ID(deliveriesFlags.Webhook)))
+			}
+			if webhookFlags.User != "" {
+				q = q.Where(delivery.HasWebhookWith(webhook.HasUserWith(user.Name(webhookFlags.User))))
+			}
+			if deliveriesFlags.Status != "" {
+				status := delivery.Status(deliveriesFlags.Status)
+				err := delivery.StatusValidator(status)
+				if err != nil {
+					return err
+				}
+				q = q.Where(delivery.StatusEQ(status))
+			}
+			if deliveriesFlags.Limit > 0 {
+				q = q.Limit(deliveriesFlags.Limit)
+			}
+
+			deliveries, err := q.WithWebhook().
+				Order(ent.Desc(delivery.FieldCreateTime), ent.Desc(delivery.FieldID)).
+				All(ctx)
+			if err != nil {
+				return fmt.Errorf("list deliveries: %w", err)
+			}
+
+			for _, d := range deliveries {
+				fmt.Printf("%v: %v to webhook %v (%v)\n", d.ID, d.Event, d.Edges.Webhook.ID, d.Status)
+				fmt.Printf("  Created: %v\n", d.CreateTime.Format(time.RFC3339))
+				fmt.Printf("  Attempts: %v\n", d.Attempts)
+
+				switch d.Status {
+				case delivery.StatusDelivered:
+					fmt.Printf("  Delivered: %v\n", d.Delivered.Format(time.RFC3339))
+				case delivery.StatusPending:
+					fmt.Printf("  Next attempt: %v\n", d.NextAttempt.Format(time.RFC3339))
+				}
+				if d.ResponseCode != nil {
+					fmt.Printf("  Response: %v\n", *d.ResponseCode)
+				}
+				if d.LastError != "" {
+					fmt.Printf("  Error: %v\n", d.LastError)
+				}
+			}
+
+			return nil
+		},
+	}
+	deliveriesCmd.Flags().IntVar(&deliveriesFlags.Webhook, "webhook", 0, "only show deliveries to the webhook with this ID")
+	deliveriesCmd.Flags().StringVar(&deliveriesFlags.Status, "status", "", "only show deliveries with this status: pending, delivered, or failed")
+	deliveriesCmd.Flags().IntVar(&deliveriesFlags.Limit, "limit", 20, "maximum number of deliveries to show (0 for no limit)")
+
+	webhooksCmd.AddCommand(
+		addCmd,
+		listCmd,
+		rmCmd,
+		deliveriesCmd,
+	)
+	webhooksCmd.PersistentFlags().StringVar(&webhookFlags.User, "user", "", "user that webhooks belong to")
+}
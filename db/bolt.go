@@ -10,8 +10,9 @@ import (
 	"github.com/asdine/storm/q"
 )
 
-// MigrateFromBolt migrates data from the old BoltDB system to the new one.
-func MigrateFromBolt(ctx context.Context, entc *ent.Client, bolt *storm.DB) error {
+// MigrateFromBolt migrates data from the old BoltDB system to the new
+// one. Tokens are hashed using key.
+func MigrateFromBolt(ctx context.Context, entc *ent.Client, bolt *storm.DB, key []byte) error {
 	tx, err := entc.Tx(ctx)
 	if err != nil {
 		return fmt.Errorf("begin transaction: %w", err)
@@ -61,7 +62,8 @@ func MigrateFromBolt(ctx context.Context, entc *ent.Client, bolt *storm.DB) erro
 			_, err := tx.Token.Create().
 				SetUser(u).
 				SetCreateTime(token.Created).
-				SetToken(token.ID).
+				SetHash(HashToken(key, token.ID)).
+				SetPrefix(TokenPrefix(token.ID)).
 				Save(ctx)
 			if err != nil {
 				return fmt.Errorf("create ent token: %w", err)
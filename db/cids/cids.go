@@ -0,0 +1,20 @@
+// Package cids compares CIDs by the content that they refer to. It is
+// separate from package db so that the database schema can use it.
+package cids
+
+import (
+	"github.com/ipfs/go-cid"
+)
+
+// Key returns a key for str that is the same for every CID that refers
+// to the same content, regardless of its version or encoding, so that,
+// for example, a pin of a CIDv0 and a pin of the equivalent CIDv1 are
+// known to need the same content. CIDs are compared by their
+// multihashes. If str isn't a valid CID, it is returned as is.
+func Key(str string) string {
+	c, err := cid.Decode(str)
+	if err != nil {
+		return str
+	}
+	return c.Hash().B58String()
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 
+	entsql "entgo.io/ent/dialect/sql"
+	"github.com/DeedleFake/sips/db/viewer"
 	"github.com/DeedleFake/sips/ent"
+	_ "github.com/DeedleFake/sips/ent/runtime"
 	_ "github.com/lib/pq"
 )
 
@@ -21,14 +24,25 @@ func OpenAndMigrate(ctx context.Context, driver, source string, opts ...ent.Opti
 		return nil, fmt.Errorf("auto-migrate: %w", err)
 	}
 
+	_, err = FillCIDKeys(viewer.SystemContext(ctx), entc)
+	if err != nil {
+		return nil, fmt.Errorf("fill CID keys: %w", err)
+	}
+
 	return entc, nil
 }
 
-// Open opens the database. It is exactly equivalent to calling
-// ent.Open(), but it is preferred so that this package, and its
-// dependencies, are always imported.
+// Open opens the database. It is equivalent to calling ent.Open(),
+// but it is preferred so that this package, and its dependencies, are
+// always imported, and so that transaction errors are counted in the
+// daemon's metrics.
 func Open(driver, source string, opts ...ent.Option) (*ent.Client, error) {
-	return ent.Open(driver, source, opts...)
+	drv, err := entsql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return ent.NewClient(append(opts, ent.Driver(metricsDriver{drv}))...), nil
 }
 
 var drivers = []string{"postgres"}
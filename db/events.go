@@ -0,0 +1,288 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/delivery"
+	"github.com/DeedleFake/sips/ent/membership"
+	"github.com/DeedleFake/sips/ent/organization"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/DeedleFake/sips/ent/pinevent"
+	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/ent/webhook"
+)
+
+// EventHistory is the number of each user's or organization's most
+// recent pin events that are kept.
+const EventHistory = 1000
+
+// DeliveryHistory is the number of each webhook's most recent
+// deliveries that are kept. Pending deliveries are always kept, so
+// that they aren't lost before they're sent.
+const DeliveryHistory = 1000
+
+// EventType is the type of a change in the status of a pin.
+type EventType string
+
+const (
+	EventQueued  EventType = "pin.queued"
+	EventPinning EventType = "pin.pinning"
+	EventPinned  EventType = "pin.pinned"
+	EventFailed  EventType = "pin.failed"
+	EventDeleted EventType = "pin.deleted"
+)
+
+// EventTypes is every type of event.
+var EventTypes = []EventType{
+	EventQueued,
+	EventPinning,
+	EventPinned,
+	EventFailed,
+	EventDeleted,
+}
+
+// ParseEventType parses an event type from a string.
+func ParseEventType(str string) (EventType, error) {
+	for _, t := range EventTypes {
+		if string(t) == str {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("invalid event type: %q", str)
+}
+
+// Event is the payload of a webhook delivery.
+type Event struct {
+	Type EventType      `json:"type"`
+	Time time.Time      `json:"time"`
+	Pin  sips.PinStatus `json:"pin"`
+}
+
+// QueueEvent records an event of type t about p in the history of p's
+// owner and queues deliveries of it to every one of the owner's
+// webhooks that wants it. p should reflect the state of the pin after
+// whatever caused the event. If p belongs to an organization, the
+// event is recorded in the organization's history instead, and is
+// delivered to the webhooks of the user that created p, as long as
+// they are still a member of the organization.
+//
+// Events are recorded in the same transaction as the change that
+// caused them, so an event exists if and only if the change is
+// committed. The returned event, which has its User or Organization
+// edge loaded, can be published once it is. If p has no owner,
+// nothing is recorded and the returned event is nil.
+func QueueEvent(ctx context.Context, tx *ent.Tx, p *ent.Pin, t EventType) (*ent.PinEvent, error) {
+	status := PinStatus(p, []string{})
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return nil, fmt.Errorf("marshal status of pin %v: %w", p.ID, err)
+	}
+
+	org, err := tx.Organization.Query().
+		Where(organization.HasPinsWith(pin.ID(p.ID))).
+		Only(ctx)
+	switch {
+	case err == nil:
+		return queueOrgEvent(ctx, tx, org, p, t, status, payload)
+	case !ent.IsNotFound(err):
+		return nil, fmt.Errorf("query organization of pin %v: %w", p.ID, err)
+	}
+
+	owner, err := tx.User.Query().
+		Where(user.HasPinsWith(pin.ID(p.ID))).
+		Only(ctx)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query owner of pin %v: %w", p.ID, err)
+	}
+
+	// Incrementing the sequence number locks the user's row, so
+	// concurrent events for the same user are ordered.
+	owner, err = tx.User.UpdateOne(owner).
+		AddEventSeq(1).
+		Save(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("increment event sequence of owner of pin %v: %w", p.ID, err)
+	}
+
+	ev, err := tx.PinEvent.Create().
+		SetUser(owner).
+		SetSeq(owner.EventSeq).
+		SetType(string(t)).
+		SetPayload(string(payload)).
+		Save(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create %v event for pin %v: %w", t, p.ID, err)
+	}
+	ev.Edges.User = owner
+
+	_, err = tx.PinEvent.Delete().
+		Where(
+			pinevent.HasUserWith(user.ID(owner.ID)),
+			pinevent.SeqLTE(owner.EventSeq-EventHistory),
+		).
+		Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("prune events of user %v: %w", owner.ID, err)
+	}
+
+	err = queueDeliveries(ctx, tx, owner, Event{
+		Type: t,
+		Time: ev.CreateTime,
+		Pin:  status,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+func queueOrgEvent(ctx context.Context, tx *ent.Tx, org *ent.Organization, p *ent.Pin, t EventType, status sips.PinStatus, payload []byte) (*ent.PinEvent, error) {
+	org, err := tx.Organization.UpdateOne(org).
+		AddEventSeq(1).
+		Save(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("increment event sequence of organization of pin %v: %w", p.ID, err)
+	}
+
+	ev, err := tx.PinEvent.Create().
+		SetOrganization(org).
+		SetSeq(org.EventSeq).
+		SetType(string(t)).
+		SetPayload(string(payload)).
+		Save(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create %v event for pin %v: %w", t, p.ID, err)
+	}
+	ev.Edges.Organization = org
+
+	_, err = tx.PinEvent.Delete().
+		Where(
+			pinevent.HasOrganizationWith(organization.ID(org.ID)),
+			pinevent.SeqLTE(org.EventSeq-EventHistory),
+		).
+		Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("prune events of organization %v: %w", org.ID, err)
+	}
+
+	// Webhooks belong to users, so the closest thing to the
+	// organization's own is those of the user that created the pin.
+	creator, err := tx.User.Query().
+		Where(
+			user.HasPinsWith(pin.ID(p.ID)),
+			user.HasMembershipsWith(membership.HasOrganizationWith(organization.ID(org.ID))),
+		).
+		Only(ctx)
+	switch {
+	case err == nil:
+		err = queueDeliveries(ctx, tx, creator, Event{
+			Type: t,
+			Time: ev.CreateTime,
+			Pin:  status,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case !ent.IsNotFound(err):
+		return nil, fmt.Errorf("query creator of pin %v: %w", p.ID, err)
+	}
+
+	return ev, nil
+}
+
+func queueDeliveries(ctx context.Context, tx *ent.Tx, owner *ent.User, event Event) error {
+	hooks, err := tx.Webhook.Query().
+		Where(webhook.HasUserWith(user.ID(owner.ID))).
+		All(ctx)
+	if err != nil {
+		return fmt.Errorf("query webhooks of user %v: %w", owner.ID, err)
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal %v event: %w", event.Type, err)
+	}
+
+	for _, hook := range hooks {
+		if !WebhookWants(hook, event.Type) {
+			continue
+		}
+
+		err := tx.Delivery.Create().
+			SetWebhook(hook).
+			SetEvent(string(event.Type)).
+			SetPayload(string(payload)).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("create delivery of %v event to webhook %v: %w", event.Type, hook.ID, err)
+		}
+
+		err = pruneDeliveries(ctx, tx, hook)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneDeliveries deletes the finished deliveries to hook that are
+// older than its DeliveryHistory most recent ones.
+func pruneDeliveries(ctx context.Context, tx *ent.Tx, hook *ent.Webhook) error {
+	oldest, err := tx.Delivery.Query().
+		Where(delivery.HasWebhookWith(webhook.ID(hook.ID))).
+		Order(ent.Desc(delivery.FieldID)).
+		Offset(DeliveryHistory - 1).
+		FirstID(ctx)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("query deliveries of webhook %v: %w", hook.ID, err)
+	}
+
+	_, err = tx.Delivery.Delete().
+		Where(
+			delivery.HasWebhookWith(webhook.ID(hook.ID)),
+			delivery.IDLT(oldest),
+			delivery.StatusNEQ(delivery.StatusPending),
+		).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("prune deliveries of webhook %v: %w", hook.ID, err)
+	}
+	return nil
+}
+
+// EventsSince returns the events in o's namespace that have a sequence
+// number greater than seq, in order.
+func EventsSince(ctx context.Context, entc *ent.Client, o Owner, seq int) ([]*ent.PinEvent, error) {
+	owned := pinevent.HasUserWith(user.ID(o.User.ID))
+	if o.Org != nil {
+		owned = pinevent.HasOrganizationWith(organization.ID(o.Org.ID))
+	}
+
+	events, err := entc.PinEvent.Query().
+		Where(
+			owned,
+			pinevent.SeqGT(seq),
+		).
+		Order(ent.Asc(pinevent.FieldSeq)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query events of %v since %v: %w", o, seq, err)
+	}
+	return events, nil
+}
@@ -0,0 +1,128 @@
+//go:build sqlite3
+// +build sqlite3
+
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/delivery"
+	"github.com/DeedleFake/sips/ent/membership"
+	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/ent/webhook"
+)
+
+func TestQueueOrgEvent(t *testing.T) {
+	entc, tn := setupTenants(t)
+	ctx := context.Background()
+	system := viewer.SystemContext(ctx)
+
+	hook := func(u *ent.User) *ent.Webhook {
+		return entc.Webhook.Create().
+			SetUser(u).
+			SetURL("http://example.com/" + u.Name).
+			SetSecret("secret").
+			SaveX(system)
+	}
+	aliceHook := hook(tn.alice)
+	bobHook := hook(tn.bob)
+	entc.Membership.Create().SetUser(tn.bob).SetOrganization(tn.team).SaveX(system)
+
+	queue := func() {
+		t.Helper()
+
+		// Pins are updated by members using their organization tokens.
+		ctx := db.Owner{User: tn.bob, Org: tn.team}.Context(ctx)
+		tx, err := entc.Tx(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		ev, err := db.QueueEvent(ctx, tx, tn.teamPin, db.EventPinned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Edges.Organization == nil {
+			t.Fatal("event not recorded for organization")
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries := func(hook *ent.Webhook) int {
+		return entc.Delivery.Query().
+			Where(delivery.HasWebhookWith(webhook.ID(hook.ID))).
+			CountX(system)
+	}
+
+	queue()
+	if n := deliveries(aliceHook); n != 1 {
+		t.Errorf("got %v deliveries to creator, want 1", n)
+	}
+	if n := deliveries(bobHook); n != 0 {
+		t.Errorf("got %v deliveries to other member, want 0", n)
+	}
+
+	entc.Membership.Delete().
+		Where(membership.HasUserWith(user.ID(tn.alice.ID))).
+		ExecX(system)
+	queue()
+	if n := deliveries(aliceHook); n != 1 {
+		t.Errorf("got %v deliveries to creator after leaving, want 1", n)
+	}
+}
+
+func TestPruneDeliveries(t *testing.T) {
+	entc, tn := setupTenants(t)
+	ctx := viewer.SystemContext(context.Background())
+
+	hook := entc.Webhook.Create().
+		SetUser(tn.bob).
+		SetURL("http://example.com/bob").
+		SetSecret("secret").
+		SaveX(ctx)
+
+	// The oldest delivery hasn't been sent yet, so it must be kept.
+	pending := entc.Delivery.Create().
+		SetWebhook(hook).
+		SetEvent(string(db.EventPinned)).
+		SetPayload("{}").
+		SaveX(ctx)
+	old := make([]*ent.DeliveryCreate, db.DeliveryHistory)
+	for i := range old {
+		old[i] = entc.Delivery.Create().
+			SetWebhook(hook).
+			SetEvent(string(db.EventPinned)).
+			SetPayload("{}").
+			SetStatus(delivery.StatusDelivered)
+	}
+	entc.Delivery.CreateBulk(old...).ExecX(ctx)
+
+	tx, err := entc.Tx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = db.QueueEvent(ctx, tx, tn.bobPin, db.EventPinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := entc.Delivery.Query().CountX(ctx); n != db.DeliveryHistory+1 {
+		t.Errorf("got %v deliveries, want %v", n, db.DeliveryHistory+1)
+	}
+	if !entc.Delivery.Query().Where(delivery.ID(pending.ID)).ExistX(ctx) {
+		t.Error("pending delivery was pruned")
+	}
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db/cids"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/job"
+	"github.com/DeedleFake/sips/ent/pin"
+)
+
+// QueueAdd queues a job to pin p's CID.
+func QueueAdd(ctx context.Context, tx *ent.Tx, p *ent.Pin) error {
+	_, err := replaceJobs(ctx, tx, p)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Job.Create().
+		SetPin(p).
+		SetAction(job.ActionAdd).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("create add job for pin %v: %w", p.ID, err)
+	}
+
+	return nil
+}
+
+// QueueUpdate queues a job to change the CID pinned for p. The old
+// pin should be p as it was before it was updated.
+func QueueUpdate(ctx context.Context, tx *ent.Tx, old, p *ent.Pin) error {
+	from, err := replaceJobs(ctx, tx, p)
+	if err != nil {
+		return err
+	}
+	if (from == "") && (old.Status == sips.Pinned) {
+		from = old.CID
+	}
+
+	create := tx.Job.Create().
+		SetPin(p).
+		SetAction(job.ActionAdd)
+	if (from != "") && (from != p.CID) {
+		create = create.
+			SetAction(job.ActionUpdate).
+			SetOldCID(from)
+	}
+
+	err = create.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("create update job for pin %v: %w", p.ID, err)
+	}
+
+	return nil
+}
+
+// QueueDelete queues a job to unpin p's CID and then delete p.
+func QueueDelete(ctx context.Context, tx *ent.Tx, p *ent.Pin) error {
+	from, err := replaceJobs(ctx, tx, p)
+	if err != nil {
+		return err
+	}
+
+	create := tx.Job.Create().
+		SetPin(p).
+		SetAction(job.ActionDelete)
+	if (from != "") && (from != p.CID) {
+		create = create.SetOldCID(from)
+	}
+
+	err = create.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("create delete job for pin %v: %w", p.ID, err)
+	}
+
+	return nil
+}
+
+// replaceJobs deletes any existing jobs for p. If one of them was
+// replacing a previously pinned CID that might still be pinned, that
+// CID is returned so that the new job can take care of it.
+func replaceJobs(ctx context.Context, tx *ent.Tx, p *ent.Pin) (from string, err error) {
+	jobs, err := tx.Pin.QueryJobs(p).All(ctx)
+	if err != nil {
+		return "", fmt.Errorf("query jobs for pin %v: %w", p.ID, err)
+	}
+
+	for _, j := range jobs {
+		if j.OldCID != "" {
+			from = j.OldCID
+		}
+
+		err := tx.Job.DeleteOne(j).Exec(ctx)
+		if err != nil {
+			return "", fmt.Errorf("delete job %v: %w", j.ID, err)
+		}
+	}
+
+	return from, nil
+}
+
+// CIDInUse returns true if cid is still needed by any pin other than
+// the one with the ID exclude, in which case it should not be unpinned.
+// A CID is needed if it belongs to a pin that hasn't failed and isn't
+// waiting to be deleted, or if a pending update is replacing it, as
+// the update needs it to still be pinned. CIDs are compared by the
+// content that they refer to, so a pin of a CIDv0 needs the equivalent
+// CIDv1, for example.
+//
+// Pins waiting to be deleted don't count, as their own jobs will
+// check again. Otherwise, two pins of the same CID that are deleted at
+// the same time would each leave it pinned for the other.
+func CIDInUse(ctx context.Context, entc *ent.Client, cid string, exclude int) (bool, error) {
+	key := cids.Key(cid)
+
+	inuse, err := entc.Pin.Query().
+		Where(
+			pin.CIDKey(key),
+			pin.IDNEQ(exclude),
+			pin.StatusNEQ(sips.Failed),
+			NotDeleted(),
+		).
+		Exist(ctx)
+	if err != nil {
+		return false, fmt.Errorf("query pins of %v: %w", cid, err)
+	}
+	if inuse {
+		return true, nil
+	}
+
+	inuse, err = entc.Job.Query().
+		Where(
+			job.ActionEQ(job.ActionUpdate),
+			job.OldCIDKey(key),
+			job.HasPinWith(pin.IDNEQ(exclude)),
+		).
+		Exist(ctx)
+	if err != nil {
+		return false, fmt.Errorf("query updates from %v: %w", cid, err)
+	}
+	return inuse, nil
+}
+
+// FillCIDKeys sets the keys that CIDInUse compares of the pins and
+// jobs from before they were recorded. It returns the number of pins
+// and jobs that were updated.
+func FillCIDKeys(ctx context.Context, entc *ent.Client) (int, error) {
+	tx, err := entc.Tx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pins, err := tx.Pin.Query().
+		Where(pin.CIDKeyIsNil()).
+		All(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("query pins without CID keys: %w", err)
+	}
+	for _, p := range pins {
+		err := tx.Pin.UpdateOne(p).
+			SetCIDKey(cids.Key(p.CID)).
+			Exec(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("set CID key of pin %v: %w", p.ID, err)
+		}
+	}
+
+	jobs, err := tx.Job.Query().
+		Where(
+			job.OldCIDNEQ(""),
+			job.OldCIDKeyIsNil(),
+		).
+		All(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("query jobs without CID keys: %w", err)
+	}
+	for _, j := range jobs {
+		err := tx.Job.UpdateOne(j).
+			SetOldCIDKey(cids.Key(j.OldCID)).
+			Exec(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("set CID key of job %v: %w", j.ID, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return len(pins) + len(jobs), nil
+}
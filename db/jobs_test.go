@@ -0,0 +1,66 @@
+//go:build sqlite3
+// +build sqlite3
+
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/ipfs/go-cid"
+)
+
+func TestCIDInUseCIDVersions(t *testing.T) {
+	entc, tn := setupTenants(t)
+	ctx := viewer.SystemContext(context.Background())
+
+	v0 := tn.alicePin.CID
+	c, err := cid.Decode(v0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := cid.NewCidV1(cid.DagProtobuf, c.Hash()).String()
+
+	entc.Pin.UpdateOne(tn.bobPin).SetCID(v1).ExecX(ctx)
+	entc.Pin.UpdateOne(tn.teamPin).SetStatus(sips.Failed).ExecX(ctx)
+
+	inuse, err := db.CIDInUse(ctx, entc, v0, tn.alicePin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inuse {
+		t.Errorf("%v not in use when another pin is pinning %v", v0, v1)
+	}
+
+	entc.Pin.UpdateOne(tn.bobPin).SetStatus(sips.Failed).ExecX(ctx)
+
+	inuse, err = db.CIDInUse(ctx, entc, v0, tn.alicePin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inuse {
+		t.Errorf("%v in use when every other pin of it has failed", v0)
+	}
+}
+
+func TestFillCIDKeys(t *testing.T) {
+	entc, _ := setupTenants(t)
+	ctx := viewer.SystemContext(context.Background())
+
+	entc.Pin.Update().ClearCIDKey().ExecX(ctx)
+
+	n, err := db.FillCIDKeys(ctx, entc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("filled %v CID keys, want 3", n)
+	}
+	if n := entc.Pin.Query().Where(pin.CIDKeyIsNil()).CountX(ctx); n != 0 {
+		t.Errorf("%v pins left without CID keys", n)
+	}
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"entgo.io/ent/dialect"
+	"github.com/DeedleFake/sips/internal/metrics"
+)
+
+var txErrors = metrics.NewCounter(
+	"sips_db_tx_errors_total",
+	"Number of database transactions that failed to begin, commit, or roll back.",
+	"op",
+)
+
+// metricsDriver wraps a driver in order to count transaction errors.
+type metricsDriver struct {
+	dialect.Driver
+}
+
+func (drv metricsDriver) Tx(ctx context.Context) (dialect.Tx, error) {
+	tx, err := drv.Driver.Tx(ctx)
+	if err != nil {
+		txErrors.With("begin").Inc()
+		return nil, err
+	}
+	return metricsTx{tx}, nil
+}
+
+// BeginTx is like Tx, but allows options, such as the isolation level,
+// to be given, as ent.Client.BeginTx requires.
+func (drv metricsDriver) BeginTx(ctx context.Context, opts *sql.TxOptions) (dialect.Tx, error) {
+	b, ok := drv.Driver.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (dialect.Tx, error)
+	})
+	if !ok {
+		txErrors.With("begin").Inc()
+		return nil, errors.New("driver does not support transaction options")
+	}
+
+	tx, err := b.BeginTx(ctx, opts)
+	if err != nil {
+		txErrors.With("begin").Inc()
+		return nil, err
+	}
+	return metricsTx{tx}, nil
+}
+
+type metricsTx struct {
+	dialect.Tx
+}
+
+func (tx metricsTx) Commit() error {
+	err := tx.Tx.Commit()
+	if err != nil {
+		txErrors.With("commit").Inc()
+	}
+	return err
+}
+
+func (tx metricsTx) Rollback() error {
+	// Transactions are usually rolled back via a defer after they've
+	// already been committed, which isn't a problem.
+	err := tx.Tx.Rollback()
+	if (err != nil) && !errors.Is(err, sql.ErrTxDone) {
+		txErrors.With("rollback").Inc()
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/membership"
+	"github.com/DeedleFake/sips/ent/organization"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/DeedleFake/sips/ent/token"
+	"github.com/DeedleFake/sips/ent/user"
+)
+
+// Owner is a namespace that pins belong to. Pins belong either to a
+// user directly or to an organization, in which case they are shared
+// by its members.
+type Owner struct {
+	// User is the user acting in the namespace. If Org is nil, the
+	// namespace is the user's own.
+	User *ent.User
+
+	// Org is the organization that the namespace belongs to, if any.
+	Org *ent.Organization
+}
+
+func (o Owner) String() string {
+	if o.Org != nil {
+		return fmt.Sprintf("organization %q", o.Org.Name)
+	}
+	return fmt.Sprintf("user %q", o.User.Name)
+}
+
+// Lock locks the namespace's row in tx until it ends, so that requests
+// that check the namespace's pins and then change them, such as by
+// checking its quota before adding another, can't interleave. It
+// returns o with its entities bound to tx.
+func (o Owner) Lock(ctx context.Context, tx *ent.Tx) (Owner, error) {
+	// Writing to the row locks it. Saving it without any changes still
+	// touches its update time, so that's enough.
+	if o.Org != nil {
+		org, err := tx.Organization.UpdateOneID(o.Org.ID).Save(ctx)
+		if err != nil {
+			return Owner{}, fmt.Errorf("lock %v: %w", o, err)
+		}
+
+		u, err := tx.User.Get(ctx, o.User.ID)
+		if err != nil {
+			return Owner{}, fmt.Errorf("query user %v: %w", o.User.ID, err)
+		}
+		return Owner{User: u, Org: org}, nil
+	}
+
+	u, err := tx.User.UpdateOneID(o.User.ID).Save(ctx)
+	if err != nil {
+		return Owner{}, fmt.Errorf("lock %v: %w", o, err)
+	}
+	return Owner{User: u}, nil
+}
+
+// In returns o with its entities reloaded in tx, so that queries built
+// from them, such as by QueryPins, run in it. See Lock for a version
+// that also locks the namespace.
+func (o Owner) In(ctx context.Context, tx *ent.Tx) (Owner, error) {
+	u, err := tx.User.Get(ctx, o.User.ID)
+	if err != nil {
+		return Owner{}, fmt.Errorf("query user %v: %w", o.User.ID, err)
+	}
+	if o.Org == nil {
+		return Owner{User: u}, nil
+	}
+
+	org, err := tx.Organization.Get(ctx, o.Org.ID)
+	if err != nil {
+		return Owner{}, fmt.Errorf("query %v: %w", o, err)
+	}
+	return Owner{User: u, Org: org}, nil
+}
+
+// QueryPins returns a query for the pins in the namespace.
+func (o Owner) QueryPins() *ent.PinQuery {
+	if o.Org != nil {
+		return o.Org.QueryPins()
+	}
+	return o.User.QueryPins().Where(pin.Not(pin.HasOrganization()))
+}
+
+// QueryTokens returns a query for the tokens that act in the
+// namespace.
+func (o Owner) QueryTokens() *ent.TokenQuery {
+	if o.Org != nil {
+		return o.Org.QueryTokens()
+	}
+	return o.User.QueryTokens().Where(token.Not(token.HasOrganization()))
+}
+
+// EventSeq returns the sequence number of the most recent event in the
+// namespace.
+func (o Owner) EventSeq() int {
+	if o.Org != nil {
+		return o.Org.EventSeq
+	}
+	return o.User.EventSeq
+}
+
+// quotas returns the namespace's quotas.
+func (o Owner) quotas() (maxPins *int, maxBytes *int64) {
+	if o.Org != nil {
+		return o.Org.MaxPins, o.Org.MaxBytes
+	}
+	return o.User.MaxPins, o.User.MaxBytes
+}
+
+// RoleScopes returns the scopes that a member of an organization with
+// the given role may use on its behalf.
+func RoleScopes(role membership.Role) []Scope {
+	switch role {
+	case membership.RoleOwner, membership.RoleMember:
+		return DefaultScopes
+	default:
+		return []Scope{ScopeRead}
+	}
+}
+
+// Membership returns the membership of the user with the ID uid in the
+// organization with the ID oid.
+func Membership(ctx context.Context, tx *ent.Tx, uid, oid int) (*ent.Membership, error) {
+	return tx.Membership.Query().
+		Where(
+			membership.HasUserWith(user.ID(uid)),
+			membership.HasOrganizationWith(organization.ID(oid)),
+		).
+		Only(ctx)
+}
+
+// LimitScopes returns the scopes in scopes that are allowed by
+// allowed. ScopeAdmin is replaced by allowed itself, so that a token
+// with it gets everything that it can be given, but nothing more.
+func LimitScopes(scopes, allowed []Scope) []Scope {
+	limited := make([]Scope, 0, len(scopes))
+	for _, s := range scopes {
+		switch {
+		case s == ScopeAdmin:
+			return allowed
+		case ScopesAllow(allowed, s):
+			limited = append(limited, s)
+		}
+	}
+	return limited
+}
+
+// Context returns a context for a viewer acting in the namespace.
+func (o Owner) Context(ctx context.Context) context.Context {
+	var oid int
+	if o.Org != nil {
+		oid = o.Org.ID
+	}
+	return viewer.UserContext(ctx, o.User.ID, oid)
+}
@@ -0,0 +1,228 @@
+//go:build sqlite3
+// +build sqlite3
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/privacy"
+)
+
+type tenants struct {
+	alice, bob *ent.User
+	team       *ent.Organization
+
+	alicePin, bobPin, teamPin *ent.Pin
+	aliceTok, bobTok, teamTok *ent.Token
+}
+
+func setupTenants(t *testing.T) (*ent.Client, tenants) {
+	ctx := viewer.SystemContext(context.Background())
+
+	entc, err := db.OpenAndMigrate(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_fk=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { entc.Close() })
+
+	var tn tenants
+	tn.alice = entc.User.Create().SetName("alice").SaveX(ctx)
+	tn.bob = entc.User.Create().SetName("bob").SaveX(ctx)
+	tn.team = entc.Organization.Create().SetName("team").SaveX(ctx)
+	entc.Membership.Create().SetUser(tn.alice).SetOrganization(tn.team).SaveX(ctx)
+
+	pin := func(u *ent.User, org *ent.Organization, name string) *ent.Pin {
+		return entc.Pin.Create().
+			SetUser(u).
+			SetNillableOrganizationID(orgID(org)).
+			SetName(name).
+			SetCID("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG").
+			SaveX(ctx)
+	}
+	tn.alicePin = pin(tn.alice, nil, "alice")
+	tn.bobPin = pin(tn.bob, nil, "bob")
+	tn.teamPin = pin(tn.alice, tn.team, "team")
+
+	tok := func(u *ent.User, org *ent.Organization, name string) *ent.Token {
+		return entc.Token.Create().
+			SetUser(u).
+			SetNillableOrganizationID(orgID(org)).
+			SetHash(db.HashToken(nil, name)).
+			SetPrefix(name).
+			SaveX(ctx)
+	}
+	tn.aliceTok = tok(tn.alice, nil, "alice")
+	tn.bobTok = tok(tn.bob, nil, "bob")
+	tn.teamTok = tok(tn.alice, tn.team, "team")
+
+	return entc, tn
+}
+
+func orgID(org *ent.Organization) *int {
+	if org == nil {
+		return nil
+	}
+	return &org.ID
+}
+
+func TestPinPrivacy(t *testing.T) {
+	entc, tn := setupTenants(t)
+	ctx := context.Background()
+	alice := db.Owner{User: tn.alice}.Context(ctx)
+	team := db.Owner{User: tn.alice, Org: tn.team}.Context(ctx)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want []int
+	}{
+		{"User", alice, []int{tn.alicePin.ID}},
+		{"Org", team, []int{tn.teamPin.ID}},
+		{"Admin", viewer.AdminContext(ctx), []int{tn.alicePin.ID, tn.bobPin.ID, tn.teamPin.ID}},
+		{"System", viewer.SystemContext(ctx), []int{tn.alicePin.ID, tn.bobPin.ID, tn.teamPin.ID}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids, err := entc.Pin.Query().IDs(test.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalIDs(ids, test.want) {
+				t.Fatalf("got pins %v, want %v", ids, test.want)
+			}
+		})
+	}
+
+	t.Run("NoViewer", func(t *testing.T) {
+		_, err := entc.Pin.Query().All(ctx)
+		if !errors.Is(err, privacy.Deny) {
+			t.Fatalf("expected denial, got %v", err)
+		}
+	})
+
+	t.Run("CrossTenantGet", func(t *testing.T) {
+		for _, id := range []int{tn.bobPin.ID, tn.teamPin.ID} {
+			_, err := entc.Pin.Get(alice, id)
+			if !ent.IsNotFound(err) {
+				t.Errorf("get pin %v: expected not found, got %v", id, err)
+			}
+		}
+
+		_, err := entc.Pin.Get(team, tn.alicePin.ID)
+		if !ent.IsNotFound(err) {
+			t.Errorf("get personal pin with org viewer: expected not found, got %v", err)
+		}
+
+		n, err := tn.bob.QueryPins().Count(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("found %v of bob's pins through edge", n)
+		}
+	})
+
+	t.Run("CrossTenantMutation", func(t *testing.T) {
+		err := entc.Pin.UpdateOneID(tn.bobPin.ID).SetName("stolen").Exec(alice)
+		if !ent.IsNotFound(err) {
+			t.Errorf("update: expected not found, got %v", err)
+		}
+
+		err = entc.Pin.DeleteOneID(tn.bobPin.ID).Exec(alice)
+		if !ent.IsNotFound(err) {
+			t.Errorf("delete: expected not found, got %v", err)
+		}
+
+		_, err = entc.Pin.Create().
+			SetUser(tn.bob).
+			SetName("planted").
+			SetCID("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG").
+			Save(alice)
+		if !errors.Is(err, privacy.Deny) {
+			t.Errorf("create: expected denial, got %v", err)
+		}
+
+		p := entc.Pin.GetX(viewer.SystemContext(ctx), tn.bobPin.ID)
+		if p.Name != "bob" {
+			t.Errorf("bob's pin was renamed to %q", p.Name)
+		}
+	})
+}
+
+func TestTokenPrivacy(t *testing.T) {
+	entc, tn := setupTenants(t)
+	ctx := context.Background()
+	alice := db.Owner{User: tn.alice}.Context(ctx)
+	team := db.Owner{User: tn.alice, Org: tn.team}.Context(ctx)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want []int
+	}{
+		{"User", alice, []int{tn.aliceTok.ID}},
+		{"Org", team, []int{tn.teamTok.ID}},
+		{"Admin", viewer.AdminContext(ctx), []int{tn.aliceTok.ID, tn.bobTok.ID, tn.teamTok.ID}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids, err := entc.Token.Query().IDs(test.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalIDs(ids, test.want) {
+				t.Fatalf("got tokens %v, want %v", ids, test.want)
+			}
+		})
+	}
+
+	t.Run("NoViewer", func(t *testing.T) {
+		_, err := entc.Token.Query().All(ctx)
+		if !errors.Is(err, privacy.Deny) {
+			t.Fatalf("expected denial, got %v", err)
+		}
+	})
+
+	t.Run("CrossTenant", func(t *testing.T) {
+		_, err := entc.Token.Get(alice, tn.bobTok.ID)
+		if !ent.IsNotFound(err) {
+			t.Errorf("get: expected not found, got %v", err)
+		}
+
+		err = entc.Token.DeleteOneID(tn.bobTok.ID).Exec(alice)
+		if !ent.IsNotFound(err) {
+			t.Errorf("delete: expected not found, got %v", err)
+		}
+
+		_, err = entc.Token.Create().
+			SetUser(tn.bob).
+			SetHash(db.HashToken(nil, "planted")).
+			SetPrefix("planted").
+			Save(alice)
+		if !errors.Is(err, privacy.Deny) {
+			t.Errorf("create: expected denial, got %v", err)
+		}
+	})
+}
+
+func equalIDs(got, want []int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[int]bool, len(got))
+	for _, id := range got {
+		seen[id] = true
+	}
+	for _, id := range want {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
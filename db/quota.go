@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/job"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/DeedleFake/sips/ent/predicate"
+)
+
+// ErrQuotaExceeded is wrapped by errors returned from CheckQuota when
+// a user or organization has reached one of their quotas.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrTooManyQueued is wrapped by errors returned from CheckQueued when
+// a user or organization has too many pins waiting to be pinned.
+var ErrTooManyQueued = errors.New("too many queued pins")
+
+// NotDeleted returns a predicate that matches pins that are not
+// waiting to be deleted. Such pins have already been deleted as far as
+// the user is concerned.
+func NotDeleted() predicate.Pin {
+	return pin.Not(pin.HasJobsWith(job.ActionEQ(job.ActionDelete)))
+}
+
+// Usage returns the number of pins that o has and their total size in
+// bytes, not counting pins that are waiting to be deleted or the pins
+// with the IDs in exclude.
+func Usage(ctx context.Context, o Owner, exclude ...int) (pins int, bytes int64, err error) {
+	q := o.QueryPins().Where(NotDeleted())
+	if len(exclude) > 0 {
+		q = q.Where(pin.IDNotIn(exclude...))
+	}
+
+	// The pins are grouped by status only because ent requires a
+	// field to group by in order to aggregate.
+	var rows []struct {
+		Status string `json:"status"`
+		Count  int    `json:"count"`
+		Sum    int64  `json:"sum"`
+	}
+	err = q.GroupBy(pin.FieldStatus).
+		Aggregate(
+			ent.As(ent.Count(), "count"),
+			ent.As(ent.Sum(pin.FieldSize), "sum"),
+		).
+		Scan(ctx, &rows)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, row := range rows {
+		pins += row.Count
+		bytes += row.Sum
+	}
+	return pins, bytes, nil
+}
+
+// CheckQuota returns an error wrapping ErrQuotaExceeded if o is not
+// allowed to pin anything else. If replacing is not zero, the pin with
+// that ID is not counted against the quotas, as it is about to be
+// replaced.
+//
+// The size of a pin isn't known until it has been pinned, so the byte
+// quota is a soft limit: pins are rejected once the quota has been
+// reached, but the pins that are added before then can take usage past
+// it. The pin quota is exact, as long as o was locked with Owner.Lock
+// in the same transaction that the pin is added in, as otherwise
+// concurrent requests could each see room for one more.
+func CheckQuota(ctx context.Context, o Owner, replacing int) error {
+	maxPins, maxBytes := o.quotas()
+	if (maxPins == nil) && (maxBytes == nil) {
+		return nil
+	}
+
+	var exclude []int
+	if replacing != 0 {
+		exclude = append(exclude, replacing)
+	}
+	pins, bytes, err := Usage(ctx, o, exclude...)
+	if err != nil {
+		return fmt.Errorf("get usage: %w", err)
+	}
+
+	if (maxPins != nil) && (pins >= *maxPins) {
+		return fmt.Errorf("%w: %v of %v pins used", ErrQuotaExceeded, pins, *maxPins)
+	}
+	if (maxBytes != nil) && (bytes >= *maxBytes) {
+		return fmt.Errorf("%w: %v of %v bytes used", ErrQuotaExceeded, bytes, *maxBytes)
+	}
+	return nil
+}
+
+// CheckQueued returns an error wrapping ErrTooManyQueued if o already
+// has max or more pins that are queued or being pinned. If replacing
+// is not zero, the pin with that ID is not counted, as it is about to
+// be replaced. If max is not positive, there is no limit.
+func CheckQueued(ctx context.Context, o Owner, max int, replacing int) error {
+	if max <= 0 {
+		return nil
+	}
+
+	q := o.QueryPins().
+		Where(
+			pin.StatusIn(sips.Queued, sips.Pinning),
+			NotDeleted(),
+		)
+	if replacing != 0 {
+		q = q.Where(pin.IDNEQ(replacing))
+	}
+	queued, err := q.Count(ctx)
+	if err != nil {
+		return fmt.Errorf("count queued pins: %w", err)
+	}
+
+	if queued >= max {
+		return fmt.Errorf("%w: %v of %v pins queued", ErrTooManyQueued, queued, max)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db/cids"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/job"
+	"github.com/DeedleFake/sips/ent/pin"
+)
+
+// Reconciliation is the result of comparing the pins in the database
+// with the CIDs that are actually pinned.
+type Reconciliation struct {
+	// Missing are the pins that are marked as pinned in the database
+	// but whose CIDs are not actually pinned.
+	Missing []*ent.Pin
+
+	// Orphans are the CIDs that are pinned but that no pin in the
+	// database refers to.
+	Orphans []string
+
+	// Events are the events recorded for the missing pins being
+	// requeued.
+	Events []*ent.PinEvent
+}
+
+// Reconcile compares pinned, the list of CIDs that are recursively
+// pinned, with the pins in the database. Unless dryRun is true, the
+// missing pins are queued to be pinned again. Orphaned CIDs are only
+// reported, as they might have been pinned by something other than
+// SIPS.
+func Reconcile(ctx context.Context, entc *ent.Client, pinned []string, dryRun bool) (Reconciliation, error) {
+	tx, err := entc.Tx(ctx)
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pinset := make(map[string]struct{}, len(pinned))
+	for _, cid := range pinned {
+		pinset[cids.Key(cid)] = struct{}{}
+	}
+
+	// Pins with jobs are left alone, as the job will either pin them
+	// or remove them anyways.
+	pins, err := tx.Pin.Query().
+		Where(
+			pin.StatusEQ(sips.Pinned),
+			pin.Not(pin.HasJobs()),
+		).
+		All(ctx)
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("query pinned pins: %w", err)
+	}
+
+	var r Reconciliation
+	for _, p := range pins {
+		if _, ok := pinset[cids.Key(p.CID)]; ok {
+			continue
+		}
+		r.Missing = append(r.Missing, p)
+
+		if dryRun {
+			continue
+		}
+
+		up, err := tx.Pin.UpdateOne(p).
+			SetStatus(sips.Queued).
+			ClearFinished().
+			Save(ctx)
+		if err != nil {
+			return Reconciliation{}, fmt.Errorf("update status of pin %v: %w", p.ID, err)
+		}
+		err = QueueAdd(ctx, tx, up)
+		if err != nil {
+			return Reconciliation{}, fmt.Errorf("queue add %v: %w", p.ID, err)
+		}
+		ev, err := QueueEvent(ctx, tx, up, EventQueued)
+		if err != nil {
+			return Reconciliation{}, err
+		}
+		if ev != nil {
+			r.Events = append(r.Events, ev)
+		}
+	}
+
+	known := make(map[string]struct{})
+	pincids, err := tx.Pin.Query().
+		Select(pin.FieldCID).
+		Strings(ctx)
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("query pin CIDs: %w", err)
+	}
+	for _, cid := range pincids {
+		known[cids.Key(cid)] = struct{}{}
+	}
+	oldcids, err := tx.Job.Query().
+		Where(job.OldCIDNEQ("")).
+		Select(job.FieldOldCID).
+		Strings(ctx)
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("query job CIDs: %w", err)
+	}
+	for _, cid := range oldcids {
+		known[cids.Key(cid)] = struct{}{}
+	}
+
+	for _, cid := range pinned {
+		if _, ok := known[cids.Key(cid)]; !ok {
+			r.Orphans = append(r.Orphans, cid)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return r, nil
+}
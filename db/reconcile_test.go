@@ -0,0 +1,48 @@
+//go:build sqlite3
+// +build sqlite3
+
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/ipfs/go-cid"
+)
+
+func TestReconcileCIDVersions(t *testing.T) {
+	entc, tn := setupTenants(t)
+	ctx := viewer.SystemContext(context.Background())
+
+	v0 := tn.alicePin.CID
+	c, err := cid.Decode(v0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := cid.NewCidV1(cid.DagProtobuf, c.Hash()).String()
+	orphan := "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+
+	entc.Pin.Update().SetStatus(sips.Pinned).ExecX(ctx)
+
+	r, err := db.Reconcile(ctx, entc, []string{v1, orphan}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Missing) != 0 {
+		t.Errorf("pins pinned as %v reported missing when %v is pinned", v0, v1)
+	}
+	if (len(r.Orphans) != 1) || (r.Orphans[0] != orphan) {
+		t.Errorf("got orphans %v, want [%v]", r.Orphans, orphan)
+	}
+
+	r, err = db.Reconcile(ctx, entc, []string{orphan}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Missing) != 3 {
+		t.Errorf("got %v missing pins, want 3", len(r.Missing))
+	}
+}
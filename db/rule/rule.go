@@ -0,0 +1,131 @@
+// Package rule contains the privacy rules used by the database schema.
+package rule
+
+import (
+	"context"
+
+	"github.com/DeedleFake/sips/db/viewer"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/organization"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/DeedleFake/sips/ent/predicate"
+	"github.com/DeedleFake/sips/ent/privacy"
+	"github.com/DeedleFake/sips/ent/token"
+	"github.com/DeedleFake/sips/ent/user"
+)
+
+// DenyIfNoViewer denies queries and mutations made with a context that
+// doesn't carry a viewer.
+func DenyIfNoViewer() privacy.QueryMutationRule {
+	return privacy.ContextQueryMutationRule(func(ctx context.Context) error {
+		if _, ok := viewer.FromContext(ctx); !ok {
+			return privacy.Denyf("no viewer in context")
+		}
+		return privacy.Skip
+	})
+}
+
+// AllowIfPrivileged allows admin and system viewers to do anything.
+func AllowIfPrivileged() privacy.QueryMutationRule {
+	return privacy.ContextQueryMutationRule(func(ctx context.Context) error {
+		if v, ok := viewer.FromContext(ctx); ok && v.Privileged() {
+			return privacy.Allow
+		}
+		return privacy.Skip
+	})
+}
+
+// pinsOf returns a predicate that matches the pins in v's namespace.
+func pinsOf(v viewer.Viewer) predicate.Pin {
+	if v.OrgID != 0 {
+		return pin.HasOrganizationWith(organization.ID(v.OrgID))
+	}
+	return pin.And(
+		pin.HasUserWith(user.ID(v.UserID)),
+		pin.Not(pin.HasOrganization()),
+	)
+}
+
+// tokensOf returns a predicate that matches the tokens that act in v's
+// namespace.
+func tokensOf(v viewer.Viewer) predicate.Token {
+	if v.OrgID != 0 {
+		return token.HasOrganizationWith(organization.ID(v.OrgID))
+	}
+	return token.And(
+		token.HasUserWith(user.ID(v.UserID)),
+		token.Not(token.HasOrganization()),
+	)
+}
+
+// FilterPins limits queries of pins to those in the viewer's
+// namespace.
+func FilterPins() privacy.PinQueryRuleFunc {
+	return func(ctx context.Context, q *ent.PinQuery) error {
+		v, ok := viewer.FromContext(ctx)
+		if !ok {
+			return privacy.Denyf("no viewer in context")
+		}
+		q.Where(pinsOf(v))
+		return privacy.Allow
+	}
+}
+
+// FilterPinMutations limits changes to pins to those in the viewer's
+// namespace, and only allows pins to be created in it.
+func FilterPinMutations() privacy.PinMutationRuleFunc {
+	return func(ctx context.Context, m *ent.PinMutation) error {
+		v, ok := viewer.FromContext(ctx)
+		if !ok {
+			return privacy.Denyf("no viewer in context")
+		}
+
+		if !m.Op().Is(ent.OpCreate) {
+			m.Where(pinsOf(v))
+			return privacy.Allow
+		}
+
+		uid, _ := m.UserID()
+		oid, _ := m.OrganizationID()
+		if (uid != v.UserID) || (oid != v.OrgID) {
+			return privacy.Denyf("pin created outside of viewer's namespace")
+		}
+		return privacy.Allow
+	}
+}
+
+// FilterTokens limits queries of tokens to those that act in the
+// viewer's namespace.
+func FilterTokens() privacy.TokenQueryRuleFunc {
+	return func(ctx context.Context, q *ent.TokenQuery) error {
+		v, ok := viewer.FromContext(ctx)
+		if !ok {
+			return privacy.Denyf("no viewer in context")
+		}
+		q.Where(tokensOf(v))
+		return privacy.Allow
+	}
+}
+
+// FilterTokenMutations limits changes to tokens to those that act in
+// the viewer's namespace, and only allows tokens to be created in it.
+func FilterTokenMutations() privacy.TokenMutationRuleFunc {
+	return func(ctx context.Context, m *ent.TokenMutation) error {
+		v, ok := viewer.FromContext(ctx)
+		if !ok {
+			return privacy.Denyf("no viewer in context")
+		}
+
+		if !m.Op().Is(ent.OpCreate) {
+			m.Where(tokensOf(v))
+			return privacy.Allow
+		}
+
+		uid, _ := m.UserID()
+		oid, _ := m.OrganizationID()
+		if (uid != v.UserID) || (oid != v.OrgID) {
+			return privacy.Denyf("token created outside of viewer's namespace")
+		}
+		return privacy.Allow
+	}
+}
@@ -0,0 +1,62 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"entgo.io/ent/schema/mixin"
+)
+
+type Delivery struct {
+	ent.Schema
+}
+
+func (Delivery) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		mixin.Time{},
+	}
+}
+
+func (Delivery) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("Event").
+			NotEmpty(),
+		field.Text("Payload"),
+		field.Enum("Status").
+			Values("pending", "delivered", "failed").
+			Default("pending"),
+		field.Int("Attempts").
+			Default(0).
+			NonNegative(),
+		field.Time("NextAttempt").
+			Default(time.Now),
+
+		// ResponseCode and LastError are the result of the most recent
+		// attempt.
+		field.Int("ResponseCode").
+			Optional().
+			Nillable(),
+		field.String("LastError").
+			Optional(),
+
+		field.Time("Delivered").
+			Optional().
+			Nillable(),
+	}
+}
+
+func (Delivery) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("Webhook", Webhook.Type).Ref("Deliveries").Unique().Required(),
+	}
+}
+
+func (Delivery) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("Status", "NextAttempt"),
+		index.Edges("Webhook"),
+	}
+}
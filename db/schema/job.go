@@ -0,0 +1,73 @@
+package schema
+
+import (
+	"context"
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"entgo.io/ent/schema/mixin"
+	"github.com/DeedleFake/sips/db/cids"
+	gen "github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/hook"
+)
+
+type Job struct {
+	ent.Schema
+}
+
+func (Job) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		mixin.Time{},
+	}
+}
+
+func (Job) Fields() []ent.Field {
+	return []ent.Field{
+		field.Enum("Action").
+			Values("add", "update", "delete"),
+		field.String("OldCID").
+			Optional().
+			Match(CIDRegexp),
+		// OldCIDKey is to OldCID what a pin's CIDKey is to its CID.
+		field.String("OldCIDKey").
+			Optional(),
+		field.Int("Attempts").
+			Default(0).
+			NonNegative(),
+		field.Time("NextAttempt").
+			Default(time.Now),
+	}
+}
+
+func (Job) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("Pin", Pin.Type).Ref("Jobs").Unique().Required(),
+	}
+}
+
+func (Job) Hooks() []ent.Hook {
+	return []ent.Hook{
+		hook.On(
+			func(next ent.Mutator) ent.Mutator {
+				return hook.JobFunc(func(ctx context.Context, m *gen.JobMutation) (gen.Value, error) {
+					if cid, ok := m.OldCID(); ok {
+						m.SetOldCIDKey(cids.Key(cid))
+					}
+					return next.Mutate(ctx, m)
+				})
+			},
+			ent.OpCreate|ent.OpUpdate|ent.OpUpdateOne,
+		),
+	}
+}
+
+func (Job) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("NextAttempt"),
+		index.Fields("OldCIDKey"),
+		index.Edges("Pin"),
+	}
+}
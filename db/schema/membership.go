@@ -0,0 +1,46 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"entgo.io/ent/schema/mixin"
+)
+
+// Membership is a user's membership in an organization.
+type Membership struct {
+	ent.Schema
+}
+
+func (Membership) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		mixin.Time{},
+	}
+}
+
+func (Membership) Fields() []ent.Field {
+	return []ent.Field{
+		// Role determines what the user may do with the organization's
+		// pins. Owners and members may add and remove them, while
+		// read-only members may only list them. Only owners may manage
+		// the organization's tokens.
+		field.Enum("Role").
+			Values("owner", "member", "readonly").
+			Default("member"),
+	}
+}
+
+func (Membership) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("User", User.Type).Ref("Memberships").Unique().Required(),
+		edge.From("Organization", Organization.Type).Ref("Memberships").Unique().Required(),
+	}
+}
+
+func (Membership) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Edges("User", "Organization").Unique(),
+		index.Edges("Organization"),
+	}
+}
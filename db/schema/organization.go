@@ -0,0 +1,53 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/mixin"
+)
+
+// Organization is a group of users that share a set of pins.
+type Organization struct {
+	ent.Schema
+}
+
+func (Organization) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		mixin.Time{},
+	}
+}
+
+func (Organization) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("Name").
+			NotEmpty().
+			Unique(),
+
+		// MaxPins and MaxBytes are the organization's quotas. If they are
+		// nil, there is no limit.
+		field.Int("MaxPins").
+			Optional().
+			Nillable().
+			NonNegative(),
+		field.Int64("MaxBytes").
+			Optional().
+			Nillable().
+			NonNegative(),
+
+		// EventSeq is the sequence number of the most recent of the
+		// organization's pin events.
+		field.Int("EventSeq").
+			Default(0).
+			NonNegative(),
+	}
+}
+
+func (Organization) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.To("Memberships", Membership.Type),
+		edge.To("Pins", Pin.Type),
+		edge.To("Tokens", Token.Type),
+		edge.To("PinEvents", PinEvent.Type),
+	}
+}
@@ -1,13 +1,20 @@
 package schema
 
 import (
+	"context"
 	"regexp"
 
 	"entgo.io/ent"
 	"entgo.io/ent/schema/edge"
 	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
 	"entgo.io/ent/schema/mixin"
 	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db/cids"
+	"github.com/DeedleFake/sips/db/rule"
+	gen "github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/hook"
+	"github.com/DeedleFake/sips/ent/privacy"
 )
 
 var CIDRegexp = regexp.MustCompile(`^[A-Za-z0-9-_=]+$`)
@@ -31,13 +38,77 @@ func (Pin) Fields() []ent.Field {
 			NotEmpty(),
 		field.String("CID").
 			Match(CIDRegexp),
+		// CIDKey identifies the content that CID refers to, so that pins
+		// of different CIDs for the same content can be found. It is set
+		// automatically whenever CID is.
+		field.String("CIDKey").
+			Optional(),
 		field.Strings("Origins").
 			Optional(),
+		field.JSON("Meta", map[string]string{}).
+			Optional(),
+		field.Int("Progress").
+			Default(0).
+			NonNegative(),
+		// Size is the total size of the pinned DAG in bytes, as
+		// measured once pinning has finished.
+		field.Int64("Size").
+			Default(0).
+			NonNegative(),
+		field.String("LastError").
+			Optional(),
+		field.Time("Started").
+			Optional().
+			Nillable(),
+		field.Time("Finished").
+			Optional().
+			Nillable(),
 	}
 }
 
 func (Pin) Edges() []ent.Edge {
 	return []ent.Edge{
+		// User is the user that created the pin. If the pin belongs to an
+		// organization, it is shared by the organization's members.
 		edge.From("User", User.Type).Ref("Pins").Unique(),
+		edge.From("Organization", Organization.Type).Ref("Pins").Unique(),
+		edge.To("Jobs", Job.Type),
+	}
+}
+
+func (Pin) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("CIDKey"),
+	}
+}
+
+func (Pin) Hooks() []ent.Hook {
+	return []ent.Hook{
+		hook.On(
+			func(next ent.Mutator) ent.Mutator {
+				return hook.PinFunc(func(ctx context.Context, m *gen.PinMutation) (gen.Value, error) {
+					if cid, ok := m.CID(); ok {
+						m.SetCIDKey(cids.Key(cid))
+					}
+					return next.Mutate(ctx, m)
+				})
+			},
+			ent.OpCreate|ent.OpUpdate|ent.OpUpdateOne,
+		),
+	}
+}
+
+func (Pin) Policy() ent.Policy {
+	return privacy.Policy{
+		Query: privacy.QueryPolicy{
+			rule.DenyIfNoViewer(),
+			rule.AllowIfPrivileged(),
+			rule.FilterPins(),
+		},
+		Mutation: privacy.MutationPolicy{
+			rule.DenyIfNoViewer(),
+			rule.AllowIfPrivileged(),
+			rule.FilterPinMutations(),
+		},
 	}
 }
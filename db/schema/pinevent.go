@@ -0,0 +1,51 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"entgo.io/ent/schema/mixin"
+)
+
+// PinEvent is a change in the status of one of a user's or an
+// organization's pins. A limited history is kept so that clients
+// streaming events can resume where they left off.
+type PinEvent struct {
+	ent.Schema
+}
+
+func (PinEvent) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		mixin.CreateTime{},
+	}
+}
+
+func (PinEvent) Fields() []ent.Field {
+	return []ent.Field{
+		// Seq orders the events of a single user or organization.
+		field.Int("Seq").
+			Positive(),
+		field.String("Type").
+			NotEmpty(),
+
+		// Payload is the JSON-encoded status of the pin after the event.
+		field.Text("Payload"),
+	}
+}
+
+func (PinEvent) Edges() []ent.Edge {
+	return []ent.Edge{
+		// An event belongs to either a user or an organization,
+		// depending on who its pin belongs to.
+		edge.From("User", User.Type).Ref("PinEvents").Unique(),
+		edge.From("Organization", Organization.Type).Ref("PinEvents").Unique(),
+	}
+}
+
+func (PinEvent) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("Seq").Edges("User").Unique(),
+		index.Fields("Seq").Edges("Organization").Unique(),
+	}
+}
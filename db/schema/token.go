@@ -8,9 +8,14 @@ import (
 	"entgo.io/ent/schema/field"
 	"entgo.io/ent/schema/index"
 	"entgo.io/ent/schema/mixin"
+	"github.com/DeedleFake/sips/db/rule"
+	"github.com/DeedleFake/sips/ent/privacy"
 )
 
-var TokenRegexp = regexp.MustCompile(`^[A-Za-z0-9-_=]{43,44}$`)
+var (
+	TokenRegexp     = regexp.MustCompile(`^[A-Za-z0-9-_=]{43,44}$`)
+	TokenHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
 
 type Token struct {
 	ent.Schema
@@ -24,23 +29,70 @@ func (Token) Mixin() []ent.Mixin {
 
 func (Token) Fields() []ent.Field {
 	return []ent.Field{
+		// Token is the plaintext token. It is only present for tokens
+		// that were created before tokens were hashed and have not been
+		// migrated yet.
 		field.String("Token").
-			Immutable().
+			Optional().
+			Nillable().
 			Match(TokenRegexp).
 			Sensitive().
 			Unique(),
+		field.String("Hash").
+			Optional().
+			Match(TokenHashRegexp).
+			Sensitive().
+			Unique(),
+		field.String("Prefix").
+			Optional(),
+		// Label is a name given to the token by whoever created it to
+		// help them tell it apart from their others.
+		field.String("Label").
+			Optional().
+			MaxLen(255),
+		field.Time("Expires").
+			Optional().
+			Nillable(),
+		field.Strings("Scopes").
+			Optional(),
+		field.Time("LastUsed").
+			Optional().
+			Nillable(),
+		field.String("LastIP").
+			Optional(),
 	}
 }
 
 func (Token) Edges() []ent.Edge {
 	return []ent.Edge{
 		edge.From("User", User.Type).Ref("Tokens").Unique(),
+
+		// Organization, if set, is the organization that the token acts
+		// on behalf of. Its user must be a member of it.
+		edge.From("Organization", Organization.Type).Ref("Tokens").Unique(),
 	}
 }
 
 func (Token) Indexes() []ent.Index {
 	return []ent.Index{
 		index.Fields("Token").Unique(),
+		index.Fields("Hash").Unique(),
 		index.Edges("User"),
+		index.Edges("Organization"),
+	}
+}
+
+func (Token) Policy() ent.Policy {
+	return privacy.Policy{
+		Query: privacy.QueryPolicy{
+			rule.DenyIfNoViewer(),
+			rule.AllowIfPrivileged(),
+			rule.FilterTokens(),
+		},
+		Mutation: privacy.MutationPolicy{
+			rule.DenyIfNoViewer(),
+			rule.AllowIfPrivileged(),
+			rule.FilterTokenMutations(),
+		},
 	}
 }
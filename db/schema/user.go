@@ -22,6 +22,23 @@ func (User) Fields() []ent.Field {
 		field.String("Name").
 			NotEmpty().
 			Unique(),
+
+		// MaxPins and MaxBytes are the user's quotas. If they are nil,
+		// there is no limit.
+		field.Int("MaxPins").
+			Optional().
+			Nillable().
+			NonNegative(),
+		field.Int64("MaxBytes").
+			Optional().
+			Nillable().
+			NonNegative(),
+
+		// EventSeq is the sequence number of the most recent of the
+		// user's pin events.
+		field.Int("EventSeq").
+			Default(0).
+			NonNegative(),
 	}
 }
 
@@ -29,5 +46,8 @@ func (User) Edges() []ent.Edge {
 	return []ent.Edge{
 		edge.To("Tokens", Token.Type),
 		edge.To("Pins", Pin.Type),
+		edge.To("Webhooks", Webhook.Type),
+		edge.To("PinEvents", PinEvent.Type),
+		edge.To("Memberships", Membership.Type),
 	}
 }
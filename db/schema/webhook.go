@@ -0,0 +1,50 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"entgo.io/ent/schema/mixin"
+)
+
+type Webhook struct {
+	ent.Schema
+}
+
+func (Webhook) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		mixin.Time{},
+	}
+}
+
+func (Webhook) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("URL").
+			NotEmpty(),
+
+		// Secret is the key used to sign deliveries so that the receiver
+		// can verify that they came from SIPS.
+		field.String("Secret").
+			NotEmpty().
+			Sensitive(),
+
+		// Events are the types of events that are sent to the webhook.
+		// If it is empty, every event is sent.
+		field.Strings("Events").
+			Optional(),
+	}
+}
+
+func (Webhook) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("User", User.Type).Ref("Webhooks").Unique().Required(),
+		edge.To("Deliveries", Delivery.Type),
+	}
+}
+
+func (Webhook) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Edges("User"),
+	}
+}
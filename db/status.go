@@ -0,0 +1,52 @@
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/ent"
+)
+
+// PinStatus returns the status of p as it is reported to clients.
+func PinStatus(p *ent.Pin, delegates []string) sips.PinStatus {
+	return sips.PinStatus{
+		RequestID: strconv.FormatInt(int64(p.ID), 16),
+		Status:    p.Status,
+		Created:   p.CreateTime,
+		Delegates: delegates,
+		Info:      pinInfo(p),
+		Pin: sips.Pin{
+			CID:     p.CID,
+			Name:    p.Name,
+			Origins: p.Origins,
+			Meta:    p.Meta,
+		},
+	}
+}
+
+// pinInfo returns the extra info about the pinning process that is
+// sent to the client along with a pin's status.
+func pinInfo(p *ent.Pin) map[string]string {
+	info := make(map[string]string)
+	if p.Progress > 0 {
+		info["blocks_fetched"] = strconv.FormatInt(int64(p.Progress), 10)
+	}
+	if p.Size > 0 {
+		info["size"] = strconv.FormatInt(p.Size, 10)
+	}
+	if p.LastError != "" {
+		info["error"] = p.LastError
+	}
+	if p.Started != nil {
+		info["started"] = p.Started.Format(time.RFC3339)
+	}
+	if p.Finished != nil {
+		info["finished"] = p.Finished.Format(time.RFC3339)
+	}
+
+	if len(info) == 0 {
+		return nil
+	}
+	return info
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/token"
+)
+
+// tokenPrefix is prepended to newly generated tokens to make them
+// easier to recognize.
+const tokenPrefix = "sips_"
+
+// tokenPrefixLen is the number of characters of a token, not
+// including tokenPrefix, that are stored in plaintext in order to
+// identify it.
+const tokenPrefixLen = 8
+
+// Scope is a permission that can be granted to a token. Every token
+// can read, regardless of the scopes that it has been granted, so
+// scopes only limit what a token can change.
+type Scope string
+
+const (
+	// ScopeRead allows listing and getting the status of pins. Every
+	// token is allowed to read, so granting it only matters to tokens
+	// that should have no other scopes. See ScopesAllow.
+	ScopeRead Scope = "read"
+
+	// ScopePin allows adding and updating pins.
+	ScopePin Scope = "pin"
+
+	// ScopeUnpin allows deleting pins.
+	ScopeUnpin Scope = "unpin"
+
+	// ScopeAdmin allows everything.
+	ScopeAdmin Scope = "admin"
+)
+
+// DefaultScopes are the scopes given to tokens that don't specify any,
+// including those created before scopes existed.
+var DefaultScopes = []Scope{ScopeRead, ScopePin, ScopeUnpin}
+
+// ParseScope parses a scope from a string.
+func ParseScope(str string) (Scope, error) {
+	switch s := Scope(str); s {
+	case ScopeRead, ScopePin, ScopeUnpin, ScopeAdmin:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid scope: %q", str)
+	}
+}
+
+// TokenScopes returns the scopes granted to tok.
+func TokenScopes(tok *ent.Token) []Scope {
+	if len(tok.Scopes) == 0 {
+		return DefaultScopes
+	}
+
+	scopes := make([]Scope, 0, len(tok.Scopes))
+	for _, s := range tok.Scopes {
+		scopes = append(scopes, Scope(s))
+	}
+	return scopes
+}
+
+// TokenAllows returns true if tok has been granted scope.
+func TokenAllows(tok *ent.Token, scope Scope) bool {
+	return ScopesAllow(TokenScopes(tok), scope)
+}
+
+// ScopesAllow returns true if scope is allowed by any of scopes.
+// ScopeRead is always allowed, even if scopes is empty.
+func ScopesAllow(scopes []Scope, scope Scope) bool {
+	if scope == ScopeRead {
+		return true
+	}
+
+	for _, s := range scopes {
+		if (s == scope) || (s == ScopeAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenExpired returns true if tok has expired as of now.
+func TokenExpired(tok *ent.Token, now time.Time) bool {
+	return (tok.Expires != nil) && !now.Before(*tok.Expires)
+}
+
+// NewToken generates a new random token.
+func NewToken() (string, error) {
+	var buf [32]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", fmt.Errorf("generate random bytes for token: %w", err)
+	}
+
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// HashToken returns the keyed hash of tok that is stored in the
+// database in place of the token itself.
+func HashToken(key []byte, tok string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(tok))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TokenPrefix returns the non-secret part of tok that is stored in
+// the database so that it can be identified by admins.
+func TokenPrefix(tok string) string {
+	n := tokenPrefixLen
+	if strings.HasPrefix(tok, tokenPrefix) {
+		n += len(tokenPrefix)
+	}
+	if len(tok) < n {
+		return tok
+	}
+	return tok[:n]
+}
+
+// LoadTokenKey reads the key used for hashing tokens from the file at
+// path. Leading and trailing whitespace is ignored. If the file doesn't
+// exist, a new random key is generated and written to it, readable
+// only by the current user, unless entc already has hashed tokens, as
+// they must have been hashed with some other key and would no longer
+// work. It returns true if a new key was generated.
+func LoadTokenKey(ctx context.Context, entc *ent.Client, path string) (key []byte, created bool, err error) {
+	if path == "" {
+		return nil, false, errors.New("no token key file given")
+	}
+
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		key = []byte(strings.TrimSpace(string(buf)))
+		if len(key) == 0 {
+			return nil, false, fmt.Errorf("token key file %q is empty", path)
+		}
+		return key, false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+
+	hashed, err := entc.Token.Query().
+		Where(token.HashNEQ("")).
+		Exist(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("check for hashed tokens: %w", err)
+	}
+	if hashed {
+		return nil, false, fmt.Errorf("token key file %q does not exist, but the database already has hashed tokens, which would stop working with a new key", path)
+	}
+
+	var raw [32]byte
+	_, err = rand.Read(raw[:])
+	if err != nil {
+		return nil, false, fmt.Errorf("generate random bytes for token key: %w", err)
+	}
+	key = []byte(base64.StdEncoding.EncodeToString(raw[:]))
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, false, fmt.Errorf("create token key directory: %w", err)
+	}
+	err = os.WriteFile(path, append(key, '\n'), 0600)
+	if err != nil {
+		return nil, false, fmt.Errorf("write token key file: %w", err)
+	}
+	return key, true, nil
+}
+
+// HashTokens migrates tokens that are stored in plaintext, replacing
+// them with their hashes and prefixes. It returns the number of tokens
+// that were migrated.
+func HashTokens(ctx context.Context, entc *ent.Client, key []byte) (int, error) {
+	tx, err := entc.Tx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	toks, err := tx.Token.Query().
+		Where(token.TokenNotNil()).
+		All(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("query plaintext tokens: %w", err)
+	}
+
+	for _, tok := range toks {
+		err := tx.Token.UpdateOne(tok).
+			ClearToken().
+			SetHash(HashToken(key, *tok.Token)).
+			SetPrefix(TokenPrefix(*tok.Token)).
+			Exec(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("hash token %v: %w", tok.ID, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return len(toks), nil
+}
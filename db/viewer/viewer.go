@@ -0,0 +1,73 @@
+// Package viewer describes who database queries are made on behalf
+// of. The privacy policies of the database schema use it to keep the
+// pins and tokens of each user and organization out of reach of every
+// other.
+package viewer
+
+import "context"
+
+// Role is the kind of viewer that is making a query.
+type Role int
+
+const (
+	// RoleUser is a user acting either in their own namespace or on
+	// behalf of an organization. It may only see and change what
+	// belongs to that namespace.
+	RoleUser Role = iota
+
+	// RoleAdmin is an operator administrating the service, such as
+	// through sipsctl or the admin API. It may see and change anything.
+	RoleAdmin
+
+	// RoleSystem is the service itself, such as the pin queue or the
+	// lookup of a token before it is known who it belongs to. It may
+	// see and change anything.
+	RoleSystem
+)
+
+// Viewer is who a query is being made on behalf of.
+type Viewer struct {
+	Role Role
+
+	// UserID is the ID of the user acting, if Role is RoleUser.
+	UserID int
+
+	// OrgID is the ID of the organization that the user is acting on
+	// behalf of, or zero if they are acting in their own namespace.
+	OrgID int
+}
+
+// Privileged returns true if v may see and change anything.
+func (v Viewer) Privileged() bool {
+	return (v.Role == RoleAdmin) || (v.Role == RoleSystem)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying v.
+func NewContext(ctx context.Context, v Viewer) context.Context {
+	return context.WithValue(ctx, contextKey{}, v)
+}
+
+// FromContext returns the viewer carried by ctx, if any.
+func FromContext(ctx context.Context) (Viewer, bool) {
+	v, ok := ctx.Value(contextKey{}).(Viewer)
+	return v, ok
+}
+
+// UserContext returns a context for the user with the ID uid acting
+// in the namespace of the organization with the ID oid, or in their
+// own if oid is zero.
+func UserContext(ctx context.Context, uid, oid int) context.Context {
+	return NewContext(ctx, Viewer{Role: RoleUser, UserID: uid, OrgID: oid})
+}
+
+// AdminContext returns a context for an operator.
+func AdminContext(ctx context.Context) context.Context {
+	return NewContext(ctx, Viewer{Role: RoleAdmin})
+}
+
+// SystemContext returns a context for the service itself.
+func SystemContext(ctx context.Context) context.Context {
+	return NewContext(ctx, Viewer{Role: RoleSystem})
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/delivery"
+	"github.com/DeedleFake/sips/ent/predicate"
+)
+
+// WebhookWants returns true if events of type t should be sent to
+// hook.
+func WebhookWants(hook *ent.Webhook, t EventType) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == string(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWebhookSecret generates a new random secret for signing webhook
+// deliveries.
+func NewWebhookSecret() (string, error) {
+	var buf [32]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", fmt.Errorf("generate random bytes for webhook secret: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// SignPayload returns the signature of a webhook delivery's payload,
+// which is the hex-encoded HMAC-SHA256, keyed with the webhook's
+// secret, of the delivery's timestamp in decimal Unix seconds, a
+// period, and the payload. The timestamp is sent along with the
+// delivery so that receivers can reject deliveries that are too old,
+// as they may have been replayed.
+func SignPayload(secret string, timestamp time.Time, payload []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	h.Write([]byte{'.'})
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DeleteWebhooks deletes the webhooks matching ps, along with their
+// deliveries, returning the number of webhooks deleted.
+func DeleteWebhooks(ctx context.Context, tx *ent.Tx, ps ...predicate.Webhook) (int, error) {
+	_, err := tx.Delivery.Delete().
+		Where(delivery.HasWebhookWith(ps...)).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("delete deliveries: %w", err)
+	}
+
+	n, err := tx.Webhook.Delete().
+		Where(ps...).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("delete webhooks: %w", err)
+	}
+	return n, nil
+}
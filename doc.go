@@ -5,4 +5,8 @@
 // around the PinHandler interface. An implementation of this
 // interface can be passed to the Handler function in order to create
 // an HTTP handler that serves a valid pinning service.
+//
+// The package also provides Client, which implements PinHandler by
+// making requests to an existing pinning service, for use either
+// directly or as a PinHandler for a proxy.
 package sips
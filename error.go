@@ -0,0 +1,83 @@
+package sips
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Error is an error returned by a pinning service in response to a
+// request made by a Client. It implements both StatusError and
+// ReasonError, so if it is returned from a PinHandler, such as when
+// proxying, the original status and reason are passed on to the client.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Mnemonic is the reason given by the service, such as
+	// "NOT_FOUND" or "INSUFFICIENT_FUNDS".
+	Mnemonic string
+
+	// Details is the optional human-readable description of the
+	// error given by the service.
+	Details string
+
+	// Wait is how long the service asked the client to wait before
+	// trying again via the Retry-After header, if it did.
+	Wait time.Duration
+}
+
+func newError(status int, body []byte) *Error {
+	err := Error{StatusCode: status}
+
+	var rsp errorResponse
+	if json.Unmarshal(body, &rsp) == nil && rsp.Error.Reason != "" {
+		err.Mnemonic = rsp.Error.Reason
+		err.Details = rsp.Error.Details
+		return &err
+	}
+
+	err.Mnemonic = reasonFromStatus(status)
+	err.Details = strings.TrimSpace(string(body))
+	return &err
+}
+
+// Error returns the details given by the service, or a description
+// of the status if there weren't any. The details are returned
+// verbatim so that the error can be passed on to clients unchanged
+// when proxying.
+func (err *Error) Error() string {
+	if err.Details == "" {
+		return fmt.Sprintf("pinning service error (%v): %v", err.StatusCode, err.Mnemonic)
+	}
+	return err.Details
+}
+
+func (err *Error) Status() int {
+	return err.StatusCode
+}
+
+func (err *Error) Reason() string {
+	return err.Mnemonic
+}
+
+func (err *Error) RetryAfter() time.Duration {
+	return err.Wait
+}
+
+// IsNotFound returns true if err is an *Error that indicates that the
+// requested pinning request doesn't exist.
+func IsNotFound(err error) bool {
+	var serr *Error
+	return errors.As(err, &serr) && (serr.StatusCode == http.StatusNotFound)
+}
+
+// IsUnauthorized returns true if err is an *Error that indicates that
+// the token used was missing or invalid.
+func IsUnauthorized(err error) bool {
+	var serr *Error
+	return errors.As(err, &serr) && (serr.StatusCode == http.StatusUnauthorized)
+}
@@ -0,0 +1,114 @@
+package sips
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// keepaliveInterval is how often a comment is sent on an otherwise
+// idle event stream so that proxies don't close it.
+const keepaliveInterval = 30 * time.Second
+
+// PinEvent is a change in the status of a pinning request.
+type PinEvent struct {
+	// ID identifies the event in the stream that it was sent on. It is
+	// sent back by clients that are resuming the stream.
+	ID string
+
+	// Type is the type of change, such as "pin.pinned".
+	Type string
+
+	// Status is the status of the request after the change.
+	Status PinStatus
+}
+
+// PinEventHandler may be implemented by a PinHandler to stream
+// changes in the status of pinning requests to clients. If it is, the
+// handler returned by Handler serves the stream as server-sent events
+// at "/pins/events".
+type PinEventHandler interface {
+	// PinEvents returns a channel that events for the client's pins are
+	// sent on. If lastEventID is not empty, the stream should resume
+	// with the event after the one with that ID. Otherwise, only new
+	// events should be sent. The channel should be closed when ctx is
+	// canceled.
+	//
+	// The context is set up in the same way as it is for the methods of
+	// PinHandler, and errors are handled in the same way.
+	PinEvents(ctx context.Context, lastEventID string) (<-chan PinEvent, error)
+}
+
+func (h handler) getPinEvents(rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		respondError(rw, http.StatusInternalServerError, errNoStreaming)
+		return
+	}
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if strings.ContainsAny(lastEventID, "\r\n") {
+		respondError(rw, http.StatusBadRequest, errInvalidLastEventID)
+		return
+	}
+
+	events, err := h.h.(PinEventHandler).PinEvents(ctx, lastEventID)
+	if err != nil {
+		respondError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(ev.Status)
+			if err != nil {
+				return
+			}
+
+			_, err = writeEvent(rw, ev.ID, ev.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-keepalive.C:
+			_, err := rw.Write([]byte(":\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a single server-sent event. data must not contain
+// any newlines, which JSON never does.
+func writeEvent(rw http.ResponseWriter, id, typ string, data []byte) (int, error) {
+	buf := make([]byte, 0, len(id)+len(typ)+len(data)+24)
+	buf = append(buf, "id: "...)
+	buf = append(buf, id...)
+	buf = append(buf, "\nevent: "...)
+	buf = append(buf, typ...)
+	buf = append(buf, "\ndata: "...)
+	buf = append(buf, data...)
+	buf = append(buf, "\n\n"...)
+	return rw.Write(buf)
+}
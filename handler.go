@@ -2,25 +2,57 @@ package sips
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/DeedleFake/sips/internal/metrics"
 	"github.com/gorilla/mux"
 )
 
+var (
+	requestsTotal = metrics.NewCounter(
+		"sips_http_requests_total",
+		"Number of pinning service requests handled, by route and status code.",
+		"method", "route", "code",
+	)
+	requestDuration = metrics.NewHistogram(
+		"sips_http_request_duration_seconds",
+		"Time taken to handle pinning service requests, by route.",
+		nil,
+		"method", "route",
+	)
+)
+
 var (
 	errNoToken            = errors.New("no bearer token provided")
-	errInvalidStatusQuery = errors.New("status list must be non-empty and have at most 4 elements")
+	errInvalidStatusQuery = errors.New("status list must have at most 4 elements")
+	errInvalidLimit       = errors.New("limit must be between 1 and 1000")
 	errNoRequestID        = errors.New("request ID is required")
+	errNoCID              = errors.New("pin CID is required")
+	errNameTooLong        = errors.New("pin name must be at most 255 characters")
+	errNoStreaming        = errors.New("streaming is not supported")
+	errInvalidLastEventID = errors.New("invalid Last-Event-ID")
+	errNoTokenPrefix      = errors.New("token prefix is required")
+	errLabelTooLong       = errors.New("token label must be at most 255 characters")
 )
 
-type ctxKeyToken struct{}
+type (
+	ctxKeyToken      struct{}
+	ctxKeyRemoteAddr struct{}
+	ctxKeyRequestID  struct{}
+	ctxKeyClientCert struct{}
+)
 
 func withToken(ctx context.Context, token string) context.Context {
 	return context.WithValue(ctx, ctxKeyToken{}, token)
@@ -32,6 +64,73 @@ func Token(ctx context.Context) (string, bool) {
 	return tok, ok
 }
 
+func withRemoteAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, ctxKeyRemoteAddr{}, addr)
+}
+
+// RemoteAddr returns the IP address of the client that made the
+// request associated with the context.
+func RemoteAddr(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(ctxKeyRemoteAddr{}).(string)
+	return addr, ok
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestID{}, id)
+}
+
+// RequestID returns the ID of the request associated with the
+// context. The ID is taken from the request's X-Request-ID header if
+// it has a reasonable one, and is otherwise generated randomly. Either
+// way, it is sent back to the client in the same header so that the
+// request can be correlated with the service's logs.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ctxKeyRequestID{}).(string)
+	return id, ok
+}
+
+func requestIDFromRequest(req *http.Request) string {
+	id := req.Header.Get("X-Request-ID")
+	if validRequestID(id) {
+		return id
+	}
+
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+func validRequestID(id string) bool {
+	if (id == "") || (len(id) > 64) {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case (c >= 'a') && (c <= 'z'), (c >= 'A') && (c <= 'Z'), (c >= '0') && (c <= '9'), c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func withClientCertificate(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, ctxKeyClientCert{}, cert)
+}
+
+// ClientCertificate returns the verified TLS certificate that the
+// client presented, if any, for the request associated with the
+// context.
+func ClientCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	cert, ok := ctx.Value(ctxKeyClientCert{}).(*x509.Certificate)
+	return cert, ok
+}
+
+func hasClientCertificate(ctx context.Context) bool {
+	_, ok := ClientCertificate(ctx)
+	return ok
+}
+
 func tokenFromRequest(req *http.Request) (string, bool) {
 	auth := req.Header.Get("Authorization")
 	if auth == "" {
@@ -54,8 +153,12 @@ func tokenFromRequest(req *http.Request) (string, bool) {
 //
 // Every method is called after the authentication token is pulled
 // from HTTP headers, so it can be assumed that a token is included in
-// the provided context. It should not, however, be assumed that the
-// token is valid.
+// the provided context unless the client presented a verified TLS
+// certificate instead, which can be retrieved with ClientCertificate.
+// It should not, however, be assumed that the token is valid. The
+// address of the client, if known, is also included and can be
+// retrieved with RemoteAddr, as is a unique ID for the request that
+// can be retrieved with RequestID.
 //
 // Errors returned by a PinHandler's methods are returned to the
 // client verbatim, so implementations should be careful not to
@@ -64,12 +167,11 @@ func tokenFromRequest(req *http.Request) (string, bool) {
 // whatever the error's Status method returns.
 type PinHandler interface {
 	// Pins returns a list of pinning request statuses based on the
-	// given query.
-	//
-	// BUG: Doesn't properly allow a differenation between number of
-	// results returned and total number of results, thus breaking
-	// paging.
-	Pins(ctx context.Context, query PinQuery) ([]PinStatus, error)
+	// given query. The Count field of the returned list should be the
+	// total number of requests that match the query, ignoring its
+	// Limit, so that clients can page through the results using the
+	// Before field of the query.
+	Pins(ctx context.Context, query PinQuery) (PinList, error)
 
 	// AddPin adds a new pin to the service's backend.
 	AddPin(ctx context.Context, pin Pin) (PinStatus, error)
@@ -84,30 +186,78 @@ type PinHandler interface {
 	DeletePin(ctx context.Context, requestID string) error
 }
 
+// DefaultMaxBodySize is the default limit on the size of request
+// bodies. See WithMaxBodySize.
+const DefaultMaxBodySize = 1 << 20
+
 type handler struct {
-	h PinHandler
+	h       PinHandler
+	maxBody int64
+}
+
+// HandlerOption configures the handler returned by Handler.
+type HandlerOption func(*handler)
+
+// WithMaxBodySize limits the size of request bodies to n bytes.
+// Larger requests are rejected with a 413 Request Entity Too Large
+// status. If n is zero or less, there is no limit. The default is
+// DefaultMaxBodySize.
+func WithMaxBodySize(n int64) HandlerOption {
+	return func(h *handler) {
+		h.maxBody = n
+	}
 }
 
 // Handler returns a new HTTP handler that uses h to handle pinning
 // service requests. It will handle requests to the "/pins" path and
 // related subpaths, so the user does not need to strip the prefix in
-// order to use it.
-func Handler(h PinHandler) http.Handler {
+// order to use it. If h implements PinEventHandler, it also serves an
+// event stream at "/pins/events", and if it implements TokenHandler,
+// it also serves "/tokens".
+func Handler(h PinHandler, options ...HandlerOption) http.Handler {
 	r := mux.NewRouter()
 
-	handler := handler{h: h}
+	handler := handler{
+		h:       h,
+		maxBody: DefaultMaxBodySize,
+	}
+	for _, option := range options {
+		option(&handler)
+	}
+
 	r.Methods("GET", "OPTIONS").Path("/pins").HandlerFunc(handler.getPins)
 	r.Methods("POST", "OPTIONS").Path("/pins").HandlerFunc(handler.postPins)
+	if _, ok := h.(PinEventHandler); ok {
+		r.Methods("GET", "OPTIONS").Path("/pins/events").HandlerFunc(handler.getPinEvents)
+	}
+	if _, ok := h.(TokenHandler); ok {
+		r.Methods("GET", "OPTIONS").Path("/tokens").HandlerFunc(handler.getTokens)
+		r.Methods("POST", "OPTIONS").Path("/tokens").HandlerFunc(handler.postTokens)
+		r.Methods("DELETE", "OPTIONS").Path("/tokens/{prefix}").HandlerFunc(handler.deleteTokenByPrefix)
+	}
 	r.Methods("GET", "OPTIONS").Path("/pins/{requestID}").HandlerFunc(handler.getPinByID)
 	r.Methods("POST", "OPTIONS").Path("/pins/{requestID}").HandlerFunc(handler.postPinByID)
 	r.Methods("DELETE", "OPTIONS").Path("/pins/{requestID}").HandlerFunc(handler.deletePinByID)
+	r.Use(instrument)
 	r.Use(mux.CORSMethodMiddleware(r))
 	r.Use(func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			rw.Header().Set("Content-Type", "application/json")
 
+			id := requestIDFromRequest(req)
+			rw.Header().Set("X-Request-ID", id)
+			ctx := withRequestID(req.Context(), id)
+
+			if (req.TLS != nil) && (len(req.TLS.VerifiedChains) > 0) {
+				ctx = withClientCertificate(ctx, req.TLS.VerifiedChains[0][0])
+			}
+
 			token, ok := tokenFromRequest(req)
-			if !ok {
+			switch {
+			case ok:
+				ctx = withToken(ctx, token)
+
+			case !hasClientCertificate(ctx):
 				respondError(
 					rw,
 					http.StatusUnauthorized,
@@ -115,7 +265,15 @@ func Handler(h PinHandler) http.Handler {
 				)
 				return
 			}
-			req = req.WithContext(withToken(req.Context(), token))
+
+			if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				ctx = withRemoteAddr(ctx, host)
+			}
+			req = req.WithContext(ctx)
+
+			if (req.Body != nil) && (handler.maxBody > 0) {
+				req.Body = http.MaxBytesReader(rw, req.Body, handler.maxBody)
+			}
 
 			h.ServeHTTP(rw, req)
 		})
@@ -124,6 +282,52 @@ func Handler(h PinHandler) http.Handler {
 	return r
 }
 
+// instrument is a middleware that records metrics about requests.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		route := "unknown"
+		if r := mux.CurrentRoute(req); r != nil {
+			if tmpl, err := r.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		sr := statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(&sr, req)
+
+		requestDuration.With(req.Method, route).Since(start)
+		requestsTotal.With(req.Method, route, strconv.FormatInt(int64(sr.status), 10)).Inc()
+	})
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the status
+// code that was written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (rw *statusRecorder) WriteHeader(status int) {
+	if !rw.wrote {
+		rw.status = status
+		rw.wrote = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *statusRecorder) Write(buf []byte) (int, error) {
+	rw.wrote = true
+	return rw.ResponseWriter.Write(buf)
+}
+
+func (rw *statusRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (h handler) getPins(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 
@@ -161,17 +365,28 @@ func (h handler) getPins(rw http.ResponseWriter, req *http.Request) {
 		query.Match = match
 	}
 
-	status := strings.SplitN(q.Get("status"), ",", 5)
-	if (len(status) == 0) || (len(status) > 4) {
-		respondError(
-			rw,
-			http.StatusBadRequest,
-			errInvalidStatusQuery,
-		)
-		return
-	}
-	for _, v := range status {
-		query.Status = append(query.Status, RequestStatus(v))
+	if status := q.Get("status"); status != "" {
+		statuses := strings.SplitN(status, ",", 5)
+		if len(statuses) > 4 {
+			respondError(
+				rw,
+				http.StatusBadRequest,
+				errInvalidStatusQuery,
+			)
+			return
+		}
+		for _, v := range statuses {
+			status := RequestStatus(v)
+			if !status.valid() {
+				respondError(
+					rw,
+					http.StatusBadRequest,
+					fmt.Errorf("invalid status: %q", status),
+				)
+				return
+			}
+			query.Status = append(query.Status, status)
+		}
 	}
 
 	before := q.Get("before")
@@ -213,6 +428,14 @@ func (h handler) getPins(rw http.ResponseWriter, req *http.Request) {
 			)
 			return
 		}
+		if (plimit < 1) || (plimit > 1000) {
+			respondError(
+				rw,
+				http.StatusBadRequest,
+				errInvalidLimit,
+			)
+			return
+		}
 		query.Limit = int(plimit)
 	}
 
@@ -234,18 +457,11 @@ func (h handler) getPins(rw http.ResponseWriter, req *http.Request) {
 		respondError(rw, http.StatusInternalServerError, err)
 		return
 	}
-
-	err = json.NewEncoder(rw).Encode(struct {
-		Count   int         `json:"count"`
-		Results []PinStatus `json:"results"`
-	}{
-		Count:   len(pins),
-		Results: pins,
-	})
-	if err != nil {
-		respondError(rw, http.StatusInternalServerError, err)
-		return
+	if pins.Results == nil {
+		pins.Results = []PinStatus{}
 	}
+
+	respond(rw, http.StatusOK, pins)
 }
 
 func (h handler) postPins(rw http.ResponseWriter, req *http.Request) {
@@ -253,7 +469,7 @@ func (h handler) postPins(rw http.ResponseWriter, req *http.Request) {
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		respondError(rw, http.StatusInternalServerError, err)
+		respondError(rw, bodyErrorStatus(err), err)
 		return
 	}
 
@@ -267,18 +483,19 @@ func (h handler) postPins(rw http.ResponseWriter, req *http.Request) {
 		)
 		return
 	}
-
-	status, err := h.h.AddPin(ctx, pin)
+	err = pin.validate()
 	if err != nil {
-		respondError(rw, http.StatusInternalServerError, err)
+		respondError(rw, http.StatusBadRequest, err)
 		return
 	}
 
-	err = json.NewEncoder(rw).Encode(status)
+	status, err := h.h.AddPin(ctx, pin)
 	if err != nil {
 		respondError(rw, http.StatusInternalServerError, err)
 		return
 	}
+
+	respond(rw, http.StatusAccepted, status)
 }
 
 func (h handler) getPinByID(rw http.ResponseWriter, req *http.Request) {
@@ -301,11 +518,7 @@ func (h handler) getPinByID(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = json.NewEncoder(rw).Encode(status)
-	if err != nil {
-		respondError(rw, http.StatusInternalServerError, err)
-		return
-	}
+	respond(rw, http.StatusOK, status)
 }
 
 func (h handler) postPinByID(rw http.ResponseWriter, req *http.Request) {
@@ -324,7 +537,7 @@ func (h handler) postPinByID(rw http.ResponseWriter, req *http.Request) {
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		respondError(rw, http.StatusInternalServerError, err)
+		respondError(rw, bodyErrorStatus(err), err)
 		return
 	}
 
@@ -338,18 +551,19 @@ func (h handler) postPinByID(rw http.ResponseWriter, req *http.Request) {
 		)
 		return
 	}
-
-	status, err := h.h.UpdatePin(ctx, id, pin)
+	err = pin.validate()
 	if err != nil {
-		respondError(rw, http.StatusInternalServerError, err)
+		respondError(rw, http.StatusBadRequest, err)
 		return
 	}
 
-	err = json.NewEncoder(rw).Encode(status)
+	status, err := h.h.UpdatePin(ctx, id, pin)
 	if err != nil {
 		respondError(rw, http.StatusInternalServerError, err)
 		return
 	}
+
+	respond(rw, http.StatusAccepted, status)
 }
 
 func (h handler) deletePinByID(rw http.ResponseWriter, req *http.Request) {
@@ -373,6 +587,18 @@ func (h handler) deletePinByID(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Yields no response body if successful.
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// bodyErrorStatus returns the status code to respond with when
+// reading a request body fails with err.
+func bodyErrorStatus(err error) int {
+	// http.MaxBytesReader doesn't return a distinct error type in every
+	// version of Go, so it has to be identified by its message.
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
 }
 
 type errorResponse struct {
@@ -384,17 +610,43 @@ type errorResponseError struct {
 	Details string `json:"details,omitempty"`
 }
 
+func respond(rw http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		respondError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(status)
+	rw.Write(buf)
+}
+
 func respondError(rw http.ResponseWriter, status int, err error) {
 	var statusError StatusError
 	if errors.As(err, &statusError) {
 		status = statusError.Status()
 	}
 
+	reason := reasonFromStatus(status)
+	var reasonError ReasonError
+	if errors.As(err, &reasonError) {
+		if r := reasonError.Reason(); r != "" {
+			reason = r
+		}
+	}
+
+	var retryError RetryAfterError
+	if errors.As(err, &retryError) {
+		if d := retryError.RetryAfter(); d > 0 {
+			rw.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10))
+		}
+	}
+
 	rw.WriteHeader(status)
 
 	json.NewEncoder(rw).Encode(errorResponse{
 		Error: errorResponseError{
-			Reason:  reasonFromStatus(status),
+			Reason:  reason,
 			Details: err.Error(),
 		},
 	})
@@ -408,15 +660,26 @@ func reasonFromStatus(status int) string {
 	case http.StatusUnauthorized:
 		return "UNAUTHORIZED"
 
+	case http.StatusForbidden:
+		return "FORBIDDEN"
+
 	case http.StatusNotFound:
 		return "NOT_FOUND"
 
 	case http.StatusConflict:
 		return "INSUFFICIENT_FUNDS"
 
-	default:
-		return "INTERNAL_SERVER_ERROR"
+	case http.StatusTooManyRequests:
+		return "TOO_MANY_REQUESTS"
+	}
+
+	if (status >= 400) && (status < 500) {
+		if text := http.StatusText(status); text != "" {
+			return strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+		}
 	}
+
+	return "INTERNAL_SERVER_ERROR"
 }
 
 // StatusError is implemented by errors returned by PinHandler
@@ -426,12 +689,36 @@ func reasonFromStatus(status int) string {
 // Several status codes have special handling. These include
 //    - 400 Bad Request
 //    - 401 Unauthorized
+//    - 403 Forbidden
 //    - 404 Not Found
 //    - 409 Conflict
+//    - 429 Too Many Requests
 //
-// These status codes will produce special error messages for the
-// client. All other status codes will produce the same error message
-// as a 500 Internal Server Error code does.
+// These status codes will produce the reasons that the pinning
+// service API specifies for them, such as "INSUFFICIENT_FUNDS" for a
+// 409. Other 4XX status codes produce a reason derived from the status
+// text, and all remaining status codes will produce the same reason as
+// a 500 Internal Server Error code does.
 type StatusError interface {
 	Status() int
 }
+
+// ReasonError is implemented by errors returned by PinHandler
+// implementations that want to send a custom reason to the client
+// instead of the one derived from the status code. Reasons should be
+// short, machine-readable mnemonics, such as "QUOTA_EXCEEDED". If
+// Reason returns an empty string, the default reason is used.
+type ReasonError interface {
+	Reason() string
+}
+
+// RetryAfterError is implemented by errors returned by PinHandler
+// implementations that want to tell the client how long to wait
+// before trying again, usually along with a 429 Too Many Requests
+// status. The duration is sent in the Retry-After header, rounded up
+// to the nearest second. If RetryAfter returns zero or less, no header
+// is sent.
+type RetryAfterError interface {
+	RetryAfter() time.Duration
+}
+
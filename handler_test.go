@@ -0,0 +1,157 @@
+package sips_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DeedleFake/sips"
+)
+
+type testError struct {
+	status int
+	reason string
+	wait   time.Duration
+}
+
+func (err testError) Error() string             { return "test error" }
+func (err testError) Status() int               { return err.status }
+func (err testError) Reason() string            { return err.reason }
+func (err testError) RetryAfter() time.Duration { return err.wait }
+
+// fakePinHandler is a sips.PinHandler that returns err from every
+// method.
+type fakePinHandler struct {
+	err error
+}
+
+func (h fakePinHandler) Pins(ctx context.Context, query sips.PinQuery) (sips.PinList, error) {
+	return sips.PinList{}, h.err
+}
+
+func (h fakePinHandler) AddPin(ctx context.Context, pin sips.Pin) (sips.PinStatus, error) {
+	return sips.PinStatus{RequestID: "1", Status: sips.Queued, Created: time.Now(), Pin: pin}, h.err
+}
+
+func (h fakePinHandler) GetPin(ctx context.Context, requestID string) (sips.PinStatus, error) {
+	return sips.PinStatus{RequestID: requestID, Status: sips.Pinned, Created: time.Now()}, h.err
+}
+
+func (h fakePinHandler) UpdatePin(ctx context.Context, requestID string, pin sips.Pin) (sips.PinStatus, error) {
+	return sips.PinStatus{RequestID: requestID, Status: sips.Queued, Created: time.Now(), Pin: pin}, h.err
+}
+
+func (h fakePinHandler) DeletePin(ctx context.Context, requestID string) error {
+	return h.err
+}
+
+func TestHandlerConformance(t *testing.T) {
+	const pin = `{"cid": "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"}`
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		noAuth bool
+		err    error
+
+		status     int
+		reason     string
+		retryAfter string
+	}{
+		{name: "GetPins", method: "GET", path: "/pins", status: http.StatusOK},
+		{name: "AddPin", method: "POST", path: "/pins", body: pin, status: http.StatusAccepted},
+		{name: "GetPin", method: "GET", path: "/pins/1", status: http.StatusOK},
+		{name: "ReplacePin", method: "POST", path: "/pins/1", body: pin, status: http.StatusAccepted},
+		{name: "DeletePin", method: "DELETE", path: "/pins/1", status: http.StatusAccepted},
+
+		{name: "BadBody", method: "POST", path: "/pins", body: "{", status: http.StatusBadRequest, reason: "BAD_REQUEST"},
+		{name: "NoCID", method: "POST", path: "/pins", body: "{}", status: http.StatusBadRequest, reason: "BAD_REQUEST"},
+		{name: "BadLimit", method: "GET", path: "/pins?limit=0", status: http.StatusBadRequest, reason: "BAD_REQUEST"},
+		{name: "BadStatus", method: "GET", path: "/pins?status=lost", status: http.StatusBadRequest, reason: "BAD_REQUEST"},
+		{name: "NoToken", method: "GET", path: "/pins", noAuth: true, status: http.StatusUnauthorized, reason: "UNAUTHORIZED"},
+		{name: "Unauthorized", method: "GET", path: "/pins", err: testError{status: http.StatusUnauthorized}, status: http.StatusUnauthorized, reason: "UNAUTHORIZED"},
+		{name: "Forbidden", method: "DELETE", path: "/pins/1", err: testError{status: http.StatusForbidden}, status: http.StatusForbidden, reason: "FORBIDDEN"},
+		{name: "NotFound", method: "GET", path: "/pins/1", err: testError{status: http.StatusNotFound}, status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "InsufficientFunds", method: "POST", path: "/pins", body: pin, err: testError{status: http.StatusConflict}, status: http.StatusConflict, reason: "INSUFFICIENT_FUNDS"},
+		{name: "TooManyRequests", method: "POST", path: "/pins", body: pin, err: testError{status: http.StatusTooManyRequests, wait: 1500 * time.Millisecond}, status: http.StatusTooManyRequests, reason: "TOO_MANY_REQUESTS", retryAfter: "2"},
+		{name: "CustomReason", method: "POST", path: "/pins", body: pin, err: testError{status: http.StatusConflict, reason: "QUOTA_EXCEEDED"}, status: http.StatusConflict, reason: "QUOTA_EXCEEDED"},
+		{name: "InternalServerError", method: "GET", path: "/pins", err: errors.New("broken"), status: http.StatusInternalServerError, reason: "INTERNAL_SERVER_ERROR"},
+		{name: "UnknownStatus", method: "GET", path: "/pins", err: testError{status: 599}, status: 599, reason: "INTERNAL_SERVER_ERROR"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := sips.Handler(fakePinHandler{err: test.err})
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if !test.noAuth {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("got status %v, want %v: %s", rec.Code, test.status, rec.Body)
+			}
+			if got := rec.Header().Get("Retry-After"); got != test.retryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, test.retryAfter)
+			}
+			if test.reason == "" {
+				return
+			}
+
+			var rsp struct {
+				Error struct {
+					Reason  string `json:"reason"`
+					Details string `json:"details"`
+				} `json:"error"`
+			}
+			err := json.NewDecoder(rec.Body).Decode(&rsp)
+			if err != nil {
+				t.Fatalf("decode error response: %v", err)
+			}
+			if rsp.Error.Reason != test.reason {
+				t.Errorf("got reason %q, want %q", rsp.Error.Reason, test.reason)
+			}
+			if rsp.Error.Details == "" {
+				t.Error("error response has no details")
+			}
+		})
+	}
+}
+
+func TestHandlerMaxBodySize(t *testing.T) {
+	body := `{"cid": "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", "name": "` + strings.Repeat("a", 200) + `"}`
+
+	tests := []struct {
+		name   string
+		max    int64
+		status int
+	}{
+		{name: "UnderLimit", max: 1024, status: http.StatusAccepted},
+		{name: "OverLimit", max: 64, status: http.StatusRequestEntityTooLarge},
+		{name: "NoLimit", max: 0, status: http.StatusAccepted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := sips.Handler(fakePinHandler{}, sips.WithMaxBodySize(test.max))
+
+			req := httptest.NewRequest("POST", "/pins", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("got status %v, want %v: %s", rec.Code, test.status, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// Package adminapi implements the SIPS admin API, which allows users,
+// organizations, tokens, and pins to be administrated over HTTP instead of with
+// direct access to the database.
+//
+// The API is described by the Admin interface. DB implements it using
+// the database, Handler serves any implementation of it over HTTP, and
+// Client implements it by making requests to such a server.
+package adminapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/DeedleFake/sips"
+)
+
+// Prefix is the path that the admin API is served under.
+const Prefix = "/admin/v1"
+
+// Admin is the set of operations provided by the admin API.
+type Admin interface {
+	// Users returns every user.
+	Users(ctx context.Context) ([]User, error)
+
+	// User returns the user with the given name.
+	User(ctx context.Context, name string) (User, error)
+
+	// AddUser creates a new user with the given name.
+	AddUser(ctx context.Context, name string) (User, error)
+
+	// RemoveUser deletes the user with the given name along with their
+	// webhooks, event history, and organization memberships. Their
+	// tokens and pins are left without an owner.
+	RemoveUser(ctx context.Context, name string) error
+
+	// SetQuota changes the quotas of the user with the given name and
+	// returns the updated user.
+	SetQuota(ctx context.Context, name string, quota Quota) (User, error)
+
+	// Orgs returns every organization.
+	Orgs(ctx context.Context) ([]Org, error)
+
+	// Org returns the organization with the given name.
+	Org(ctx context.Context, name string) (Org, error)
+
+	// AddOrg creates a new organization with the given name.
+	AddOrg(ctx context.Context, name string) (Org, error)
+
+	// RemoveOrg deletes the organization with the given name along with
+	// its memberships, tokens, and event history. It fails if the
+	// organization still has pins.
+	RemoveOrg(ctx context.Context, name string) error
+
+	// SetOrgQuota changes the quotas of the organization with the given
+	// name and returns the updated organization.
+	SetOrgQuota(ctx context.Context, name string, quota Quota) (Org, error)
+
+	// Members returns the members of the organization with the given
+	// name.
+	Members(ctx context.Context, org string) ([]Member, error)
+
+	// SetMember adds user to org with the given role, or changes their
+	// role if they are already a member.
+	SetMember(ctx context.Context, org, user, role string) (Member, error)
+
+	// RemoveMember removes user from org. Tokens that they created for
+	// it stop working.
+	RemoveMember(ctx context.Context, org, user string) error
+
+	// Tokens returns every token, or every token belonging to user if
+	// it is not empty.
+	Tokens(ctx context.Context, user string) ([]Token, error)
+
+	// AddToken generates a new token and returns it. This is the only
+	// time that the token itself is available.
+	AddToken(ctx context.Context, tok NewToken) (string, error)
+
+	// RemoveTokens deletes the tokens that are given either in full or
+	// by their prefixes and returns the number deleted.
+	RemoveTokens(ctx context.Context, tokens ...string) (int, error)
+
+	// Pins returns the pins matching query, belonging to any user.
+	Pins(ctx context.Context, query PinQuery) ([]Pin, error)
+
+	// SetStatus sets the status of the pins with the given IDs without
+	// doing anything else, and returns the number of pins changed.
+	SetStatus(ctx context.Context, status sips.RequestStatus, ids ...int) (int, error)
+
+	// Requeue queues the pins with the given IDs to be pinned again and
+	// returns the number queued. Pins that already have a job waiting
+	// are left alone.
+	Requeue(ctx context.Context, ids ...int) (int, error)
+}
+
+// User is a user and their usage.
+type User struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// MaxPins and MaxBytes are the user's quotas. They are nil if there
+	// is no limit.
+	MaxPins  *int   `json:"maxpins,omitempty"`
+	MaxBytes *int64 `json:"maxbytes,omitempty"`
+
+	// Pins and Bytes are the number of pins that the user has and their
+	// total size.
+	Pins  int   `json:"pins"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Org is an organization and its usage.
+type Org struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// MaxPins and MaxBytes are the organization's quotas. They are nil
+	// if there is no limit.
+	MaxPins  *int   `json:"maxpins,omitempty"`
+	MaxBytes *int64 `json:"maxbytes,omitempty"`
+
+	// Pins and Bytes are the number of pins that the organization has
+	// and their total size.
+	Pins  int   `json:"pins"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Member is a user's membership in an organization.
+type Member struct {
+	User  string    `json:"user"`
+	Role  string    `json:"role"`
+	Since time.Time `json:"since"`
+}
+
+// Quota is a change to a user's or organization's quotas. Nil fields
+// are left alone, and negative ones remove the quota.
+type Quota struct {
+	MaxPins  *int   `json:"maxpins,omitempty"`
+	MaxBytes *int64 `json:"maxbytes,omitempty"`
+}
+
+// Token describes an auth token without revealing it.
+type Token struct {
+	Prefix  string    `json:"prefix"`
+	User    string    `json:"user,omitempty"`
+	Org     string    `json:"org,omitempty"`
+	Label   string    `json:"label,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastused,omitempty"`
+	LastIP   string     `json:"lastip,omitempty"`
+
+	// Unhashed is true if the token is still stored in plaintext.
+	Unhashed bool `json:"unhashed,omitempty"`
+}
+
+// NewToken describes a token to be generated.
+type NewToken struct {
+	User  string `json:"user"`
+	Label string `json:"label,omitempty"`
+
+	// Org, if not empty, is the organization that the token acts on
+	// behalf of. User must be a member of it, and the token is limited
+	// to the scopes that their role allows.
+	Org string `json:"org,omitempty"`
+
+	// Scopes are the scopes to grant the token. If it is empty, the
+	// default scopes are granted.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Expires is when the token expires. If it is nil, it never does.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Pin is a pin belonging to any user.
+type Pin struct {
+	ID        int                `json:"id"`
+	User      string             `json:"user,omitempty"`
+	Org       string             `json:"org,omitempty"`
+	CID       string             `json:"cid"`
+	Name      string             `json:"name"`
+	Status    sips.RequestStatus `json:"status"`
+	Created   time.Time          `json:"created"`
+	LastError string             `json:"lasterror,omitempty"`
+}
+
+// PinQuery filters the pins returned by Admin.Pins. Empty fields
+// match everything.
+type PinQuery struct {
+	User   string
+	Org    string
+	Status sips.RequestStatus
+}
+
+type idsRequest struct {
+	IDs    []int              `json:"ids"`
+	Status sips.RequestStatus `json:"status,omitempty"`
+}
+
+type memberRequest struct {
+	Role string `json:"role"`
+}
+
+type tokensRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
+type countResponse struct {
+	Count int `json:"count"`
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,250 @@
+package adminapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/DeedleFake/sips"
+)
+
+// Client implements Admin by making requests to a SIPS server.
+type Client struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+// NewClient returns a new Client created with the given options.
+func NewClient(options ...ClientOption) *Client {
+	c := Client{
+		client: http.DefaultClient,
+		base:   "http://127.0.0.1:8080",
+	}
+	for _, option := range options {
+		option(&c)
+	}
+
+	return &c
+}
+
+func (c *Client) do(ctx context.Context, data interface{}, method, endpoint string, args url.Values, body interface{}) error {
+	url := c.base + Prefix + endpoint
+	if len(args) > 0 {
+		url += "?" + args.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%v %q: %w", method, endpoint, err)
+	}
+	defer rsp.Body.Close()
+
+	buf, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	if (rsp.StatusCode < 200) || (rsp.StatusCode >= 300) {
+		return newError(rsp.StatusCode, buf)
+	}
+
+	if (data == nil) || (len(bytes.TrimSpace(buf)) == 0) {
+		return nil
+	}
+
+	err = json.Unmarshal(buf, data)
+	if err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.do(ctx, &users, http.MethodGet, "/users", nil, nil)
+	return users, err
+}
+
+func (c *Client) User(ctx context.Context, name string) (User, error) {
+	var u User
+	err := c.do(ctx, &u, http.MethodGet, "/users/"+url.PathEscape(name), nil, nil)
+	return u, err
+}
+
+func (c *Client) AddUser(ctx context.Context, name string) (User, error) {
+	body := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+
+	var u User
+	err := c.do(ctx, &u, http.MethodPost, "/users", nil, body)
+	return u, err
+}
+
+func (c *Client) RemoveUser(ctx context.Context, name string) error {
+	return c.do(ctx, nil, http.MethodDelete, "/users/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) SetQuota(ctx context.Context, name string, quota Quota) (User, error) {
+	var u User
+	err := c.do(ctx, &u, http.MethodPut, "/users/"+url.PathEscape(name)+"/quota", nil, quota)
+	return u, err
+}
+
+func (c *Client) Orgs(ctx context.Context) ([]Org, error) {
+	var orgs []Org
+	err := c.do(ctx, &orgs, http.MethodGet, "/orgs", nil, nil)
+	return orgs, err
+}
+
+func (c *Client) Org(ctx context.Context, name string) (Org, error) {
+	var o Org
+	err := c.do(ctx, &o, http.MethodGet, "/orgs/"+url.PathEscape(name), nil, nil)
+	return o, err
+}
+
+func (c *Client) AddOrg(ctx context.Context, name string) (Org, error) {
+	body := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+
+	var o Org
+	err := c.do(ctx, &o, http.MethodPost, "/orgs", nil, body)
+	return o, err
+}
+
+func (c *Client) RemoveOrg(ctx context.Context, name string) error {
+	return c.do(ctx, nil, http.MethodDelete, "/orgs/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) SetOrgQuota(ctx context.Context, name string, quota Quota) (Org, error) {
+	var o Org
+	err := c.do(ctx, &o, http.MethodPut, "/orgs/"+url.PathEscape(name)+"/quota", nil, quota)
+	return o, err
+}
+
+func (c *Client) Members(ctx context.Context, org string) ([]Member, error) {
+	var members []Member
+	err := c.do(ctx, &members, http.MethodGet, "/orgs/"+url.PathEscape(org)+"/members", nil, nil)
+	return members, err
+}
+
+func (c *Client) SetMember(ctx context.Context, org, user, role string) (Member, error) {
+	var m Member
+	err := c.do(ctx, &m, http.MethodPut, "/orgs/"+url.PathEscape(org)+"/members/"+url.PathEscape(user), nil, memberRequest{Role: role})
+	return m, err
+}
+
+func (c *Client) RemoveMember(ctx context.Context, org, user string) error {
+	return c.do(ctx, nil, http.MethodDelete, "/orgs/"+url.PathEscape(org)+"/members/"+url.PathEscape(user), nil, nil)
+}
+
+func (c *Client) Tokens(ctx context.Context, user string) ([]Token, error) {
+	args := make(url.Values)
+	if user != "" {
+		args.Set("user", user)
+	}
+
+	var toks []Token
+	err := c.do(ctx, &toks, http.MethodGet, "/tokens", args, nil)
+	return toks, err
+}
+
+func (c *Client) AddToken(ctx context.Context, tok NewToken) (string, error) {
+	var rsp tokenResponse
+	err := c.do(ctx, &rsp, http.MethodPost, "/tokens", nil, tok)
+	return rsp.Token, err
+}
+
+func (c *Client) RemoveTokens(ctx context.Context, tokens ...string) (int, error) {
+	var rsp countResponse
+	err := c.do(ctx, &rsp, http.MethodPost, "/tokens/revoke", nil, tokensRequest{Tokens: tokens})
+	return rsp.Count, err
+}
+
+func (c *Client) Pins(ctx context.Context, query PinQuery) ([]Pin, error) {
+	args := make(url.Values)
+	if query.User != "" {
+		args.Set("user", query.User)
+	}
+	if query.Org != "" {
+		args.Set("org", query.Org)
+	}
+	if query.Status != "" {
+		args.Set("status", string(query.Status))
+	}
+
+	var pins []Pin
+	err := c.do(ctx, &pins, http.MethodGet, "/pins", args, nil)
+	return pins, err
+}
+
+func (c *Client) SetStatus(ctx context.Context, status sips.RequestStatus, ids ...int) (int, error) {
+	var rsp countResponse
+	err := c.do(ctx, &rsp, http.MethodPost, "/pins/status", nil, idsRequest{IDs: ids, Status: status})
+	return rsp.Count, err
+}
+
+func (c *Client) Requeue(ctx context.Context, ids ...int) (int, error) {
+	var rsp countResponse
+	err := c.do(ctx, &rsp, http.MethodPost, "/pins/requeue", nil, idsRequest{IDs: ids})
+	return rsp.Count, err
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithHTTPClient uses the given http.Client instead of
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithBaseURL sets the base URL of the server, not including Prefix.
+// The default is "http://127.0.0.1:8080".
+func WithBaseURL(base string) ClientOption {
+	return func(c *Client) {
+		c.base = strings.TrimSuffix(base, "/")
+	}
+}
+
+// WithToken sets the token used to authenticate with the server. It
+// must have the admin scope.
+func WithToken(token string) ClientOption {
+	return func(c *Client) {
+		c.token = token
+	}
+}
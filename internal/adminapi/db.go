@@ -0,0 +1,745 @@
+package adminapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/DeedleFake/sips"
+	"github.com/DeedleFake/sips/db"
+	"github.com/DeedleFake/sips/ent"
+	"github.com/DeedleFake/sips/ent/membership"
+	"github.com/DeedleFake/sips/ent/organization"
+	"github.com/DeedleFake/sips/ent/pin"
+	"github.com/DeedleFake/sips/ent/pinevent"
+	"github.com/DeedleFake/sips/ent/token"
+	"github.com/DeedleFake/sips/ent/user"
+	"github.com/DeedleFake/sips/ent/webhook"
+)
+
+var validUserRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// DB implements Admin using the database directly. Its methods must
+// be called with a context from viewer.AdminContext, or the database
+// will refuse access to the pins and tokens of every user.
+type DB struct {
+	Client *ent.Client
+
+	// TokenKey is the key used to hash tokens.
+	TokenKey []byte
+
+	// Committed, if not nil, is called after changes to pins have been
+	// committed, with the events that they recorded, so that the pin
+	// queue and anything following the events can be told about them.
+	Committed func(events ...*ent.PinEvent)
+}
+
+func (a *DB) committed(events ...*ent.PinEvent) {
+	if a.Committed != nil {
+		a.Committed(events...)
+	}
+}
+
+func (a *DB) user(ctx context.Context, u *ent.User) (User, error) {
+	pins, bytes, err := db.Usage(ctx, db.Owner{User: u})
+	if err != nil {
+		return User{}, fmt.Errorf("get usage of user %q: %w", u.Name, err)
+	}
+
+	return User{
+		ID:       u.ID,
+		Name:     u.Name,
+		Created:  u.CreateTime,
+		MaxPins:  u.MaxPins,
+		MaxBytes: u.MaxBytes,
+		Pins:     pins,
+		Bytes:    bytes,
+	}, nil
+}
+
+func (a *DB) Users(ctx context.Context) ([]User, error) {
+	users, err := a.Client.User.Query().
+		Order(ent.Asc(user.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+
+	list := make([]User, 0, len(users))
+	for _, u := range users {
+		au, err := a.user(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, au)
+	}
+	return list, nil
+}
+
+func (a *DB) User(ctx context.Context, name string) (User, error) {
+	u, err := a.Client.User.Query().
+		Where(user.Name(name)).
+		Only(ctx)
+	if err != nil {
+		return User{}, fmt.Errorf("find user %q: %w", name, err)
+	}
+
+	return a.user(ctx, u)
+}
+
+func (a *DB) AddUser(ctx context.Context, name string) (User, error) {
+	if !validUserRE.MatchString(name) {
+		return User{}, invalid("invalid username: %q", name)
+	}
+
+	u, err := a.Client.User.Create().
+		SetName(name).
+		Save(ctx)
+	if err != nil {
+		return User{}, fmt.Errorf("create user %q: %w", name, err)
+	}
+
+	return a.user(ctx, u)
+}
+
+func (a *DB) RemoveUser(ctx context.Context, name string) error {
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = db.DeleteWebhooks(ctx, tx, webhook.HasUserWith(user.Name(name)))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.PinEvent.Delete().
+		Where(pinevent.HasUserWith(user.Name(name))).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete pin events of user %q: %w", name, err)
+	}
+
+	_, err = tx.Membership.Delete().
+		Where(membership.HasUserWith(user.Name(name))).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete memberships of user %q: %w", name, err)
+	}
+
+	n, err := tx.User.Delete().
+		Where(user.Name(name)).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete user %q: %w", name, err)
+	}
+	if n == 0 {
+		return &Error{StatusCode: http.StatusNotFound, Details: fmt.Sprintf("user %q not found", name)}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (a *DB) SetQuota(ctx context.Context, name string, quota Quota) (User, error) {
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return User{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	u, err := tx.User.Query().
+		Where(user.Name(name)).
+		Only(ctx)
+	if err != nil {
+		return User{}, fmt.Errorf("find user %q: %w", name, err)
+	}
+
+	update := tx.User.UpdateOne(u)
+	if quota.MaxPins != nil {
+		if *quota.MaxPins < 0 {
+			update.ClearMaxPins()
+		} else {
+			update.SetMaxPins(*quota.MaxPins)
+		}
+	}
+	if quota.MaxBytes != nil {
+		if *quota.MaxBytes < 0 {
+			update.ClearMaxBytes()
+		} else {
+			update.SetMaxBytes(*quota.MaxBytes)
+		}
+	}
+	u, err = update.Save(ctx)
+	if err != nil {
+		return User{}, fmt.Errorf("update user %q: %w", name, err)
+	}
+
+	au, err := a.user(ctx, u)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return au, nil
+}
+
+func (a *DB) org(ctx context.Context, o *ent.Organization) (Org, error) {
+	pins, bytes, err := db.Usage(ctx, db.Owner{Org: o})
+	if err != nil {
+		return Org{}, fmt.Errorf("get usage of organization %q: %w", o.Name, err)
+	}
+
+	return Org{
+		ID:       o.ID,
+		Name:     o.Name,
+		Created:  o.CreateTime,
+		MaxPins:  o.MaxPins,
+		MaxBytes: o.MaxBytes,
+		Pins:     pins,
+		Bytes:    bytes,
+	}, nil
+}
+
+func (a *DB) Orgs(ctx context.Context) ([]Org, error) {
+	orgs, err := a.Client.Organization.Query().
+		Order(ent.Asc(organization.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query organizations: %w", err)
+	}
+
+	list := make([]Org, 0, len(orgs))
+	for _, o := range orgs {
+		ao, err := a.org(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ao)
+	}
+	return list, nil
+}
+
+func (a *DB) Org(ctx context.Context, name string) (Org, error) {
+	o, err := a.Client.Organization.Query().
+		Where(organization.Name(name)).
+		Only(ctx)
+	if err != nil {
+		return Org{}, fmt.Errorf("find organization %q: %w", name, err)
+	}
+
+	return a.org(ctx, o)
+}
+
+func (a *DB) AddOrg(ctx context.Context, name string) (Org, error) {
+	if !validUserRE.MatchString(name) {
+		return Org{}, invalid("invalid organization name: %q", name)
+	}
+
+	o, err := a.Client.Organization.Create().
+		SetName(name).
+		Save(ctx)
+	if err != nil {
+		return Org{}, fmt.Errorf("create organization %q: %w", name, err)
+	}
+
+	return a.org(ctx, o)
+}
+
+func (a *DB) RemoveOrg(ctx context.Context, name string) error {
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err := tx.Organization.Query().
+		Where(organization.Name(name)).
+		Only(ctx)
+	if err != nil {
+		return fmt.Errorf("find organization %q: %w", name, err)
+	}
+
+	// Deleting the organization would otherwise quietly turn its pins
+	// into personal pins of whoever created them.
+	haspins, err := o.QueryPins().Exist(ctx)
+	if err != nil {
+		return fmt.Errorf("query pins of organization %q: %w", name, err)
+	}
+	if haspins {
+		return &Error{StatusCode: http.StatusConflict, Details: fmt.Sprintf("organization %q still has pins", name)}
+	}
+
+	_, err = tx.Membership.Delete().
+		Where(membership.HasOrganizationWith(organization.ID(o.ID))).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete members of organization %q: %w", name, err)
+	}
+
+	_, err = tx.Token.Delete().
+		Where(token.HasOrganizationWith(organization.ID(o.ID))).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete tokens of organization %q: %w", name, err)
+	}
+
+	_, err = tx.PinEvent.Delete().
+		Where(pinevent.HasOrganizationWith(organization.ID(o.ID))).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete pin events of organization %q: %w", name, err)
+	}
+
+	err = tx.Organization.DeleteOne(o).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete organization %q: %w", name, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (a *DB) SetOrgQuota(ctx context.Context, name string, quota Quota) (Org, error) {
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return Org{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err := tx.Organization.Query().
+		Where(organization.Name(name)).
+		Only(ctx)
+	if err != nil {
+		return Org{}, fmt.Errorf("find organization %q: %w", name, err)
+	}
+
+	update := tx.Organization.UpdateOne(o)
+	if quota.MaxPins != nil {
+		if *quota.MaxPins < 0 {
+			update.ClearMaxPins()
+		} else {
+			update.SetMaxPins(*quota.MaxPins)
+		}
+	}
+	if quota.MaxBytes != nil {
+		if *quota.MaxBytes < 0 {
+			update.ClearMaxBytes()
+		} else {
+			update.SetMaxBytes(*quota.MaxBytes)
+		}
+	}
+	o, err = update.Save(ctx)
+	if err != nil {
+		return Org{}, fmt.Errorf("update organization %q: %w", name, err)
+	}
+
+	ao, err := a.org(ctx, o)
+	if err != nil {
+		return Org{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Org{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return ao, nil
+}
+
+func member(m *ent.Membership) Member {
+	am := Member{
+		Role:  string(m.Role),
+		Since: m.CreateTime,
+	}
+	if m.Edges.User != nil {
+		am.User = m.Edges.User.Name
+	}
+	return am
+}
+
+func (a *DB) Members(ctx context.Context, org string) ([]Member, error) {
+	o, err := a.Client.Organization.Query().
+		Where(organization.Name(org)).
+		Only(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("find organization %q: %w", org, err)
+	}
+
+	ms, err := o.QueryMemberships().
+		WithUser().
+		Order(ent.Asc(membership.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query members of organization %q: %w", org, err)
+	}
+
+	list := make([]Member, 0, len(ms))
+	for _, m := range ms {
+		list = append(list, member(m))
+	}
+	return list, nil
+}
+
+func (a *DB) SetMember(ctx context.Context, org, username, role string) (Member, error) {
+	r := membership.Role(role)
+	if role == "" {
+		r = membership.DefaultRole
+	}
+	err := membership.RoleValidator(r)
+	if err != nil {
+		return Member{}, invalid("invalid role: %q", role)
+	}
+
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return Member{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	o, err := tx.Organization.Query().
+		Where(organization.Name(org)).
+		Only(ctx)
+	if err != nil {
+		return Member{}, fmt.Errorf("find organization %q: %w", org, err)
+	}
+
+	u, err := tx.User.Query().
+		Where(user.Name(username)).
+		Only(ctx)
+	if err != nil {
+		return Member{}, fmt.Errorf("find user %q: %w", username, err)
+	}
+
+	m, err := db.Membership(ctx, tx, u.ID, o.ID)
+	switch {
+	case err == nil:
+		m, err = tx.Membership.UpdateOne(m).
+			SetRole(r).
+			Save(ctx)
+	case ent.IsNotFound(err):
+		m, err = tx.Membership.Create().
+			SetUser(u).
+			SetOrganization(o).
+			SetRole(r).
+			Save(ctx)
+	}
+	if err != nil {
+		return Member{}, fmt.Errorf("set membership of user %q in organization %q: %w", username, org, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Member{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	m.Edges.User = u
+	return member(m), nil
+}
+
+func (a *DB) RemoveMember(ctx context.Context, org, username string) error {
+	n, err := a.Client.Membership.Delete().
+		Where(
+			membership.HasOrganizationWith(organization.Name(org)),
+			membership.HasUserWith(user.Name(username)),
+		).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("remove user %q from organization %q: %w", username, org, err)
+	}
+	if n == 0 {
+		return &Error{StatusCode: http.StatusNotFound, Details: fmt.Sprintf("user %q is not a member of organization %q", username, org)}
+	}
+	return nil
+}
+
+func (a *DB) Tokens(ctx context.Context, username string) ([]Token, error) {
+	q := a.Client.Token.Query()
+	if username != "" {
+		q = q.Where(token.HasUserWith(user.Name(username)))
+	}
+	toks, err := q.WithUser().
+		WithOrganization().
+		Order(ent.Asc(token.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query tokens: %w", err)
+	}
+
+	list := make([]Token, 0, len(toks))
+	for _, tok := range toks {
+		scopes := db.TokenScopes(tok)
+		t := Token{
+			Prefix:   tok.Prefix,
+			Label:    tok.Label,
+			Scopes:   make([]string, 0, len(scopes)),
+			Created:  tok.CreateTime,
+			Expires:  tok.Expires,
+			LastUsed: tok.LastUsed,
+			LastIP:   tok.LastIP,
+		}
+		for _, s := range scopes {
+			t.Scopes = append(t.Scopes, string(s))
+		}
+		if tok.Edges.User != nil {
+			t.User = tok.Edges.User.Name
+		}
+		if tok.Edges.Organization != nil {
+			t.Org = tok.Edges.Organization.Name
+		}
+		if tok.Token != nil {
+			t.Prefix = db.TokenPrefix(*tok.Token)
+			t.Unhashed = true
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+func (a *DB) AddToken(ctx context.Context, nt NewToken) (string, error) {
+	scopes := make([]string, 0, len(nt.Scopes))
+	for _, str := range nt.Scopes {
+		scope, err := db.ParseScope(str)
+		if err != nil {
+			return "", invalid("%v", err)
+		}
+		scopes = append(scopes, string(scope))
+	}
+
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return "", fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	u, err := tx.User.Query().
+		Where(user.Name(nt.User)).
+		Only(ctx)
+	if err != nil {
+		return "", fmt.Errorf("find user %q: %w", nt.User, err)
+	}
+
+	var org *ent.Organization
+	if nt.Org != "" {
+		org, err = tx.Organization.Query().
+			Where(organization.Name(nt.Org)).
+			Only(ctx)
+		if err != nil {
+			return "", fmt.Errorf("find organization %q: %w", nt.Org, err)
+		}
+
+		m, err := db.Membership(ctx, tx, u.ID, org.ID)
+		if err != nil {
+			if ent.IsNotFound(err) {
+				return "", invalid("user %q is not a member of organization %q", nt.User, nt.Org)
+			}
+			return "", fmt.Errorf("find membership of user %q in organization %q: %w", nt.User, nt.Org, err)
+		}
+
+		allowed := db.RoleScopes(m.Role)
+		for _, s := range scopes {
+			if !db.ScopesAllow(allowed, db.Scope(s)) {
+				return "", invalid("role %q in organization %q does not allow %q scope", m.Role, nt.Org, s)
+			}
+		}
+		if len(scopes) == 0 {
+			for _, s := range allowed {
+				scopes = append(scopes, string(s))
+			}
+		}
+	}
+
+	tok, err := db.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	create := tx.Token.Create().
+		SetUser(u).
+		SetHash(db.HashToken(a.TokenKey, tok)).
+		SetPrefix(db.TokenPrefix(tok)).
+		SetLabel(nt.Label).
+		SetScopes(scopes).
+		SetNillableExpires(nt.Expires)
+	if org != nil {
+		create.SetOrganization(org)
+	}
+	err = create.Exec(ctx)
+	if err != nil {
+		return "", fmt.Errorf("create token: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return tok, nil
+}
+
+func (a *DB) RemoveTokens(ctx context.Context, tokens ...string) (int, error) {
+	hashes := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		hashes = append(hashes, db.HashToken(a.TokenKey, tok))
+	}
+
+	n, err := a.Client.Token.Delete().
+		Where(token.Or(
+			token.HashIn(hashes...),
+			token.PrefixIn(tokens...),
+			token.TokenIn(tokens...),
+		)).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("delete tokens: %w", err)
+	}
+	return n, nil
+}
+
+func (a *DB) Pins(ctx context.Context, query PinQuery) ([]Pin, error) {
+	q := a.Client.Pin.Query()
+	if query.User != "" {
+		q = q.Where(pin.HasUserWith(user.Name(query.User)))
+	}
+	if query.Org != "" {
+		q = q.Where(pin.HasOrganizationWith(organization.Name(query.Org)))
+	}
+	if query.Status != "" {
+		q = q.Where(pin.StatusEQ(query.Status))
+	}
+	pins, err := q.WithUser().
+		WithOrganization().
+		Order(ent.Asc(pin.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query pins: %w", err)
+	}
+
+	list := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		ap := Pin{
+			ID:        p.ID,
+			CID:       p.CID,
+			Name:      p.Name,
+			Status:    p.Status,
+			Created:   p.CreateTime,
+			LastError: p.LastError,
+		}
+		if p.Edges.User != nil {
+			ap.User = p.Edges.User.Name
+		}
+		if p.Edges.Organization != nil {
+			ap.Org = p.Edges.Organization.Name
+		}
+		list = append(list, ap)
+	}
+	return list, nil
+}
+
+func (a *DB) SetStatus(ctx context.Context, status sips.RequestStatus, ids ...int) (int, error) {
+	t, err := db.ParseEventType("pin." + string(status))
+	if err != nil {
+		return 0, invalid("invalid status: %q", status)
+	}
+
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pins, err := tx.Pin.Query().
+		Where(pin.IDIn(ids...)).
+		All(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("query pins: %w", err)
+	}
+
+	var events []*ent.PinEvent
+	for _, p := range pins {
+		up, err := tx.Pin.UpdateOne(p).
+			SetStatus(status).
+			Save(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("update pin %v: %w", p.ID, err)
+		}
+
+		ev, err := db.QueueEvent(ctx, tx, up, t)
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, ev)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	a.committed(events...)
+
+	return len(pins), nil
+}
+
+func (a *DB) Requeue(ctx context.Context, ids ...int) (int, error) {
+	tx, err := a.Client.Tx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pins, err := tx.Pin.Query().
+		Where(
+			pin.IDIn(ids...),
+			pin.Not(pin.HasJobs()),
+		).
+		All(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("query pins: %w", err)
+	}
+
+	var events []*ent.PinEvent
+	for _, p := range pins {
+		up, err := tx.Pin.UpdateOne(p).
+			SetStatus(sips.Queued).
+			SetProgress(0).
+			ClearLastError().
+			ClearFinished().
+			Save(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("update pin %v: %w", p.ID, err)
+		}
+
+		err = db.QueueAdd(ctx, tx, up)
+		if err != nil {
+			return 0, fmt.Errorf("queue add %v: %w", p.ID, err)
+		}
+
+		ev, err := db.QueueEvent(ctx, tx, up, db.EventQueued)
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, ev)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	a.committed(events...)
+
+	return len(pins), nil
+}
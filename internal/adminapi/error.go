@@ -0,0 +1,89 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/DeedleFake/sips/ent"
+)
+
+// Error is an error with an HTTP status. Errors returned by Client are
+// of this type, and an implementation of Admin may return them to
+// control the status that Handler responds with.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Details is a description of the error.
+	Details string
+}
+
+func newError(status int, body []byte) *Error {
+	var rsp errorResponse
+	if json.Unmarshal(body, &rsp) == nil && rsp.Error.Details != "" {
+		return &Error{StatusCode: status, Details: rsp.Error.Details}
+	}
+
+	details := strings.TrimSpace(string(body))
+	if details == "" {
+		details = http.StatusText(status)
+	}
+	return &Error{StatusCode: status, Details: details}
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("admin API error (%v): %v", err.StatusCode, err.Details)
+}
+
+func (err *Error) Status() int {
+	return err.StatusCode
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Details:    fmt.Sprintf(format, args...),
+	}
+}
+
+// IsNotFound returns true if err indicates that the requested item
+// doesn't exist.
+func IsNotFound(err error) bool {
+	var aerr *Error
+	if errors.As(err, &aerr) {
+		return aerr.StatusCode == http.StatusNotFound
+	}
+	return ent.IsNotFound(err)
+}
+
+// statusOf returns the HTTP status that should be responded with for
+// err.
+func statusOf(err error) int {
+	var serr interface{ Status() int }
+	if errors.As(err, &serr) {
+		return serr.Status()
+	}
+
+	switch {
+	case ent.IsNotFound(err):
+		return http.StatusNotFound
+	case ent.IsConstraintError(err):
+		return http.StatusConflict
+	case ent.IsValidationError(err):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type errorResponse struct {
+	Error errorResponseError `json:"error"`
+}
+
+type errorResponseError struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
@@ -0,0 +1,431 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DeedleFake/sips"
+	"github.com/gorilla/mux"
+)
+
+// maxBodySize is the limit on the size of request bodies.
+const maxBodySize = 1 << 20
+
+type handler struct {
+	a    Admin
+	auth func(*http.Request) (*http.Request, error)
+}
+
+// HandlerOption configures the handler returned by Handler.
+type HandlerOption func(*handler)
+
+// WithAuth sets a function that is called with every request before
+// it is handled. If it returns an error, the request is rejected with
+// it. Otherwise, the request that it returns is handled, which allows
+// it to attach information to the request's context. By default,
+// every request is allowed, so this should almost always be set.
+func WithAuth(auth func(*http.Request) (*http.Request, error)) HandlerOption {
+	return func(h *handler) {
+		h.auth = auth
+	}
+}
+
+// Handler returns an HTTP handler that serves the admin API under
+// Prefix using a.
+//
+// Errors returned by a are sent to the client. If an error has a
+// Status method, as Error does, the status that it returns is used.
+// Otherwise, the status is derived from the error if it came from ent
+// and is 500 Internal Server Error if it didn't.
+func Handler(a Admin, options ...HandlerOption) http.Handler {
+	h := handler{a: a}
+	for _, option := range options {
+		option(&h)
+	}
+
+	r := mux.NewRouter().PathPrefix(Prefix).Subrouter()
+	r.Methods("GET").Path("/users").HandlerFunc(h.getUsers)
+	r.Methods("POST").Path("/users").HandlerFunc(h.postUsers)
+	r.Methods("GET").Path("/users/{name}").HandlerFunc(h.getUser)
+	r.Methods("DELETE").Path("/users/{name}").HandlerFunc(h.deleteUser)
+	r.Methods("PUT").Path("/users/{name}/quota").HandlerFunc(h.putQuota)
+	r.Methods("GET").Path("/orgs").HandlerFunc(h.getOrgs)
+	r.Methods("POST").Path("/orgs").HandlerFunc(h.postOrgs)
+	r.Methods("GET").Path("/orgs/{name}").HandlerFunc(h.getOrg)
+	r.Methods("DELETE").Path("/orgs/{name}").HandlerFunc(h.deleteOrg)
+	r.Methods("PUT").Path("/orgs/{name}/quota").HandlerFunc(h.putOrgQuota)
+	r.Methods("GET").Path("/orgs/{name}/members").HandlerFunc(h.getMembers)
+	r.Methods("PUT").Path("/orgs/{name}/members/{user}").HandlerFunc(h.putMember)
+	r.Methods("DELETE").Path("/orgs/{name}/members/{user}").HandlerFunc(h.deleteMember)
+	r.Methods("GET").Path("/tokens").HandlerFunc(h.getTokens)
+	r.Methods("POST").Path("/tokens").HandlerFunc(h.postTokens)
+	r.Methods("POST").Path("/tokens/revoke").HandlerFunc(h.revokeTokens)
+	r.Methods("GET").Path("/pins").HandlerFunc(h.getPins)
+	r.Methods("POST").Path("/pins/status").HandlerFunc(h.setStatus)
+	r.Methods("POST").Path("/pins/requeue").HandlerFunc(h.requeue)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+
+			if h.auth != nil {
+				var err error
+				req, err = h.auth(req)
+				if err != nil {
+					respondError(rw, err)
+					return
+				}
+			}
+
+			if req.Body != nil {
+				req.Body = http.MaxBytesReader(rw, req.Body, maxBodySize)
+			}
+
+			next.ServeHTTP(rw, req)
+		})
+	})
+
+	return r
+}
+
+func (h handler) getUsers(rw http.ResponseWriter, req *http.Request) {
+	users, err := h.a.Users(req.Context())
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, users)
+}
+
+func (h handler) postUsers(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	err := readBody(req, &body)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	u, err := h.a.AddUser(req.Context(), body.Name)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusCreated, u)
+}
+
+func (h handler) getUser(rw http.ResponseWriter, req *http.Request) {
+	u, err := h.a.User(req.Context(), mux.Vars(req)["name"])
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, u)
+}
+
+func (h handler) deleteUser(rw http.ResponseWriter, req *http.Request) {
+	err := h.a.RemoveUser(req.Context(), mux.Vars(req)["name"])
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h handler) putQuota(rw http.ResponseWriter, req *http.Request) {
+	var quota Quota
+	err := readBody(req, &quota)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	u, err := h.a.SetQuota(req.Context(), mux.Vars(req)["name"], quota)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, u)
+}
+
+func (h handler) getOrgs(rw http.ResponseWriter, req *http.Request) {
+	orgs, err := h.a.Orgs(req.Context())
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, orgs)
+}
+
+func (h handler) postOrgs(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	err := readBody(req, &body)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	o, err := h.a.AddOrg(req.Context(), body.Name)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusCreated, o)
+}
+
+func (h handler) getOrg(rw http.ResponseWriter, req *http.Request) {
+	o, err := h.a.Org(req.Context(), mux.Vars(req)["name"])
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, o)
+}
+
+func (h handler) deleteOrg(rw http.ResponseWriter, req *http.Request) {
+	err := h.a.RemoveOrg(req.Context(), mux.Vars(req)["name"])
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h handler) putOrgQuota(rw http.ResponseWriter, req *http.Request) {
+	var quota Quota
+	err := readBody(req, &quota)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	o, err := h.a.SetOrgQuota(req.Context(), mux.Vars(req)["name"], quota)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, o)
+}
+
+func (h handler) getMembers(rw http.ResponseWriter, req *http.Request) {
+	members, err := h.a.Members(req.Context(), mux.Vars(req)["name"])
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, members)
+}
+
+func (h handler) putMember(rw http.ResponseWriter, req *http.Request) {
+	var body memberRequest
+	err := readBody(req, &body)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	vars := mux.Vars(req)
+	m, err := h.a.SetMember(req.Context(), vars["name"], vars["user"], body.Role)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, m)
+}
+
+func (h handler) deleteMember(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	err := h.a.RemoveMember(req.Context(), vars["name"], vars["user"])
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h handler) getTokens(rw http.ResponseWriter, req *http.Request) {
+	toks, err := h.a.Tokens(req.Context(), req.URL.Query().Get("user"))
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, toks)
+}
+
+func (h handler) postTokens(rw http.ResponseWriter, req *http.Request) {
+	var nt NewToken
+	err := readBody(req, &nt)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	tok, err := h.a.AddToken(req.Context(), nt)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusCreated, tokenResponse{Token: tok})
+}
+
+func (h handler) revokeTokens(rw http.ResponseWriter, req *http.Request) {
+	var body tokensRequest
+	err := readBody(req, &body)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+	if len(body.Tokens) == 0 {
+		respondError(rw, invalid("no tokens given"))
+		return
+	}
+
+	n, err := h.a.RemoveTokens(req.Context(), body.Tokens...)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, countResponse{Count: n})
+}
+
+func (h handler) getPins(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	query := PinQuery{
+		User:   q.Get("user"),
+		Org:    q.Get("org"),
+		Status: sips.RequestStatus(q.Get("status")),
+	}
+	if (query.Status != "") && !validStatus(query.Status) {
+		respondError(rw, invalid("invalid status: %q", query.Status))
+		return
+	}
+
+	pins, err := h.a.Pins(req.Context(), query)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, pins)
+}
+
+func (h handler) setStatus(rw http.ResponseWriter, req *http.Request) {
+	var body idsRequest
+	err := readBody(req, &body)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+	if !validStatus(body.Status) {
+		respondError(rw, invalid("invalid status: %q", body.Status))
+		return
+	}
+
+	n, err := h.a.SetStatus(req.Context(), body.Status, body.IDs...)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, countResponse{Count: n})
+}
+
+func (h handler) requeue(rw http.ResponseWriter, req *http.Request) {
+	var body idsRequest
+	err := readBody(req, &body)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	n, err := h.a.Requeue(req.Context(), body.IDs...)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	respond(rw, http.StatusOK, countResponse{Count: n})
+}
+
+func validStatus(status sips.RequestStatus) bool {
+	for _, v := range status.Values() {
+		if string(status) == v {
+			return true
+		}
+	}
+	return false
+}
+
+func readBody(req *http.Request, v interface{}) error {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return invalid("read body: %v", err)
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return invalid("failed to parse body: %v", err)
+	}
+	return nil
+}
+
+func respond(rw http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		respondError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(status)
+	rw.Write(buf)
+}
+
+func respondError(rw http.ResponseWriter, err error) {
+	status := statusOf(err)
+
+	var aerr *Error
+	details := err.Error()
+	if errors.As(err, &aerr) {
+		details = aerr.Details
+	}
+
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(errorResponse{
+		Error: errorResponseError{
+			Reason:  reason(status),
+			Details: details,
+		},
+	})
+}
+
+// reason returns a mnemonic for status, such as "NOT_FOUND", in the
+// same style as the pinning service API's.
+func reason(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "STATUS_" + strconv.FormatInt(int64(status), 10)
+	}
+	return strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
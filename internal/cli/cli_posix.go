@@ -13,3 +13,9 @@ var Signals = []os.Signal{
 	os.Interrupt,
 	unix.SIGTERM,
 }
+
+// ReloadSignals are the signals that tell a daemon to reload its
+// configuration, such as its TLS certificates.
+var ReloadSignals = []os.Signal{
+	unix.SIGHUP,
+}
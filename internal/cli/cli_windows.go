@@ -10,3 +10,8 @@ var Signals = []os.Signal{
 	os.Interrupt,
 	windows.SIGTERM,
 }
+
+// ReloadSignals are the signals that tell a daemon to reload its
+// configuration, such as its TLS certificates. Windows has none, so
+// changes are only picked up by watching files.
+var ReloadSignals []os.Signal
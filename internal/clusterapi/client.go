@@ -0,0 +1,285 @@
+// Package clusterapi provides a client for the IPFS Cluster REST API.
+package clusterapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client is a client for the IPFS Cluster REST API.
+type Client struct {
+	client *http.Client
+	base   string
+	user   *url.Userinfo
+}
+
+// NewClient returns a new Client created with the given options.
+func NewClient(options ...ClientOption) *Client {
+	c := Client{
+		client: http.DefaultClient,
+		base:   "http://127.0.0.1:9094",
+	}
+	for _, option := range options {
+		option(&c)
+	}
+
+	return &c
+}
+
+func (c *Client) do(ctx context.Context, data interface{}, method, endpoint string, args url.Values) error {
+	buf, err := c.request(ctx, method, endpoint, args)
+	if err != nil {
+		return err
+	}
+
+	if (data == nil) || (len(bytes.TrimSpace(buf)) == 0) {
+		return nil
+	}
+
+	err = json.Unmarshal(buf, data)
+	if err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) request(ctx context.Context, method, endpoint string, args url.Values) ([]byte, error) {
+	url := c.base + endpoint
+	if len(args) > 0 {
+		url += "?" + args.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if c.user != nil {
+		pass, _ := c.user.Password()
+		req.SetBasicAuth(c.user.Username(), pass)
+	}
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%v %q: %w", method, endpoint, err)
+	}
+	defer rsp.Body.Close()
+
+	buf, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if (rsp.StatusCode < 200) || (rsp.StatusCode >= 300) {
+		return nil, newError(rsp.StatusCode, buf)
+	}
+
+	return buf, nil
+}
+
+// ID describes a cluster peer.
+type ID struct {
+	ID        string   `json:"id"`
+	Peername  string   `json:"peername"`
+	Addresses []string `json:"addresses"`
+	Error     string   `json:"error"`
+	IPFS      IPFSID   `json:"ipfs"`
+}
+
+// IPFSID describes the IPFS node attached to a cluster peer.
+type IPFSID struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+	Error     string   `json:"error"`
+}
+
+// Peers lists the peers in the cluster.
+func (c *Client) Peers(ctx context.Context) ([]ID, error) {
+	var data []ID
+	err := c.stream(ctx, http.MethodGet, "/peers", nil, func(d *json.Decoder) error {
+		var id ID
+		err := d.Decode(&id)
+		data = append(data, id)
+		return err
+	})
+	return data, err
+}
+
+// stream makes a request to an endpoint that returns a list of
+// objects and calls decode once for each of them. Older versions of
+// IPFS Cluster return a JSON array, while newer ones stream a sequence
+// of objects instead.
+func (c *Client) stream(ctx context.Context, method, endpoint string, args url.Values, decode func(*json.Decoder) error) error {
+	buf, err := c.request(ctx, method, endpoint, args)
+	if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(bytes.TrimSpace(buf)))
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("[")) {
+		_, err := d.Token()
+		if err != nil {
+			return fmt.Errorf("unmarshal response: %w", err)
+		}
+	}
+
+	for d.More() {
+		err := decode(d)
+		if err != nil {
+			return fmt.Errorf("unmarshal response: %w", err)
+		}
+	}
+	return nil
+}
+
+// PinOptions are options for adding a pin to the cluster.
+type PinOptions struct {
+	// Name is the name to give to the pin.
+	Name string
+
+	// ReplicationMin and ReplicationMax control the number of peers
+	// that the content will be pinned to. Zero means that the
+	// cluster's defaults are used.
+	ReplicationMin int
+	ReplicationMax int
+
+	// Origins are multiaddresses of peers known to provide the
+	// content.
+	Origins []string
+
+	// Update is the CID of an existing pin that the new pin is
+	// replacing. Its options are used as defaults for the new pin, and
+	// the cluster uses it to speed up pinning.
+	Update string
+}
+
+func (opts PinOptions) values() url.Values {
+	args := make(url.Values)
+	if opts.Name != "" {
+		args.Set("name", opts.Name)
+	}
+	if opts.ReplicationMin != 0 {
+		args.Set("replication-min", strconv.FormatInt(int64(opts.ReplicationMin), 10))
+	}
+	if opts.ReplicationMax != 0 {
+		args.Set("replication-max", strconv.FormatInt(int64(opts.ReplicationMax), 10))
+	}
+	if len(opts.Origins) > 0 {
+		args.Set("origins", strings.Join(opts.Origins, ","))
+	}
+	if opts.Update != "" {
+		args.Set("pin-update", opts.Update)
+	}
+	return args
+}
+
+// Pin is a pin as tracked by the cluster.
+type Pin struct {
+	CID            string   `json:"cid"`
+	Name           string   `json:"name"`
+	Allocations    []string `json:"allocations"`
+	ReplicationMin int      `json:"replication_factor_min"`
+	ReplicationMax int      `json:"replication_factor_max"`
+}
+
+// Pin adds a pin to the cluster. The cluster pins the content in the
+// background, so Status should be used to find out when it's done.
+func (c *Client) Pin(ctx context.Context, cid string, opts PinOptions) (Pin, error) {
+	var data Pin
+	err := c.do(ctx, &data, http.MethodPost, "/pins/"+url.PathEscape(cid), opts.values())
+	return data, err
+}
+
+// Allocations lists the pins that are tracked by the cluster.
+func (c *Client) Allocations(ctx context.Context) ([]Pin, error) {
+	var data []Pin
+	err := c.stream(ctx, http.MethodGet, "/allocations", url.Values{"filter": []string{"pin"}}, func(d *json.Decoder) error {
+		var pin Pin
+		err := d.Decode(&pin)
+		data = append(data, pin)
+		return err
+	})
+	return data, err
+}
+
+// Unpin removes a pin from the cluster.
+func (c *Client) Unpin(ctx context.Context, cid string) error {
+	return c.do(ctx, nil, http.MethodDelete, "/pins/"+url.PathEscape(cid), nil)
+}
+
+// TrackerStatus is the status of a pin on a single cluster peer.
+type TrackerStatus string
+
+const (
+	StatusPinned      TrackerStatus = "pinned"
+	StatusPinning     TrackerStatus = "pinning"
+	StatusPinQueued   TrackerStatus = "pin_queued"
+	StatusPinError    TrackerStatus = "pin_error"
+	StatusUnpinned    TrackerStatus = "unpinned"
+	StatusRemote      TrackerStatus = "remote"
+	StatusClusterErr  TrackerStatus = "cluster_error"
+	StatusUnexpected  TrackerStatus = "unexpectedly_unpinned"
+	StatusSharded     TrackerStatus = "sharded"
+	StatusUnpinQueued TrackerStatus = "unpin_queued"
+	StatusUnpinning   TrackerStatus = "unpinning"
+	StatusUnpinError  TrackerStatus = "unpin_error"
+)
+
+// PinInfo is the status of a pin on a single cluster peer.
+type PinInfo struct {
+	Peername          string        `json:"peername"`
+	IPFSPeerID        string        `json:"ipfs_peer_id"`
+	IPFSPeerAddresses []string      `json:"ipfs_peer_addresses"`
+	Status            TrackerStatus `json:"status"`
+	Error             string        `json:"error"`
+	AttemptCount      int           `json:"attempt_count"`
+}
+
+// GlobalPinInfo is the status of a pin across the entire cluster.
+type GlobalPinInfo struct {
+	CID         string             `json:"cid"`
+	Name        string             `json:"name"`
+	Allocations []string           `json:"allocations"`
+	PeerMap     map[string]PinInfo `json:"peer_map"`
+}
+
+// Status returns the status of a pin across the cluster.
+func (c *Client) Status(ctx context.Context, cid string) (GlobalPinInfo, error) {
+	var data GlobalPinInfo
+	err := c.do(ctx, &data, http.MethodGet, "/pins/"+url.PathEscape(cid), nil)
+	return data, err
+}
+
+type ClientOption func(*Client)
+
+// WithHTTPClient uses the given http.Client instead of
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithBaseURL sets the base URL for accessing the API. The default
+// is "http://127.0.0.1:9094". If the URL contains user info, it is
+// used for basic authentication.
+func WithBaseURL(base string) ClientOption {
+	return func(c *Client) {
+		c.base = strings.TrimSuffix(base, "/")
+
+		u, err := url.Parse(c.base)
+		if (err != nil) || (u.User == nil) {
+			return
+		}
+		c.user = u.User
+		u.User = nil
+		c.base = u.String()
+	}
+}
@@ -0,0 +1,61 @@
+package clusterapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error is an error returned by the IPFS Cluster API itself.
+type Error struct {
+	// Status is the HTTP status code of the response.
+	Status int
+
+	// Message is the error message returned by the API.
+	Message string `json:"message"`
+
+	// Code is the error code returned by the API.
+	Code int `json:"code"`
+}
+
+func newError(status int, body []byte) *Error {
+	err := Error{Status: status}
+	if json.Unmarshal(body, &err) != nil || err.Message == "" {
+		err.Message = string(body)
+	}
+	return &err
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("IPFS Cluster API error (%v): %v", err.Status, err.Message)
+}
+
+// IsNotFound returns true if err indicates that the requested item
+// doesn't exist.
+func IsNotFound(err error) bool {
+	var apierr *Error
+	return errors.As(err, &apierr) && (apierr.Status == http.StatusNotFound)
+}
+
+// IsTemporary returns true if err is likely to be the result of a
+// temporary condition, in which case retrying the request later might
+// succeed.
+func IsTemporary(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apierr *Error
+	if errors.As(err, &apierr) {
+		switch {
+		case apierr.Status == http.StatusTooManyRequests:
+			return true
+		case (apierr.Status >= 400) && (apierr.Status < 500):
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,238 @@
+// Package config loads the configuration shared by sips and sipsctl.
+//
+// Configuration is taken, in increasing order of precedence, from the
+// defaults returned by Default, a YAML file, environment variables,
+// and command-line flags. Every option has the same name in all of
+// them, except that environment variables are upper-case and prefixed
+// with "SIPS_", so, for example, the database connection string can be
+// set with "db: ..." in the file, the $SIPS_DB environment variable,
+// or the -db flag.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased name of each option to
+// get the name of the environment variable that sets it.
+const envPrefix = "SIPS_"
+
+// Config is the configuration of sips and sipsctl. The yaml tag of
+// each field is the name of the option that sets it.
+type Config struct {
+	Addr        string `yaml:"addr"`
+	MetricsAddr string `yaml:"metricsaddr"`
+	AdminAddr   string `yaml:"adminaddr"`
+
+	RateLimit     float64 `yaml:"ratelimit"`
+	RateBurst     int     `yaml:"rateburst"`
+	AuthFailRate  float64 `yaml:"authfailrate"`
+	AuthFailBurst int     `yaml:"authfailburst"`
+	MaxBodySize   int     `yaml:"maxbodysize"`
+	MaxQueued     int     `yaml:"maxqueued"`
+
+	TLSCert     string `yaml:"tlscert"`
+	TLSKey      string `yaml:"tlskey"`
+	TLSClientCA string `yaml:"tlsclientca"`
+
+	Backend    string        `yaml:"backend"`
+	API        string        `yaml:"api"`
+	Cluster    string        `yaml:"cluster"`
+	APITimeout time.Duration `yaml:"apitimeout"`
+	ReplMin    int           `yaml:"replmin"`
+	ReplMax    int           `yaml:"replmax"`
+
+	DBDriver string `yaml:"dbdriver"`
+	DB       string `yaml:"db"`
+	Migrate  bool   `yaml:"migrate"`
+	TokenKey string `yaml:"tokenkey"`
+
+	MaxRetries      int           `yaml:"maxretries"`
+	RetryBackoff    time.Duration `yaml:"retrybackoff"`
+	MaxRetryBackoff time.Duration `yaml:"maxretrybackoff"`
+	Workers         int           `yaml:"workers"`
+	UserWorkers     int           `yaml:"userworkers"`
+
+	WebhookRetries int           `yaml:"webhookretries"`
+	WebhookTimeout time.Duration `yaml:"webhooktimeout"`
+	WebhookWorkers int           `yaml:"webhookworkers"`
+
+	Reconcile       time.Duration `yaml:"reconcile"`
+	ReconcileUnpin  bool          `yaml:"reconcileunpin"`
+	ReconcileDryRun bool          `yaml:"reconciledryrun"`
+
+	LogLevel  string `yaml:"loglevel"`
+	LogFormat string `yaml:"logformat"`
+
+	Server     string `yaml:"server"`
+	AdminToken string `yaml:"admintoken"`
+}
+
+// Default returns the default configuration.
+func Default() Config {
+	return Config{
+		Addr: ":8080",
+
+		RateBurst:     10,
+		AuthFailRate:  0.1,
+		AuthFailBurst: 5,
+		MaxBodySize:   1 << 20,
+
+		Backend:    "kubo",
+		API:        "http://127.0.0.1:5001",
+		Cluster:    "http://127.0.0.1:9094",
+		APITimeout: 30 * time.Second,
+
+		DBDriver: "postgres",
+		DB:       "host=/var/run/postgresql dbname=sips",
+		Migrate:  true,
+		TokenKey: "$CONFIG/sips/token.key",
+
+		MaxRetries:      5,
+		RetryBackoff:    30 * time.Second,
+		MaxRetryBackoff: time.Hour,
+		Workers:         16,
+		UserWorkers:     4,
+
+		WebhookRetries: 8,
+		WebhookTimeout: 10 * time.Second,
+		WebhookWorkers: 4,
+
+		Reconcile: time.Hour,
+
+		LogLevel:  "info",
+		LogFormat: "logfmt",
+	}
+}
+
+// File returns the path of the config file to load. If path is not
+// empty, it is returned as is. Otherwise, $SIPS_CONFIG is used if it is
+// set, and, failing that, "sips/config.yaml" in the user config
+// directory is used if it exists. If there is no config file, an empty
+// string is returned.
+func File(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+		return path, nil
+	}
+
+	cfgdir, err := os.UserConfigDir()
+	if err != nil {
+		return "", nil
+	}
+	path = filepath.Join(cfgdir, "sips", "config.yaml")
+	_, err = os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", fmt.Errorf("check for config file: %w", err)
+	}
+	return path, nil
+}
+
+// Load overrides the options in c with those set in the YAML file at
+// path, if path is not empty, and then with those set in the
+// environment.
+func (c *Config) Load(path string) error {
+	if path != "" {
+		err := c.loadFile(path)
+		if err != nil {
+			return fmt.Errorf("load %q: %w", path, err)
+		}
+	}
+
+	return c.loadEnv()
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	d := yaml.NewDecoder(file)
+	d.KnownFields(true)
+	err = d.Decode(c)
+	if (err != nil) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := optionName(t.Field(i))
+		env := envPrefix + strings.ToUpper(name)
+		str, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		err := setValue(v.Field(i), str)
+		if err != nil {
+			return fmt.Errorf("parse $%v: %w", env, err)
+		}
+	}
+
+	return nil
+}
+
+func optionName(f reflect.StructField) string {
+	return strings.SplitN(f.Tag.Get("yaml"), ",", 2)[0]
+}
+
+func setValue(v reflect.Value, str string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(str)
+
+	case time.Duration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+
+	case int:
+		n, err := strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+
+	case float64:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+
+	case bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	default:
+		panic(fmt.Errorf("unsupported config type: %v", v.Type()))
+	}
+
+	return nil
+}
@@ -9,6 +9,23 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/DeedleFake/sips/internal/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogram(
+		"sips_ipfs_api_request_duration_seconds",
+		"Time taken for the IPFS API to respond to requests, by endpoint.",
+		nil,
+		"endpoint",
+	)
+	requestErrors = metrics.NewCounter(
+		"sips_ipfs_api_errors_total",
+		"Number of requests to the IPFS API that failed, by endpoint.",
+		"endpoint",
+	)
 )
 
 // Client is a client for the IPFS HTTP API.
@@ -43,7 +60,7 @@ func (c *Client) post(ctx context.Context, data interface{}, endpoint string, ar
 	}
 
 	if rsp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status %v: %q", rsp.Status, buf)
+		return newError(rsp.StatusCode, buf)
 	}
 
 	err = json.Unmarshal(buf, data)
@@ -63,10 +80,16 @@ func (c *Client) postResponse(ctx context.Context, endpoint string, args url.Val
 	}
 	req.Header.Set("Content-Type", "application/json")
 
+	start := time.Now()
 	rsp, err := c.client.Do(req)
+	requestDuration.With(endpoint).Since(start)
 	if err != nil {
+		requestErrors.With(endpoint).Inc()
 		return nil, fmt.Errorf("post to %q: %w", endpoint, err)
 	}
+	if rsp.StatusCode != http.StatusOK {
+		requestErrors.With(endpoint).Inc()
+	}
 
 	return rsp, err
 }
@@ -113,6 +136,11 @@ func (c *Client) PinAddProgress(ctx context.Context, cids ...string) (<-chan Pin
 	if err != nil {
 		return nil, err
 	}
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		buf, _ := io.ReadAll(rsp.Body)
+		return nil, newError(rsp.StatusCode, buf)
+	}
 
 	progress := make(chan PinAddProgress)
 	go func() {
@@ -122,6 +150,15 @@ func (c *Client) PinAddProgress(ctx context.Context, cids ...string) (<-chan Pin
 		d := json.NewDecoder(rsp.Body)
 		for {
 			if !d.More() {
+				// Errors that occur after the response has started are
+				// reported via a trailer.
+				if msg := rsp.Trailer.Get("X-Stream-Error"); msg != "" {
+					requestErrors.With("pin/add").Inc()
+					select {
+					case <-ctx.Done():
+					case progress <- PinAddProgress{Err: &Error{Status: rsp.StatusCode, Message: msg}}:
+					}
+				}
 				break
 			}
 
@@ -206,6 +243,47 @@ func (c *Client) SwarmConnect(ctx context.Context, addr string) error {
 	})
 }
 
+type DagStat struct {
+	Size      int64
+	NumBlocks int
+}
+
+// DagStat gets the total size of the DAG rooted at cid.
+func (c *Client) DagStat(ctx context.Context, cid string) (DagStat, error) {
+	// Newer versions of Kubo report the size in TotalSize and the
+	// stats for each root in DagStats, while older ones report the
+	// stats of the single root at the top level.
+	var data struct {
+		Size      int64
+		NumBlocks int
+		TotalSize int64
+		DagStats  []struct {
+			Size      int64
+			NumBlocks int
+		}
+	}
+	err := c.post(ctx, &data, "dag/stat", url.Values{
+		"arg":      []string{cid},
+		"progress": []string{"false"},
+	})
+	if err != nil {
+		return DagStat{}, err
+	}
+
+	if len(data.DagStats) > 0 {
+		stat := DagStat{Size: data.TotalSize}
+		for _, s := range data.DagStats {
+			stat.NumBlocks += s.NumBlocks
+		}
+		return stat, nil
+	}
+
+	return DagStat{
+		Size:      data.Size,
+		NumBlocks: data.NumBlocks,
+	}, nil
+}
+
 type ClientOption func(*Client)
 
 // WithHTTPClient uses the given http.Client instead of
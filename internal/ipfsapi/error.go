@@ -0,0 +1,57 @@
+package ipfsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error is an error returned by the IPFS API itself, as opposed to
+// one that occurred while trying to communicate with it.
+type Error struct {
+	// Status is the HTTP status code of the response.
+	Status int
+
+	// Message is the error message returned by the API.
+	Message string
+
+	// Code is the error code returned by the API, if any.
+	Code int
+}
+
+func newError(status int, body []byte) *Error {
+	err := Error{Status: status}
+	if json.Unmarshal(body, &err) != nil || err.Message == "" {
+		err.Message = string(body)
+	}
+	return &err
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("IPFS API error (%v): %v", err.Status, err.Message)
+}
+
+// IsTemporary returns true if err is likely to be the result of a
+// temporary condition, such as a timeout or the IPFS node being
+// unreachable, in which case retrying the request later might
+// succeed. Errors that the API reports as being caused by the request
+// itself are not considered temporary.
+func IsTemporary(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apierr *Error
+	if errors.As(err, &apierr) {
+		switch {
+		case apierr.Status == http.StatusTooManyRequests:
+			return true
+		case (apierr.Status >= 400) && (apierr.Status < 500):
+			return false
+		}
+	}
+
+	return true
+}
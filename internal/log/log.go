@@ -1,20 +1,89 @@
+// Package log implements a simple structured, leveled logger.
+//
+// Every message is written as a single line, either in logfmt or JSON
+// format, along with its level, the location that it was logged from,
+// and any fields that have been attached to the context that it was
+// logged with.
 package log
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-const flags = log.Ldate | log.Ltime | log.LUTC | log.Lmsgprefix
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+	LevelFatal
+)
+
+// ParseLevel parses a level from its name.
+func ParseLevel(str string) (Level, error) {
+	switch strings.ToLower(str) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	default:
+		return 0, fmt.Errorf("invalid log level: %q", str)
+	}
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	case LevelFatal:
+		return "fatal"
+	default:
+		return "level(" + strconv.FormatInt(int64(l), 10) + ")"
+	}
+}
+
+// Format is the format that log messages are written in.
+type Format string
+
+const (
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+// ParseFormat parses a format from its name.
+func ParseFormat(str string) (Format, error) {
+	switch f := Format(strings.ToLower(str)); f {
+	case FormatLogfmt, FormatJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid log format: %q", str)
+	}
+}
 
 var (
-	info  = log.New(os.Stderr, "[INFO] ", flags)
-	err   = log.New(os.Stderr, "[ERROR] ", flags)
-	fatal = log.New(os.Stderr, "[FATAL] ", flags)
+	m      sync.Mutex
+	out    io.Writer = os.Stderr
+	level            = LevelInfo
+	format           = FormatLogfmt
 
 	packageDir string
 )
@@ -27,33 +96,216 @@ func init() {
 	packageDir = filepath.Join(filepath.Dir(file), "..", "..")
 }
 
+// SetLevel sets the minimum level of messages that are logged. The
+// default is LevelInfo.
+func SetLevel(l Level) {
+	m.Lock()
+	defer m.Unlock()
+	level = l
+}
+
+// SetFormat sets the format that messages are written in. The
+// default is FormatLogfmt.
+func SetFormat(f Format) {
+	m.Lock()
+	defer m.Unlock()
+	format = f
+}
+
+// SetOutput sets the destination of log messages. The default is
+// standard error.
+func SetOutput(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	out = w
+}
+
+func enabled(l Level) bool {
+	m.Lock()
+	defer m.Unlock()
+	return l >= level
+}
+
 func getLocation() string {
-	_, file, line, ok := runtime.Caller(2)
+	_, file, line, ok := runtime.Caller(3)
 	if !ok {
 		return "unknown location"
 	}
-	file = strings.TrimPrefix(file, packageDir)[1:]
+	if rel, err := filepath.Rel(packageDir, file); err == nil {
+		file = rel
+	}
 	return fmt.Sprintf("%v:%v", file, line)
 }
 
-// Infof logs an informational message.
-func Infof(str string, args ...interface{}) {
-	loc := getLocation()
-	msg := fmt.Sprintf(str, args...)
-	info.Printf("(%v) %v", loc, msg)
+type field struct {
+	key string
+	val interface{}
 }
 
-// Errorf logs an error. As a special case, it returns a new error
-// constructed from its arguments via fmt.Errorf.
-func Errorf(str string, args ...interface{}) error {
+type ctxKeyFields struct{}
+
+// With returns a copy of ctx with the given fields attached, which
+// are included in everything logged via Ctx with the returned context
+// or contexts derived from it. Fields are given as alternating keys
+// and values.
+func With(ctx context.Context, kv ...interface{}) context.Context {
+	fields, _ := ctx.Value(ctxKeyFields{}).([]field)
+	fields = append(fields[:len(fields):len(fields)], pairs(kv)...)
+	return context.WithValue(ctx, ctxKeyFields{}, fields)
+}
+
+func pairs(kv []interface{}) []field {
+	fields := make([]field, 0, (len(kv)+1)/2)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var val interface{} = "MISSING"
+		if i+1 < len(kv) {
+			val = kv[i+1]
+		}
+		fields = append(fields, field{key: key, val: val})
+	}
+	return fields
+}
+
+// Logger logs messages with a set of fields attached.
+type Logger struct {
+	fields []field
+}
+
+// Ctx returns a Logger that includes the fields attached to ctx with
+// With.
+func Ctx(ctx context.Context) Logger {
+	fields, _ := ctx.Value(ctxKeyFields{}).([]field)
+	return Logger{fields: fields}
+}
+
+func (l Logger) log(lvl Level, msg string) {
+	if !enabled(lvl) {
+		return
+	}
+
 	loc := getLocation()
-	nerr := fmt.Errorf(str, args...)
-	err.Printf("(%v) %v", loc, nerr)
-	return nerr
+	fields := make([]field, 0, 4+len(l.fields))
+	fields = append(
+		fields,
+		field{key: "time", val: time.Now().UTC().Format(time.RFC3339Nano)},
+		field{key: "level", val: lvl.String()},
+		field{key: "caller", val: loc},
+		field{key: "msg", val: msg},
+	)
+	fields = append(fields, l.fields...)
+
+	m.Lock()
+	defer m.Unlock()
+
+	var line []byte
+	switch format {
+	case FormatJSON:
+		line = appendJSON(nil, fields)
+	default:
+		line = appendLogfmt(nil, fields)
+	}
+	out.Write(append(line, '\n'))
+}
+
+// Debugf logs a message that is only useful when diagnosing problems.
+func (l Logger) Debugf(str string, args ...interface{}) {
+	l.log(LevelDebug, fmt.Sprintf(str, args...))
+}
+
+// Infof logs an informational message.
+func (l Logger) Infof(str string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(str, args...))
+}
+
+// Errorf logs an error. Errors should be logged once, by whatever
+// finally handles them, rather than everywhere that they are passed
+// through, so functions that return an error should generally not
+// also log it.
+func (l Logger) Errorf(str string, args ...interface{}) {
+	l.log(LevelError, fmt.Errorf(str, args...).Error())
 }
 
 // Fatalf logs a fatal error and immediately exits.
+func (l Logger) Fatalf(str string, args ...interface{}) {
+	l.log(LevelFatal, fmt.Sprintf(str, args...))
+	os.Exit(1)
+}
+
+// Debugf logs a message without any fields. See Logger.Debugf.
+func Debugf(str string, args ...interface{}) {
+	Logger{}.log(LevelDebug, fmt.Sprintf(str, args...))
+}
+
+// Infof logs a message without any fields. See Logger.Infof.
+func Infof(str string, args ...interface{}) {
+	Logger{}.log(LevelInfo, fmt.Sprintf(str, args...))
+}
+
+// Errorf logs an error without any fields. See Logger.Errorf.
+func Errorf(str string, args ...interface{}) {
+	Logger{}.log(LevelError, fmt.Errorf(str, args...).Error())
+}
+
+// Fatalf logs a fatal error without any fields and immediately exits.
 func Fatalf(str string, args ...interface{}) {
-	loc := getLocation()
-	fatal.Fatalf("(%v) %v", loc, fmt.Sprintf(str, args...))
+	Logger{}.log(LevelFatal, fmt.Sprintf(str, args...))
+	os.Exit(1)
+}
+
+func fieldString(val interface{}) string {
+	switch val := val.(type) {
+	case string:
+		return val
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func appendLogfmt(buf []byte, fields []field) []byte {
+	for i, f := range fields {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, f.key...)
+		buf = append(buf, '=')
+
+		val := fieldString(f.val)
+		if (val == "") || strings.ContainsAny(val, " =\"\\\n\t") {
+			buf = strconv.AppendQuote(buf, val)
+			continue
+		}
+		buf = append(buf, val...)
+	}
+	return buf
+}
+
+func appendJSON(buf []byte, fields []field) []byte {
+	buf = append(buf, '{')
+	for i, f := range fields {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+
+		var val interface{} = f.val
+		switch v := val.(type) {
+		case error:
+			val = v.Error()
+		case fmt.Stringer:
+			val = v.String()
+		}
+		enc, err := json.Marshal(val)
+		if err != nil {
+			enc, _ = json.Marshal(fieldString(f.val))
+		}
+		buf = append(buf, enc...)
+	}
+	return append(buf, '}')
 }
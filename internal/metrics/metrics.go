@@ -0,0 +1,377 @@
+// Package metrics is a minimal implementation of metrics that can be
+// scraped by Prometheus. It implements just enough of the Prometheus
+// data model and text exposition format to be useful without
+// depending on the official client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the default histogram buckets. They are meant
+// for measuring latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the package-level constructors.
+var Default = new(Registry)
+
+// Registry is a collection of metrics that are exported together.
+type Registry struct {
+	m        sync.Mutex
+	families []*family
+}
+
+func (r *Registry) register(f *family) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			panic(fmt.Errorf("metric %q registered twice", f.name))
+		}
+	}
+	r.families = append(r.families, f)
+}
+
+// Handler returns an HTTP handler that serves the metrics in r in the
+// Prometheus text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		w := bufio.NewWriter(rw)
+		defer w.Flush()
+		r.write(w)
+	})
+}
+
+func (r *Registry) write(w *bufio.Writer) {
+	r.m.Lock()
+	families := make([]*family, len(r.families))
+	copy(families, r.families)
+	r.m.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// Handler returns an HTTP handler that serves the metrics in the
+// default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// family is a metric and all of its labelled children.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	m        sync.Mutex
+	children map[string]*child
+}
+
+func newFamily(r *Registry, typ, name, help string, buckets []float64, labels []string) *family {
+	f := family{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		buckets:  buckets,
+		children: make(map[string]*child),
+	}
+	r.register(&f)
+	return &f
+}
+
+func (f *family) with(values []string) *child {
+	if len(values) != len(f.labels) {
+		panic(fmt.Errorf("metric %q has %v labels but got %v values", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	c, ok := f.children[key]
+	if !ok {
+		c = &child{
+			labels: formatLabels(f.labels, values),
+			counts: make([]uint64, len(f.buckets)),
+		}
+		f.children[key] = c
+	}
+	return c
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.m.Lock()
+	children := make([]*child, 0, len(f.children))
+	for _, c := range f.children {
+		children = append(children, c)
+	}
+	f.m.Unlock()
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].labels < children[j].labels
+	})
+
+	fmt.Fprintf(w, "# HELP %v %v\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", f.name, f.typ)
+	for _, c := range children {
+		c.write(w, f)
+	}
+}
+
+// child is a single set of label values of a family.
+type child struct {
+	labels string
+
+	m      sync.Mutex
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func (c *child) add(v float64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.value += v
+}
+
+func (c *child) set(v float64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.value = v
+}
+
+func (c *child) observe(buckets []float64, v float64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for i, b := range buckets {
+		if v <= b {
+			c.counts[i]++
+		}
+	}
+	c.count++
+	c.value += v
+}
+
+func (c *child) write(w *bufio.Writer, f *family) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if f.typ != "histogram" {
+		fmt.Fprintf(w, "%v%v %v\n", f.name, braces(c.labels), formatFloat(c.value))
+		return
+	}
+
+	for i, b := range f.buckets {
+		fmt.Fprintf(w, "%v_bucket%v %v\n", f.name, braces(joinLabels(c.labels, `le="`+formatFloat(b)+`"`)), c.counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket%v %v\n", f.name, braces(joinLabels(c.labels, `le="+Inf"`)), c.count)
+	fmt.Fprintf(w, "%v_sum%v %v\n", f.name, braces(c.labels), formatFloat(c.value))
+	fmt.Fprintf(w, "%v_count%v %v\n", f.name, braces(c.labels), c.count)
+}
+
+// CounterVec is a counter, a value that only ever increases,
+// partitioned by a set of labels.
+type CounterVec struct {
+	f *family
+}
+
+// NewCounter registers a new counter with the default registry.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter registers a new counter with r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: newFamily(r, "counter", name, help, nil, labels)}
+}
+
+// With returns the counter with the given label values, which must
+// be in the same order as the labels that the counter was created
+// with.
+func (v *CounterVec) With(values ...string) Counter {
+	return Counter{c: v.f.with(values)}
+}
+
+// Counter is a single counter of a CounterVec.
+type Counter struct {
+	c *child
+}
+
+// Inc increments the counter by one.
+func (c Counter) Inc() {
+	c.c.add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter decreased")
+	}
+	c.c.add(v)
+}
+
+// GaugeVec is a gauge, a value that can go up and down, partitioned
+// by a set of labels.
+type GaugeVec struct {
+	f *family
+}
+
+// NewGauge registers a new gauge with the default registry.
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewGauge registers a new gauge with r.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: newFamily(r, "gauge", name, help, nil, labels)}
+}
+
+// With returns the gauge with the given label values.
+func (v *GaugeVec) With(values ...string) Gauge {
+	return Gauge{c: v.f.with(values)}
+}
+
+// Gauge is a single gauge of a GaugeVec.
+type Gauge struct {
+	c *child
+}
+
+// Set sets the gauge to v.
+func (g Gauge) Set(v float64) {
+	g.c.set(v)
+}
+
+// Add adds v to the gauge.
+func (g Gauge) Add(v float64) {
+	g.c.add(v)
+}
+
+// Inc increments the gauge by one.
+func (g Gauge) Inc() {
+	g.c.add(1)
+}
+
+// Dec decrements the gauge by one.
+func (g Gauge) Dec() {
+	g.c.add(-1)
+}
+
+// HistogramVec is a histogram, which counts observations in
+// configurable buckets, partitioned by a set of labels.
+type HistogramVec struct {
+	f *family
+}
+
+// NewHistogram registers a new histogram with the default registry.
+// If buckets is nil, DefaultBuckets is used.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram registers a new histogram with r. If buckets is nil,
+// DefaultBuckets is used.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &HistogramVec{f: newFamily(r, "histogram", name, help, buckets, labels)}
+}
+
+// With returns the histogram with the given label values.
+func (v *HistogramVec) With(values ...string) Histogram {
+	return Histogram{c: v.f.with(values), buckets: v.f.buckets}
+}
+
+// Histogram is a single histogram of a HistogramVec.
+type Histogram struct {
+	c       *child
+	buckets []float64
+}
+
+// Observe adds a single observation to the histogram.
+func (h Histogram) Observe(v float64) {
+	h.c.observe(h.buckets, v)
+}
+
+// Since observes the amount of time that has passed since start in
+// seconds.
+func (h Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func formatLabels(names, values []string) string {
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
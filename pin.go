@@ -12,6 +12,15 @@ const (
 	Failed  RequestStatus = "failed"
 )
 
+func (s RequestStatus) valid() bool {
+	switch s {
+	case Queued, Pinning, Pinned, Failed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s RequestStatus) Values() []string {
 	return []string{
 		string(Queued),
@@ -24,19 +33,39 @@ func (s RequestStatus) Values() []string {
 // PinStatus indicates the status of a pinning request and provides
 // associated info.
 type PinStatus struct {
-	RequestID string        `json:"requestid"`
-	Status    RequestStatus `json:"status"`
-	Created   time.Time     `json:"created"`
-	Delegates []string      `json:"delegates,omitempty"`
-	Info      interface{}   `json:"info,omitempty"`
+	RequestID string            `json:"requestid"`
+	Status    RequestStatus     `json:"status"`
+	Created   time.Time         `json:"created"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info,omitempty"`
 
 	Pin Pin `json:"pin"`
 }
 
+// PinList is a page of pinning request statuses.
+type PinList struct {
+	// Count is the total number of requests that matched the query,
+	// not just the number included in Results.
+	Count int `json:"count"`
+
+	// Results is the requested page of matching requests.
+	Results []PinStatus `json:"results"`
+}
+
 // Pin describes a single pinned item.
 type Pin struct {
-	CID     string      `json:"cid"`
-	Name    string      `json:"name"`
-	Origins []string    `json:"origins,omitempty"`
-	Meta    interface{} `json:"meta,omitempty"`
+	CID     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+func (p Pin) validate() error {
+	if p.CID == "" {
+		return errNoCID
+	}
+	if len(p.Name) > 255 {
+		return errNameTooLong
+	}
+	return nil
 }
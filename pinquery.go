@@ -32,11 +32,9 @@ type PinQuery struct {
 	Limit int
 
 	// Meta is used to filter against the Meta field of the returned
-	// requests. Note that this is simply the result of unmarshalling
-	// json using the encoding/json package, so it will likely be a
-	// map[string]interface{}, but it might not be, either. It is up to
-	// the handler to deal with this as it sees fit.
-	Meta interface{}
+	// requests. A request matches if its Meta contains every key in
+	// this map with the same value.
+	Meta map[string]string
 }
 
 func defaultPinQuery() PinQuery {
@@ -0,0 +1,145 @@
+package sips
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TokenInfo describes an auth token without revealing it.
+type TokenInfo struct {
+	// Prefix is the start of the token, which identifies it.
+	Prefix string `json:"prefix"`
+
+	Label   string     `json:"label,omitempty"`
+	Scopes  []string   `json:"scopes"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	LastUsed *time.Time `json:"lastused,omitempty"`
+	LastIP   string     `json:"lastip,omitempty"`
+}
+
+// NewToken describes an auth token to be created.
+type NewToken struct {
+	Label string `json:"label,omitempty"`
+
+	// Scopes are the scopes to grant the token. If it is empty, the
+	// service decides which to grant.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Expires is when the token expires. If it is nil, it never does.
+	// Services may limit it, such as to when the token that is
+	// creating it expires.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (tok NewToken) validate() error {
+	if len(tok.Label) > 255 {
+		return errLabelTooLong
+	}
+	return nil
+}
+
+// CreatedToken is a newly created auth token. It is the only time
+// that the token itself is available.
+type CreatedToken struct {
+	Token string `json:"token"`
+	TokenInfo
+}
+
+// TokenHandler may be implemented by a PinHandler to allow clients to
+// manage their own auth tokens. If it is, the handler returned by
+// Handler serves "/tokens" and its subpaths.
+//
+// The context passed to each method is set up in the same way as it is
+// for the methods of PinHandler, and errors are handled in the same
+// way.
+type TokenHandler interface {
+	// Tokens returns the tokens belonging to the client.
+	Tokens(ctx context.Context) ([]TokenInfo, error)
+
+	// AddToken creates a new token for the client.
+	AddToken(ctx context.Context, tok NewToken) (CreatedToken, error)
+
+	// RevokeToken revokes the client's token with the given prefix.
+	RevokeToken(ctx context.Context, prefix string) error
+}
+
+func (h handler) getTokens(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	toks, err := h.h.(TokenHandler).Tokens(ctx)
+	if err != nil {
+		respondError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	if toks == nil {
+		toks = []TokenInfo{}
+	}
+
+	respond(rw, http.StatusOK, toks)
+}
+
+func (h handler) postTokens(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		respondError(rw, bodyErrorStatus(err), err)
+		return
+	}
+
+	var tok NewToken
+	err = json.Unmarshal(body, &tok)
+	if err != nil {
+		respondError(
+			rw,
+			http.StatusBadRequest,
+			fmt.Errorf("failed to parse body: %w", err),
+		)
+		return
+	}
+	err = tok.validate()
+	if err != nil {
+		respondError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	created, err := h.h.(TokenHandler).AddToken(ctx, tok)
+	if err != nil {
+		respondError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	respond(rw, http.StatusCreated, created)
+}
+
+func (h handler) deleteTokenByPrefix(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	vars := mux.Vars(req)
+	prefix := vars["prefix"]
+	if prefix == "" {
+		respondError(
+			rw,
+			http.StatusBadRequest,
+			errNoTokenPrefix,
+		)
+		return
+	}
+
+	err := h.h.(TokenHandler).RevokeToken(ctx, prefix)
+	if err != nil {
+		respondError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Yields no response body if successful.
+	rw.WriteHeader(http.StatusNoContent)
+}